@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/redirect"
+)
+
+// accountConfig 账号配置, 优先读取 <账号名>_ 前缀的配置, 未设置时使用不带前缀的配置
+type accountConfig struct {
+	name   string
+	prefix string
+}
+
+// accountConfigs 按 ACCOUNTS 配置的账号列表, 未配置时只有一个使用不带前缀配置的默认账号
+func accountConfigs() []accountConfig {
+	names := splitList(viper.GetString("ACCOUNTS"))
+	if len(names) == 0 {
+		return []accountConfig{{}}
+	}
+	configs := make([]accountConfig, 0, len(names))
+	for _, name := range names {
+		configs = append(configs, accountConfig{name: name, prefix: strings.ToUpper(name) + "_"})
+	}
+	return configs
+}
+
+// splitList 拆分逗号分隔的配置
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (c accountConfig) key(key string) string {
+	if c.prefix != "" && viper.IsSet(c.prefix+key) {
+		return c.prefix + key
+	}
+	return key
+}
+
+func (c accountConfig) GetString(key string) string {
+	return viper.GetString(c.key(key))
+}
+
+func (c accountConfig) GetInt(key string) int {
+	return viper.GetInt(c.key(key))
+}
+
+func (c accountConfig) GetFloat64(key string) float64 {
+	return viper.GetFloat64(c.key(key))
+}
+
+func (c accountConfig) GetBool(key string) bool {
+	return viper.GetBool(c.key(key))
+}
+
+func (c accountConfig) GetDuration(key string) time.Duration {
+	return viper.GetDuration(c.key(key))
+}
+
+// metric 账号的统计名称, 默认账号不加后缀
+func (c accountConfig) metric(name string) string {
+	if c.name == "" {
+		return name
+	}
+	return name + "/" + c.name
+}
+
+// account 一个机器人账号的连接及发送者
+type account struct {
+	name       string
+	transport  connTransport
+	client     *redirect.WSClientRedirector // TRANSPORT=client 时的连接
+	routes     map[string]http.Handler
+	correlator *redirect.Correlator
+	outbox     *redirect.Outbox
+	outbound   *OutboundScheduler
+	sender     hub.SenderInterface
+	point      hub.PointInterface
+	plugins    []string
+	replayer   *redirect.Replayer
+	recorder   *redirect.Recorder
+	journal    *DeductionJournal
+	ledger     bool // 使用本地积分
+}
+
+func newAccount(ctx context.Context, c accountConfig, ledger *Ledger) *account {
+	outbox, err := redirect.NewOutbox(
+		redirect.OutboxCapacity(c.GetInt("WS_OUTBOX_CAPACITY")),
+		redirect.OutboxMaxAge(c.GetDuration("WS_OUTBOX_MAX_AGE")),
+		redirect.OutboxMaxAttempts(c.GetInt("WS_OUTBOX_MAX_ATTEMPTS")),
+		redirect.OutboxFile(c.GetString("WS_OUTBOX_FILE")),
+		redirect.OutboxDeadLetter(c.GetString("WS_DEAD_LETTER_FILE")),
+	)
+	if err != nil {
+		panic(err)
+	}
+	a := &account{name: c.name, outbox: outbox, plugins: splitList(c.GetString("PLUGINS"))}
+	a.transport, a.routes = c.newTransport(ctx, outbox)
+	a.client, _ = a.transport.(*redirect.WSClientRedirector)
+	a.replayer, _ = a.transport.(*redirect.Replayer)
+	if file := c.GetString("RECORD_FILE"); file != "" {
+		a.recorder, err = redirect.NewRecorder(a.transport, file)
+		if err != nil {
+			panic(err)
+		}
+		slog.Info("录制消息", "account", c.name, "file", file)
+		a.transport = a.recorder
+	}
+	a.correlator = redirect.NewCorrelator(a.transport, hub.ResponseID, c.GetDuration("WS_RESPONSE_TIMEOUT"))
+	if a.client != nil {
+		a.client.OnDisconnected(a.failPending)
+	}
+	a.outbound = NewOutboundScheduler(commandSender(a.correlator, c.GetBool("WS_AWAIT_RESPONSE")),
+		OutboundGroupLimit(c.GetFloat64("OUTBOUND_GROUP_RATE"), c.GetInt("OUTBOUND_GROUP_BURST")),
+		OutboundGlobalLimit(c.GetFloat64("OUTBOUND_GLOBAL_RATE"), c.GetInt("OUTBOUND_GLOBAL_BURST")),
+		OutboundQueue(c.GetInt("OUTBOUND_QUEUE")),
+		OutboundCoalesce(c.GetInt("OUTBOUND_COALESCE")),
+	)
+	registerMetric(c.metric("outbound"), func() any { return a.outbound.Stats() })
+	username, password := c.GetString("WS_USERNAME"), c.GetString("WS_PASSWORD")
+	if a.replayer != nil {
+		// 重放时不上传资源, 不修改真实的积分
+		slog.Info("重放使用内存中的积分", "account", c.name, "balance", c.GetInt("REPLAY_POINT_BALANCE"))
+		a.sender = NewSender(c.GetString("API_HOST"), username, password, a.outbound.Send, SenderUpload(discardUpload))
+		a.point = newMemoryPoint(c.GetInt("REPLAY_POINT_BALANCE"))
+		return a
+	}
+	a.sender = NewSender(c.GetString("API_HOST"), username, password, a.outbound.Send)
+	a.point, a.ledger = c.newPoint(a, ledger)
+	return a
+}
+
+// newPoint 按 POINT_BACKEND 配置选择积分, remote: 积分服务, ledger: 本地数据库, 未配置时使用积分服务
+func (c accountConfig) newPoint(a *account, ledger *Ledger) (hub.PointInterface, bool) {
+	switch backend := c.GetString("POINT_BACKEND"); backend {
+	case "ledger":
+		slog.Info("使用本地积分", "account", c.name)
+		return ledger, true
+	case "", "remote":
+	default:
+		panic(fmt.Sprintf("account %q: unknown POINT_BACKEND %q", c.name, backend))
+	}
+	pointOptions := []PointOption{
+		PointRetry(c.GetInt("POINT_RETRY_ATTEMPTS"), redirect.Backoff{
+			Min:    c.GetDuration("POINT_RETRY_MIN"),
+			Max:    c.GetDuration("POINT_RETRY_MAX"),
+			Factor: 2,
+			Jitter: 0.2,
+		}),
+	}
+	if file := c.GetString("POINT_JOURNAL_FILE"); file != "" {
+		journal, err := OpenDeductionJournal(file)
+		if err != nil {
+			panic(err)
+		}
+		a.journal = journal
+		pointOptions = append(pointOptions, PointJournal(journal))
+	}
+	return NewPointManage(c.GetString("API_HOST_POINT"), c.GetString("WS_USERNAME"), c.GetString("WS_PASSWORD"), pointOptions...), false
+}
+
+// OnMessage 收到的消息标记所属账号后交给 handle
+func (a *account) OnMessage(handle func(message *hub.Message) error) {
+	a.correlator.OnMessage(func(bs []byte) error {
+		message := &hub.Message{}
+		if err := json.Unmarshal(bs, message); err != nil {
+			slog.Error("消息反序列化失败", "account", a.name, "err", err)
+			return err
+		}
+		message.Account = a.name
+		return handle(message)
+	})
+}
+
+// OnConnection 连接建立或断开时调用 fn, 注册时先以当前状态调用一次, 状态未变化时也可能重复调用,
+// 只有主动连接hub(TRANSPORT=client)时可得知连接变化, 其他连接方式不调用
+func (a *account) OnConnection(fn func(connected bool)) {
+	if a.client == nil {
+		return
+	}
+	a.client.OnConnected(func() {
+		slog.Info("账号已连接hub", "account", a.name)
+		fn(true)
+	})
+	a.client.OnDisconnected(func(err error) {
+		slog.Warn("账号与hub断开连接", "account", a.name, "err", err)
+		a.failPending(err)
+		fn(false)
+	})
+	fn(a.client.State() == redirect.StateConnected)
+}
+
+// failPending 与hub断开连接时, 等待响应的命令不再等待, 断开前发出的命令可能已丢失
+func (a *account) failPending(error) {
+	a.correlator.FailPending(redirect.ErrDisconnected)
+}
+
+func (a *account) Close() {
+	if a.recorder != nil {
+		_ = a.recorder.Close()
+	}
+	if a.replayer != nil {
+		_ = a.replayer.Close()
+	}
+	_ = a.journal.Close()
+}
+
+// connTransport 可查询连接状态的消息通道
+type connTransport interface {
+	redirect.Transport
+	State() redirect.ConnState
+}
+
+// newTransport 按 TRANSPORT 配置创建与hub的连接, client: 主动连接hub, server: 等待hub连接,
+// http: 通过webhook接收消息, 通过http请求发送命令, replay: 重放录制文件, 发送的命令只写入捕获文件
+// 返回需要挂载到http服务上的路由
+func (c accountConfig) newTransport(ctx context.Context, outbox *redirect.Outbox) (connTransport, map[string]http.Handler) {
+	server := c.GetString("WS_SERVER")
+	username := c.GetString("WS_USERNAME")
+	password := c.GetString("WS_PASSWORD")
+	switch mode := c.GetString("TRANSPORT"); mode {
+	case "client":
+		if server == "" {
+			panic(fmt.Sprintf("account %q: %s", c.name, "WS_SERVER is empty"))
+		}
+		u, err := url.Parse(server)
+		if err != nil {
+			panic(err)
+		}
+		query := u.Query()
+		query.Set("username", username)
+		query.Set("password", password)
+		u.RawQuery = query.Encode()
+		options := []redirect.WSClientOption{
+			redirect.WSClientHeartbeat(30 * time.Second),
+			redirect.WSClientOutbox(outbox),
+			redirect.WSClientBackoff(redirect.Backoff{
+				Min:    c.GetDuration("WS_RECONNECT_MIN"),
+				Max:    c.GetDuration("WS_RECONNECT_MAX"),
+				Factor: c.GetFloat64("WS_RECONNECT_FACTOR"),
+				Jitter: c.GetFloat64("WS_RECONNECT_JITTER"),
+			}),
+		}
+		if c.GetBool("WS_AWAIT_RESPONSE") {
+			// 命令带有请求id, 收到hub的响应后才从待发送队列移除
+			options = append(options, redirect.WSClientAck(hub.ResponseID))
+		}
+		client := redirect.NewWebsocketClientMessageHandler(ctx, u.String(), options...)
+		client.OnReconnecting(func(attempt int, delay time.Duration) {
+			slog.Warn("websocket等待重连", "account", c.name, "attempt", attempt, "delay", delay)
+		})
+		return client, nil
+	case "server":
+		if username == "" || password == "" {
+			panic(fmt.Sprintf("account %q: %s", c.name, "WS_USERNAME or WS_PASSWORD is empty"))
+		}
+		path := c.GetString("WS_SERVER_PATH")
+		wsServer := redirect.NewWebsocketServerMessageHandler(ctx,
+			redirect.WSServerHeartbeat(30*time.Second),
+			redirect.WSServerOutbox(outbox),
+			redirect.WSServerBasicAuth(username, password),
+			redirect.WSServerRoute(hub.RouteGID),
+		)
+		registerMetric(c.metric("connections"), func() any { return wsServer.Connections() })
+		slog.Info("等待hub连接", "account", c.name, "path", path)
+		return wsServer, map[string]http.Handler{path: wsServer}
+	case "http":
+		commandUrl := c.GetString("HTTP_COMMAND_URL")
+		if commandUrl == "" {
+			panic(fmt.Sprintf("account %q: %s", c.name, "HTTP_COMMAND_URL is empty"))
+		}
+		secret := c.GetString("HTTP_SECRET")
+		if secret == "" && (username == "" || password == "") {
+			panic(fmt.Sprintf("account %q: %s", c.name, "HTTP_SECRET or WS_USERNAME/WS_PASSWORD is required"))
+		}
+		options := []redirect.HTTPOption{
+			redirect.HTTPOutbox(outbox),
+			redirect.HTTPTimeout(c.GetDuration("HTTP_COMMAND_TIMEOUT")),
+			redirect.HTTPBackoff(redirect.Backoff{
+				Min:    c.GetDuration("WS_RECONNECT_MIN"),
+				Max:    c.GetDuration("WS_RECONNECT_MAX"),
+				Factor: c.GetFloat64("WS_RECONNECT_FACTOR"),
+				Jitter: c.GetFloat64("WS_RECONNECT_JITTER"),
+			}),
+		}
+		if username != "" {
+			options = append(options, redirect.HTTPBasicAuth(username, password))
+		}
+		if secret != "" {
+			options = append(options, redirect.HTTPSignature(secret))
+		}
+		path := c.GetString("HTTP_WEBHOOK_PATH")
+		webhook := redirect.NewHTTPMessageHandler(ctx, commandUrl, options...)
+		slog.Info("等待hub推送消息", "account", c.name, "path", path, "command", commandUrl)
+		return webhook, map[string]http.Handler{path: webhook}
+	case "replay":
+		replayer, err := redirect.NewReplayer(c.GetString("REPLAY_FILE"),
+			redirect.ReplaySpeed(c.GetFloat64("REPLAY_SPEED")),
+			redirect.ReplayCapture(c.GetString("REPLAY_CAPTURE")),
+			redirect.ReplayRespond(replayResponse),
+		)
+		if err != nil {
+			panic(err)
+		}
+		return replayer, nil
+	default:
+		panic(fmt.Sprintf("account %q: unknown TRANSPORT: %s", c.name, mode))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/spf13/viper"
+	"testing"
+)
+
+func TestNewPointBackend(t *testing.T) {
+	t.Cleanup(func() {
+		viper.Set("POINT_BACKEND", "")
+		viper.Set("API_HOST_POINT", "")
+	})
+	ledger := NewLedger(nil)
+	tests := []struct {
+		backend string
+		apiHost string
+		ledger  bool
+	}{
+		// 未配置 POINT_BACKEND 时与之前一样使用积分服务, 本地积分需显式启用
+		{"", "", false},
+		{"", "http://point", false},
+		{"remote", "", false},
+		{"ledger", "", true},
+		{"ledger", "http://point", true},
+	}
+	for _, tt := range tests {
+		viper.Set("POINT_BACKEND", tt.backend)
+		viper.Set("API_HOST_POINT", tt.apiHost)
+		point, usesLedger := accountConfig{}.newPoint(&account{}, ledger)
+		if usesLedger != tt.ledger {
+			t.Fatalf("POINT_BACKEND=%q API_HOST_POINT=%q: ledger = %v", tt.backend, tt.apiHost, usesLedger)
+		}
+		if _, ok := point.(*PointManage); ok == tt.ledger {
+			t.Fatalf("POINT_BACKEND=%q API_HOST_POINT=%q: point = %T", tt.backend, tt.apiHost, point)
+		}
+	}
+	viper.Set("POINT_BACKEND", "unknown")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("未知的 POINT_BACKEND 应 panic")
+		}
+	}()
+	accountConfig{}.newPoint(&account{}, ledger)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	journalPending  = "pending"  // 即将发送请求
+	journalOK       = "ok"       // 扣除或退还成功
+	journalRejected = "rejected" // 积分服务拒绝
+	journalUnknown  = "unknown"  // 未收到积分服务的响应, 是否扣除或退还未知, 需要对账
+
+	journalPay    = "pay"    // 扣除
+	journalRefund = "refund" // 退还
+)
+
+type (
+	// deductionJournalEntry 一次扣除或退还尝试的记录
+	deductionJournalEntry struct {
+		Time        time.Time `json:"time"`
+		Kind        string    `json:"kind"`
+		Key         string    `json:"key,omitempty"`
+		Attempt     int       `json:"attempt"`
+		Status      string    `json:"status"`
+		GID         string    `json:"gid"`
+		UID         string    `json:"uid"`
+		Point       int       `json:"point"`
+		Command     string    `json:"command"`
+		DeductionID string    `json:"deductionId,omitempty"`
+		Balance     int       `json:"balance,omitempty"`
+		Reason      string    `json:"reason,omitempty"`
+		Error       string    `json:"error,omitempty"`
+	}
+
+	// DeductionJournal 按行追加写入JSON的扣除及退还记录, 用于与积分服务对账
+	DeductionJournal struct {
+		mu   sync.Mutex
+		file *os.File
+	}
+)
+
+// OpenDeductionJournal 以追加方式打开记录文件
+func OpenDeductionJournal(file string) (*DeductionJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeductionJournal{file: f}, nil
+}
+
+// write 写入一条记录, j 为nil时不记录
+func (j *DeductionJournal) write(entry deductionJournalEntry) {
+	if j == nil {
+		return
+	}
+	entry.Time = time.Now()
+	bs, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("组装扣除记录失败", "entry", entry, "err", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(bs, '\n')); err != nil {
+		slog.Error("写入扣除记录失败", "entry", entry, "err", err)
+	}
+}
+
+func (j *DeductionJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+type (
+	dedupeEntry struct {
+		Key  string    `json:"key"`
+		Seen time.Time `json:"seen"`
+	}
+
+	// DedupeStats 去重统计
+	DedupeStats struct {
+		Size    int   `json:"size"`    // 当前记录的消息数
+		Dropped int64 `json:"dropped"` // 丢弃的重复消息数
+	}
+
+	// Deduplicator 按账号和MsgID去重, 时间窗口内重复收到的消息直接丢弃
+	Deduplicator struct {
+		mu       sync.Mutex
+		ttl      time.Duration
+		capacity int
+		file     string
+		seen     map[string]time.Time
+		order    []dedupeEntry // 按记录时间排序, 用于淘汰
+		dropped  atomic.Int64
+	}
+
+	DedupeOption func(d *Deduplicator)
+)
+
+// DedupeTTL 记录消息的时间窗口
+func DedupeTTL(ttl time.Duration) DedupeOption {
+	return func(d *Deduplicator) {
+		d.ttl = ttl
+	}
+}
+
+// DedupeCapacity 最多记录的消息数, 超出时淘汰最早的记录, 0表示不限制
+func DedupeCapacity(capacity int) DedupeOption {
+	return func(d *Deduplicator) {
+		d.capacity = capacity
+	}
+}
+
+// DedupeFile 持久化记录的文件, 重启后继续去重
+func DedupeFile(file string) DedupeOption {
+	return func(d *Deduplicator) {
+		d.file = file
+	}
+}
+
+func NewDeduplicator(options ...DedupeOption) (*Deduplicator, error) {
+	d := &Deduplicator{
+		ttl:      10 * time.Minute,
+		capacity: 10000,
+		seen:     map[string]time.Time{},
+	}
+	for _, option := range options {
+		option(d)
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func dedupeKey(message *hub.Message) string {
+	return message.Account + "/" + message.MsgID
+}
+
+// Seen 消息是否已经收到过, 未收到过时记录该消息, 时间窗口为0时不去重
+func (d *Deduplicator) Seen(message *hub.Message) bool {
+	if message.MsgID == "" || d.ttl <= 0 {
+		return false
+	}
+	key := dedupeKey(message)
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pruneLocked(now, 0)
+	if _, ok := d.seen[key]; ok {
+		d.dropped.Add(1)
+		slog.Warn("重复的消息 已丢弃", "account", message.Account, "gid", message.GID, "msgID", message.MsgID)
+		return true
+	}
+	d.pruneLocked(now, 1)
+	d.seen[key] = now
+	d.order = append(d.order, dedupeEntry{Key: key, Seen: now})
+	return false
+}
+
+// Forget 删除消息的记录, 消息未能处理时调用, 使重新投递的消息可以再次处理
+func (d *Deduplicator) Forget(message *hub.Message) {
+	if message.MsgID == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, dedupeKey(message))
+}
+
+// pruneLocked 淘汰过期的记录, 并为即将添加的 reserve 条记录腾出容量, 需持有锁
+func (d *Deduplicator) pruneLocked(now time.Time, reserve int) {
+	i := 0
+	for ; i < len(d.order); i++ {
+		entry := d.order[i]
+		seen, ok := d.seen[entry.Key]
+		if ok && seen.Equal(entry.Seen) && now.Sub(seen) < d.ttl && (d.capacity <= 0 || len(d.seen)+reserve <= d.capacity) {
+			break
+		}
+		if ok && seen.Equal(entry.Seen) {
+			delete(d.seen, entry.Key)
+		}
+	}
+	d.order = d.order[i:]
+}
+
+// Stats 去重统计
+func (d *Deduplicator) Stats() DedupeStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return DedupeStats{Size: len(d.seen), Dropped: d.dropped.Load()}
+}
+
+func (d *Deduplicator) load() error {
+	if d.file == "" {
+		return nil
+	}
+	bs, err := os.ReadFile(d.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var entries []dedupeEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return fmt.Errorf("读取消息去重记录失败: %w", err)
+	}
+	for _, entry := range entries {
+		d.seen[entry.Key] = entry.Seen
+		d.order = append(d.order, entry)
+	}
+	d.pruneLocked(time.Now(), 0)
+	slog.Info("恢复消息去重记录", "count", len(d.seen), "file", d.file)
+	return nil
+}
+
+// Save 将记录写入文件
+func (d *Deduplicator) Save() error {
+	if d.file == "" {
+		return nil
+	}
+	d.mu.Lock()
+	d.pruneLocked(time.Now(), 0)
+	entries := make([]dedupeEntry, 0, len(d.seen))
+	for _, entry := range d.order {
+		if seen, ok := d.seen[entry.Key]; ok && seen.Equal(entry.Seen) {
+			entries = append(entries, entry)
+		}
+	}
+	d.mu.Unlock()
+	bs, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.file), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := d.file + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.file)
+}
+
+// SaveEvery 定期写入文件, ctx 取消时返回
+func (d *Deduplicator) SaveEvery(ctx context.Context, interval time.Duration) {
+	if d.file == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Save(); err != nil {
+				slog.Error("保存消息去重记录失败", "err", err)
+			}
+		}
+	}
+}
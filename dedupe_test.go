@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+)
+
+func mustDeduplicator(t *testing.T, options ...DedupeOption) *Deduplicator {
+	t.Helper()
+	d, err := NewDeduplicator(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func messageID(id string) *hub.Message {
+	return hubtest.NewMessage("hello").ID(id).Build()
+}
+
+func TestDedupeDropsRedelivered(t *testing.T) {
+	d := mustDeduplicator(t)
+	if d.Seen(messageID("m1")) {
+		t.Fatal("首次收到的消息不应丢弃")
+	}
+	if !d.Seen(messageID("m1")) {
+		t.Fatal("重复收到的消息应丢弃")
+	}
+	if d.Seen(hubtest.NewMessage("hello").ID("m1").Account("other").Build()) {
+		t.Fatal("不同账号的消息不应视为重复")
+	}
+	if d.Seen(messageID("")) || d.Seen(messageID("")) {
+		t.Fatal("没有MsgID的消息不去重")
+	}
+	if stats := d.Stats(); stats.Size != 2 || stats.Dropped != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestDedupeForget(t *testing.T) {
+	d := mustDeduplicator(t)
+	d.Seen(messageID("m1"))
+	d.Forget(messageID("m1"))
+	if d.Seen(messageID("m1")) {
+		t.Fatal("Forget 后重新投递的消息应再次处理")
+	}
+	if !d.Seen(messageID("m1")) {
+		t.Fatal("再次记录后应去重")
+	}
+}
+
+func TestDedupeTTL(t *testing.T) {
+	d := mustDeduplicator(t, DedupeTTL(20*time.Millisecond))
+	d.Seen(messageID("m1"))
+	time.Sleep(30 * time.Millisecond)
+	if d.Seen(messageID("m1")) {
+		t.Fatal("超过时间窗口的消息不应视为重复")
+	}
+	if d.Stats().Size != 1 {
+		t.Fatalf("过期的记录应淘汰, stats = %+v", d.Stats())
+	}
+	if disabled := mustDeduplicator(t, DedupeTTL(0)); disabled.Seen(messageID("m1")) || disabled.Seen(messageID("m1")) {
+		t.Fatal("时间窗口为0时不去重")
+	}
+}
+
+func TestDedupeCapacity(t *testing.T) {
+	d := mustDeduplicator(t, DedupeCapacity(2))
+	for _, id := range []string{"m1", "m2", "m3"} {
+		d.Seen(messageID(id))
+	}
+	if d.Stats().Size != 2 {
+		t.Fatalf("stats = %+v", d.Stats())
+	}
+	if !d.Seen(messageID("m3")) {
+		t.Fatal("容量内的记录应保留")
+	}
+	if d.Seen(messageID("m1")) {
+		t.Fatal("超出容量时应淘汰最早的记录")
+	}
+	// 重新记录 m1 淘汰了 m2
+	if d.Seen(messageID("m2")) {
+		t.Fatal("m2 应已被淘汰")
+	}
+}
+
+func TestDedupePersistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dedupe.json")
+	d := mustDeduplicator(t, DedupeFile(file))
+	d.Seen(messageID("m1"))
+	d.Seen(messageID("m2"))
+	d.Forget(messageID("m2"))
+	if err := d.Save(); err != nil {
+		t.Fatal(err)
+	}
+	restored := mustDeduplicator(t, DedupeFile(file))
+	if stats := restored.Stats(); stats.Size != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if !restored.Seen(messageID("m1")) {
+		t.Fatal("重启后应继续去重")
+	}
+	if restored.Seen(messageID("m2")) {
+		t.Fatal("已删除的记录不应保存")
+	}
+	// 恢复时淘汰已过期的记录
+	expired := mustDeduplicator(t, DedupeFile(file), DedupeTTL(time.Nanosecond))
+	if stats := expired.Stats(); stats.Size != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
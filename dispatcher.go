@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"wechat-hub-plugin/hub"
+)
+
+// OverflowPolicy 群消息队列已满时的处理策略
+type OverflowPolicy string
+
+const (
+	OverflowDropOldest OverflowPolicy = "drop_oldest" // 丢弃队列中最早的消息
+	OverflowReject     OverflowPolicy = "reject"      // 拒绝新消息并回复提示
+	OverflowBlock      OverflowPolicy = "block"       // 阻塞等待队列空闲
+)
+
+var (
+	ErrQueueFull        = errors.New("消息队列已满")
+	ErrDispatcherClosed = errors.New("消息分发已关闭")
+)
+
+type groupQueue struct {
+	messages []*hub.Message
+	running  bool
+}
+
+// Dispatcher 消息分发器, 不同群的消息由工作协程并行处理, 同一个群内的消息按接收顺序依次处理
+type Dispatcher struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queues   map[string]*groupQueue
+	ready    []string
+	depth    int
+	overflow OverflowPolicy
+	handle   func(message *hub.Message) error
+	onReject func(message *hub.Message)
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewDispatcher(workers int, depth int, overflow OverflowPolicy, handle func(message *hub.Message) error) *Dispatcher {
+	if workers <= 0 {
+		workers = 1
+	}
+	if depth <= 0 {
+		depth = 1
+	}
+	switch overflow {
+	case OverflowDropOldest, OverflowReject, OverflowBlock:
+	default:
+		slog.Warn("未知的队列溢出策略, 使用drop_oldest", "overflow", overflow)
+		overflow = OverflowDropOldest
+	}
+	d := &Dispatcher{
+		queues:   map[string]*groupQueue{},
+		depth:    depth,
+		overflow: overflow,
+		handle:   handle,
+	}
+	d.cond = sync.NewCond(&d.mu)
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// OnReject 设置拒绝消息时的回调, 仅在 OverflowReject 策略下调用
+func (d *Dispatcher) OnReject(fn func(message *hub.Message)) {
+	d.onReject = fn
+}
+
+// queueKey 同一账号下同一个群的消息使用同一个队列
+func queueKey(message *hub.Message) string {
+	if message.GID != "" {
+		return message.Account + "/" + message.GID
+	}
+	return message.Account + "/" + message.UID
+}
+
+// Dispatch 将消息放入所属群的队列
+func (d *Dispatcher) Dispatch(message *hub.Message) error {
+	key := queueKey(message)
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return ErrDispatcherClosed
+	}
+	q, ok := d.queues[key]
+	if !ok {
+		q = &groupQueue{}
+		d.queues[key] = q
+	}
+	for len(q.messages) >= d.depth {
+		switch d.overflow {
+		case OverflowReject:
+			d.mu.Unlock()
+			slog.Warn("消息队列已满 拒绝消息", "gid", message.GID, "msgID", message.MsgID)
+			if d.onReject != nil {
+				d.onReject(message)
+			}
+			return ErrQueueFull
+		case OverflowBlock:
+			d.cond.Wait()
+			if d.closed {
+				d.mu.Unlock()
+				return ErrDispatcherClosed
+			}
+			// 等待期间队列可能已处理完并被移除
+			if current, ok := d.queues[key]; ok {
+				q = current
+			} else {
+				q = &groupQueue{}
+				d.queues[key] = q
+			}
+		default:
+			dropped := q.messages[0]
+			q.messages = q.messages[1:]
+			slog.Warn("消息队列已满 丢弃最早的消息", "gid", dropped.GID, "msgID", dropped.MsgID)
+		}
+	}
+	q.messages = append(q.messages, message)
+	if !q.running {
+		q.running = true
+		d.ready = append(d.ready, key)
+		d.cond.Broadcast()
+	}
+	d.mu.Unlock()
+	return nil
+}
+
+// Close 停止接收新消息, 等待已入队的消息处理完成
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// Shutdown 停止接收新消息并等待已入队的消息处理完成, ctx 结束时丢弃尚未开始处理的消息, 返回丢弃的消息数
+func (d *Dispatcher) Shutdown(ctx context.Context) int {
+	done := make(chan struct{})
+	go func() {
+		d.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dropped := 0
+	for _, q := range d.queues {
+		for _, message := range q.messages {
+			slog.Warn("关闭超时 丢弃未处理的消息", "gid", message.GID, "msgID", message.MsgID)
+		}
+		dropped += len(q.messages)
+		q.messages = nil
+	}
+	// 正在处理的群处理完当前消息后移除, 等待中的群直接移除
+	for _, key := range d.ready {
+		delete(d.queues, key)
+	}
+	d.ready = nil
+	d.cond.Broadcast()
+	return dropped
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	d.mu.Lock()
+	for {
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.ready) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		key := d.ready[0]
+		d.ready = d.ready[1:]
+		q := d.queues[key]
+		message := q.messages[0]
+		q.messages = q.messages[1:]
+		d.mu.Unlock()
+
+		d.process(message)
+
+		d.mu.Lock()
+		if len(q.messages) > 0 {
+			// 放回队尾, 避免单个群长期占用工作协程
+			d.ready = append(d.ready, key)
+		} else {
+			q.running = false
+			delete(d.queues, key)
+		}
+		d.cond.Broadcast()
+	}
+}
+
+func (d *Dispatcher) process(message *hub.Message) {
+	defer func() {
+		if e := recover(); e != nil {
+			slog.Error("消息处理出错", "gid", message.GID, "msgID", message.MsgID, "error", e)
+		}
+	}()
+	if err := d.handle(message); err != nil {
+		slog.Error("消息处理失败", "gid", message.GID, "msgID", message.MsgID, "err", err)
+	}
+}
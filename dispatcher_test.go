@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+// recorder 按处理顺序记录消息id, 消息id为 block 时阻塞到 release 关闭
+type recorder struct {
+	mu      sync.Mutex
+	handled map[string][]string // 按群记录
+	started chan string
+	release chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{handled: map[string][]string{}, started: make(chan string, 1000), release: make(chan struct{})}
+}
+
+func (r *recorder) handle(message *hub.Message) error {
+	r.started <- message.MsgID
+	if message.MsgID == "block" {
+		<-r.release
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handled[message.GID] = append(r.handled[message.GID], message.MsgID)
+	return nil
+}
+
+func (r *recorder) group(gid string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.handled[gid])
+}
+
+// waitStarted 等待消息 id 开始处理
+func (r *recorder) waitStarted(t *testing.T, id string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case started := <-r.started:
+			if started == id {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("消息 %s 未开始处理", id)
+		}
+	}
+}
+
+func groupMessage(gid string, id string) *hub.Message {
+	return &hub.Message{BaseMessage: hub.BaseMessage{MsgType: 1, MsgID: id, GID: gid}, Content: id}
+}
+
+func TestDispatcherKeepsGroupOrder(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(4, 100, OverflowBlock, r.handle)
+	want := map[string][]string{}
+	for i := 0; i < 50; i++ {
+		for _, gid := range []string{"g1", "g2", "g3"} {
+			id := fmt.Sprintf("%s-%d", gid, i)
+			want[gid] = append(want[gid], id)
+			if err := d.Dispatch(groupMessage(gid, id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d.Close()
+	for gid, ids := range want {
+		if got := r.group(gid); !slices.Equal(got, ids) {
+			t.Fatalf("群 %s 的处理顺序 = %v, want %v", gid, got, ids)
+		}
+	}
+}
+
+func TestDispatcherHandlesGroupsInParallel(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(2, 10, OverflowBlock, r.handle)
+	defer d.Close()
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "after"))
+	_ = d.Dispatch(groupMessage("g2", "other"))
+	r.waitStarted(t, "other")
+	if got := r.group("g1"); len(got) != 0 {
+		t.Fatalf("同一个群的消息应等待前一条处理完成: %v", got)
+	}
+	close(r.release)
+}
+
+func TestDispatcherDropOldest(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 2, OverflowDropOldest, r.handle)
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	for _, id := range []string{"m2", "m3", "m4"} {
+		if err := d.Dispatch(groupMessage("g1", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(r.release)
+	d.Close()
+	if got, want := r.group("g1"), []string{"block", "m3", "m4"}; !slices.Equal(got, want) {
+		t.Fatalf("handled = %v, want %v", got, want)
+	}
+}
+
+func TestDispatcherReject(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 2, OverflowReject, r.handle)
+	var rejected []string
+	d.OnReject(func(message *hub.Message) {
+		rejected = append(rejected, message.MsgID)
+	})
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	_ = d.Dispatch(groupMessage("g1", "m3"))
+	if err := d.Dispatch(groupMessage("g1", "m4")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("err = %v, want ErrQueueFull", err)
+	}
+	// 其他群不受影响
+	if err := d.Dispatch(groupMessage("g2", "other")); err != nil {
+		t.Fatal(err)
+	}
+	close(r.release)
+	d.Close()
+	if !slices.Equal(rejected, []string{"m4"}) {
+		t.Fatalf("rejected = %v", rejected)
+	}
+	if got, want := r.group("g1"), []string{"block", "m2", "m3"}; !slices.Equal(got, want) {
+		t.Fatalf("handled = %v, want %v", got, want)
+	}
+}
+
+func TestDispatcherBlock(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 1, OverflowBlock, r.handle)
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	dispatched := make(chan error, 1)
+	go func() {
+		dispatched <- d.Dispatch(groupMessage("g1", "m3"))
+	}()
+	select {
+	case err := <-dispatched:
+		t.Fatalf("队列已满时应阻塞, err = %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(r.release)
+	if err := <-dispatched; err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if got, want := r.group("g1"), []string{"block", "m2", "m3"}; !slices.Equal(got, want) {
+		t.Fatalf("handled = %v, want %v", got, want)
+	}
+}
+
+func TestDispatcherBlockedDispatchReturnsOnClose(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 1, OverflowBlock, r.handle)
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	dispatched := make(chan error, 1)
+	go func() {
+		dispatched <- d.Dispatch(groupMessage("g1", "m3"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	if err := <-dispatched; !errors.Is(err, ErrDispatcherClosed) {
+		t.Fatalf("err = %v, want ErrDispatcherClosed", err)
+	}
+	close(r.release)
+	<-closed
+	// 关闭前已入队的消息仍然处理
+	if got, want := r.group("g1"), []string{"block", "m2"}; !slices.Equal(got, want) {
+		t.Fatalf("handled = %v, want %v", got, want)
+	}
+	if err := d.Dispatch(groupMessage("g1", "m4")); !errors.Is(err, ErrDispatcherClosed) {
+		t.Fatalf("err = %v, want ErrDispatcherClosed", err)
+	}
+}
+
+func TestDispatcherBlockedDispatchReturnsOnShutdown(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 1, OverflowBlock, r.handle)
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	dispatched := make(chan error, 1)
+	go func() {
+		dispatched <- d.Dispatch(groupMessage("g1", "m3"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if dropped := d.Shutdown(ctx); dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+	if err := <-dispatched; !errors.Is(err, ErrDispatcherClosed) {
+		t.Fatalf("err = %v, want ErrDispatcherClosed", err)
+	}
+	close(r.release)
+}
+
+func TestDispatcherShutdownDrainsQueued(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 10, OverflowBlock, r.handle)
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(r.release)
+	}()
+	if dropped := d.Shutdown(context.Background()); dropped != 0 {
+		t.Fatalf("dropped = %d", dropped)
+	}
+	if got := r.group("g1"); !slices.Equal(got, []string{"block", "m2"}) {
+		t.Fatalf("关闭前应处理完已入队的消息: %v", got)
+	}
+	if err := d.Dispatch(groupMessage("g1", "m3")); !errors.Is(err, ErrDispatcherClosed) {
+		t.Fatalf("err = %v, want ErrDispatcherClosed", err)
+	}
+}
+
+func TestDispatcherShutdownTimeoutDropsQueued(t *testing.T) {
+	r := newRecorder()
+	d := NewDispatcher(1, 10, OverflowBlock, r.handle)
+	_ = d.Dispatch(groupMessage("g1", "block"))
+	r.waitStarted(t, "block")
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	_ = d.Dispatch(groupMessage("g2", "m3"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if dropped := d.Shutdown(ctx); dropped != 2 {
+		t.Fatalf("dropped = %d, want 2", dropped)
+	}
+	close(r.release)
+	d.Close()
+	if got := r.group("g1"); !slices.Equal(got, []string{"block"}) {
+		t.Fatalf("超时后不应处理丢弃的消息: %v", got)
+	}
+	if got := r.group("g2"); len(got) != 0 {
+		t.Fatalf("超时后不应处理丢弃的消息: %v", got)
+	}
+}
+
+func TestDispatcherRecoversPanic(t *testing.T) {
+	var mu sync.Mutex
+	var handled []string
+	d := NewDispatcher(1, 10, OverflowBlock, func(message *hub.Message) error {
+		if message.MsgID == "panic" {
+			panic("出错了")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, message.MsgID)
+		return nil
+	})
+	_ = d.Dispatch(groupMessage("g1", "panic"))
+	_ = d.Dispatch(groupMessage("g1", "m2"))
+	d.Close()
+	if !slices.Equal(handled, []string{"m2"}) {
+		t.Fatalf("panic后应继续处理, handled = %v", handled)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+	"wechat-hub-plugin/redirect"
+)
+
+// echoPlugin 回复 #echo 命令的参数
+type echoPlugin struct{}
+
+func (echoPlugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{Name: "echo", Args: []hub.ArgSpec{{Name: "text", Type: hub.ArgText, Required: true}}, Handler: func(ctx *hub.Context, args *hub.Args) error {
+			return ctx.ReplayText(args.String("text"))
+		}},
+	}
+}
+
+// TestHubToServiceRoundTrip hub推送的命令消息经 websocket 连接及 Dispatcher 交给 Service 处理, 回复经出站队列以命令发回hub
+func TestHubToServiceRoundTrip(t *testing.T) {
+	h := hubtest.NewHub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := redirect.NewWebsocketClientMessageHandler(ctx, h.URL,
+		redirect.WSClientBackoff(redirect.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}),
+	)
+	a := &account{name: "bot", transport: client, correlator: redirect.NewCorrelator(client, hub.ResponseID, time.Second)}
+	a.outbound = NewOutboundScheduler(commandSender(a.correlator, true))
+	env := hubtest.NewEnv()
+	s := NewService()
+	s.AddAccount(Account{Name: a.name, Sender: NewSender("", "", "", a.outbound.Send), Point: env.Point})
+	s.AddPlugin(echoPlugin{})
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// 与 main 一致经 Dispatcher 处理, 在连接的读取协程中处理会阻塞响应的接收
+	handled := make(chan error, 1)
+	dispatcher := NewDispatcher(1, 1, OverflowBlock, func(message *hub.Message) error {
+		err := s.Handle(message)
+		handled <- err
+		return err
+	})
+	defer dispatcher.Shutdown(ctx)
+	a.OnMessage(dispatcher.Dispatch)
+	if err := h.WaitConnected(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Send(hubtest.NewCommand("echo", "你好").Group("g1", "群1").Build()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("消息未交给 Service 处理")
+	}
+	commands, err := h.WaitCommands(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := commands[0].Param; reply.Gid != "g1" || reply.Body != "你好" || commands[0].ID == "" {
+		t.Fatalf("command = %+v", commands[0])
+	}
+}
@@ -1,11 +1,38 @@
 package hub
 
+import (
+	"encoding/json"
+)
+
+// 回复类型
+const (
+	SendTypeText  = 1 // 文本
+	SendTypeImage = 2 // 图片
+	SendTypeVideo = 3 // 视频
+	SendTypeFile  = 4 // 文件
+)
+
 type (
 	Command struct {
-		Command string         `json:"command"` // SendMsg:发送消息
+		ID      string         `json:"id,omitempty"` // 请求id, hub的响应中携带相同的id
+		Command string         `json:"command"`      // SendMsg:发送消息
 		Param   SendMsgCommand `json:"param"`
 	}
 
+	// CommandResponse hub对命令的响应
+	CommandResponse struct {
+		ID   string     `json:"id"`
+		Code int        `json:"code"` // 0表示成功
+		Msg  string     `json:"msg"`
+		Data SendResult `json:"data"`
+	}
+
+	// SendResult 发送结果, 未开启响应确认时为零值
+	SendResult struct {
+		MsgID string `json:"msgID"` // 发送的消息id
+		Code  int    `json:"code"`  // hub返回的错误码, 0表示成功
+	}
+
 	SendMsgCommand struct {
 		Gid      string `json:"gid" form:"gid"`           // 群id
 		Type     int    `json:"type" form:"type"`         // 回复类型 1:文本,2:图片,3:视频,4:文件
@@ -14,3 +41,42 @@ type (
 		Prompt   string `json:"prompt" form:"prompt"`     // 回复提示
 	}
 )
+
+// SendOption 发送选项
+type SendOption func(cmd *SendMsgCommand)
+
+// WithPrompt 设置回复提示
+func WithPrompt(prompt string) SendOption {
+	return func(cmd *SendMsgCommand) {
+		cmd.Prompt = prompt
+	}
+}
+
+// ResponseID 判断收到的数据是否为命令响应, 响应带有请求id且不是消息
+func ResponseID(data []byte) (string, bool) {
+	var frame struct {
+		ID      string `json:"id"`
+		MsgType *int   `json:"msgType"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil || frame.ID == "" || frame.MsgType != nil {
+		return "", false
+	}
+	return frame.ID, true
+}
+
+// RouteGID 取出收到的消息或发送的命令所属的群id
+func RouteGID(data []byte) string {
+	var frame struct {
+		GID   string `json:"gid"`
+		Param struct {
+			Gid string `json:"gid"`
+		} `json:"param"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return ""
+	}
+	if frame.Param.Gid != "" {
+		return frame.Param.Gid
+	}
+	return frame.GID
+}
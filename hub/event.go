@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+)
+
+const (
+	EventNameExitGroup   = "ExitGroup"   // 用户退出群聊, Data 为 []EventExitGroupUser
+	EventNameRenameGroup = "RenameGroup" // 群名称修改, Data 为 EventRenameGroup
+	EventNameJoinGroup   = "JoinGroup"   // 用户加入群聊, Data 为 []EventJoinGroupUser
+)
+
+var (
+	eventMu      sync.RWMutex
+	eventDecoder = map[string]func(data []byte) (any, error){}
+)
+
+func init() {
+	RegisterEvent[[]EventExitGroupUser](EventNameExitGroup)
+	RegisterEvent[EventRenameGroup](EventNameRenameGroup)
+	RegisterEvent[[]EventJoinGroupUser](EventNameJoinGroup)
+}
+
+// RegisterEvent 注册事件数据类型, 反序列化消息时将该事件的 Data 解析为 T
+func RegisterEvent[T any](event string) {
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	eventDecoder[event] = func(data []byte) (any, error) {
+		var v T
+		err := json.Unmarshal(data, &v)
+		return v, err
+	}
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type message Message
+	aux := struct {
+		*message
+		Data json.RawMessage `json:"data"`
+	}{message: (*message)(m)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.Data = nil
+	if len(aux.Data) == 0 || bytes.Equal(aux.Data, []byte("null")) {
+		return nil
+	}
+	eventMu.RLock()
+	decode, ok := eventDecoder[m.Event]
+	eventMu.RUnlock()
+	if !ok {
+		m.Data = aux.Data
+		return nil
+	}
+	v, err := decode(aux.Data)
+	if err != nil {
+		slog.Warn("事件数据解析失败 保留原始数据", "event", m.Event, "err", err)
+		m.Data = aux.Data
+		return nil
+	}
+	m.Data = v
+	return nil
+}
+
+// EventData 获取指定类型的事件数据
+func EventData[T any](m *Message) (T, bool) {
+	v, ok := m.Data.(T)
+	return v, ok
+}
+
+// ExitUsers 退群事件的用户
+func (ctx *Context) ExitUsers() ([]EventExitGroupUser, bool) {
+	if ctx.Event != EventNameExitGroup {
+		return nil, false
+	}
+	return EventData[[]EventExitGroupUser](ctx.Message)
+}
+
+// JoinUsers 入群事件的用户
+func (ctx *Context) JoinUsers() ([]EventJoinGroupUser, bool) {
+	if ctx.Event != EventNameJoinGroup {
+		return nil, false
+	}
+	return EventData[[]EventJoinGroupUser](ctx.Message)
+}
+
+// RenameInfo 群名称修改事件的信息
+func (ctx *Context) RenameInfo() (EventRenameGroup, bool) {
+	if ctx.Event != EventNameRenameGroup {
+		return EventRenameGroup{}, false
+	}
+	return EventData[EventRenameGroup](ctx.Message)
+}
@@ -1,17 +1,70 @@
 package hub
 
 import (
+	"context"
 	"io"
+	"time"
 )
 
+// SenderInterface 发送消息, 开启响应确认时返回hub分配的消息id
 type SenderInterface interface {
-	SendText(gid string, content string) error
-	SendNetworkImg(gid string, src string) error
-	SendImg(gid string, filename string, file io.Reader) error
+	SendText(ctx context.Context, gid string, content string, opts ...SendOption) (*SendResult, error)
+	SendNetworkImg(ctx context.Context, gid string, src string, opts ...SendOption) (*SendResult, error)
+	SendImg(ctx context.Context, gid string, filename string, file io.Reader, opts ...SendOption) (*SendResult, error)
+	SendNetworkVideo(ctx context.Context, gid string, src string, opts ...SendOption) (*SendResult, error)
+	SendVideo(ctx context.Context, gid string, filename string, file io.Reader, opts ...SendOption) (*SendResult, error)
+	SendNetworkFile(ctx context.Context, gid string, src string, filename string, opts ...SendOption) (*SendResult, error)
+	SendFile(ctx context.Context, gid string, filename string, file io.Reader, opts ...SendOption) (*SendResult, error)
 }
 
+// Deduction 一次扣除积分的记录, 退还积分时使用
+type Deduction struct {
+	ID      string `json:"id"`            // 积分服务返回的扣除记录id, 旧版积分服务不返回
+	Key     string `json:"key,omitempty"` // 扣除时使用的幂等键
+	GID     string `json:"gid"`
+	UID     string `json:"uid"`
+	Point   int    `json:"point"`
+	Command string `json:"command"`
+	Balance int    `json:"balance"` // 扣除后的积分
+}
+
+type deductionKeyCtx struct{}
+
+// WithDeductionKey 为 ctx 内的积分扣除设置幂等键, 积分服务对相同的键只扣除一次
+func WithDeductionKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, deductionKeyCtx{}, key)
+}
+
+// DeductionKeyFrom ctx 中的幂等键, 未设置时为空
+func DeductionKeyFrom(ctx context.Context) string {
+	key, _ := ctx.Value(deductionKeyCtx{}).(string)
+	return key
+}
+
+// DeductionKey 由消息和命令生成的幂等键, 同一条消息重复投递时不变, 消息没有MsgID时为空
+func DeductionKey(message *Message, command string) string {
+	if message == nil || message.MsgID == "" {
+		return ""
+	}
+	key := message.MsgID + ":" + command
+	if message.Account != "" {
+		key = message.Account + "/" + key
+	}
+	return key
+}
+
+// PointInterface 群内用户的积分, 返回的 int 均为操作后用户的积分
 type PointInterface interface {
-	Pay(gid string, uid string, point int, command string) (int, error)
+	// Pay 扣除积分, 积分不足时返回错误
+	Pay(ctx context.Context, gid string, uid string, point int, command string) (*Deduction, error)
+	// Balance 查询积分
+	Balance(ctx context.Context, gid string, uid string) (int, error)
+	// Refund 退还一次扣除的积分
+	Refund(ctx context.Context, deduction *Deduction, reason string) (int, error)
+	// Grant 增加积分
+	Grant(ctx context.Context, gid string, uid string, point int, reason string) (int, error)
+	// Transfer 在同一个群内的用户间转移积分, 返回转出用户的积分
+	Transfer(ctx context.Context, gid string, fromUID string, toUID string, point int) (int, error)
 }
 
 type DBInterface interface {
@@ -19,17 +72,90 @@ type DBInterface interface {
 	QueryAll(sql string, args ...any) ([]map[string]any, error)
 }
 
-// Plugin 插件接口
-type Plugin interface {
+// Plugin 插件, 需实现 Handler 或 Commander 中的至少一个
+type Plugin any
+
+// Handler 处理所有消息的插件
+type Handler interface {
 	Handle(ctx *Context) error
 }
 
+// Namer 插件名称, 用于日志和按账号启用插件, 未实现时使用类型名
+type Namer interface {
+	Name() string
+}
+
+// Initializer 插件初始化, 在 Start 之前按注册顺序调用
+type Initializer interface {
+	Init(ctx context.Context) error
+}
+
+// Starter 插件启动, 可在此打开资源或启动后台任务, ctx 在服务停止时取消
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper 插件停止, 按注册的逆序调用
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// ConnectionWatcher 关注账号与hub连接状态的插件, 启动后先收到各账号当前的状态, 之后在连接建立或断开时调用,
+// 只收到启用了该插件的账号的状态, 在连接的处理协程中调用, 不应阻塞
+type ConnectionWatcher interface {
+	ConnectionChanged(account string, connected bool)
+}
+
+// Context 消息处理上下文, 同时实现 context.Context, 携带消息处理的截止时间, 服务停止时取消
 type Context struct {
 	*Message
-	Sender SenderInterface
-	Point  PointInterface
-	DB     DBInterface
-	abort  bool
+	Sender  SenderInterface
+	Point   PointInterface
+	DB      DBInterface
+	ctx     context.Context
+	abort   bool
+	command *CommandSpec
+	args    *Args
+
+	reservations []*Reservation
+}
+
+// SetContext 设置消息处理的上下文
+func (ctx *Context) SetContext(c context.Context) {
+	ctx.ctx = c
+}
+
+func (ctx *Context) base() context.Context {
+	if ctx.ctx == nil {
+		return context.Background()
+	}
+	return ctx.ctx
+}
+
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	return ctx.base().Deadline()
+}
+
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.base().Done()
+}
+
+func (ctx *Context) Err() error {
+	return ctx.base().Err()
+}
+
+func (ctx *Context) Value(key any) any {
+	return ctx.base().Value(key)
+}
+
+// MatchedCommand 当前消息匹配到的命令, 非命令消息返回nil, 参数错误时同样返回匹配到的命令
+func (ctx *Context) MatchedCommand() *CommandSpec {
+	return ctx.command
+}
+
+// Args 当前命令解析后的参数, 非命令消息及参数错误时返回nil
+func (ctx *Context) Args() *Args {
+	return ctx.args
 }
 
 func (ctx *Context) IsAbort() bool {
@@ -40,17 +166,67 @@ func (ctx *Context) Abort() {
 }
 
 func (ctx *Context) ReplayText(content string) error {
-	return ctx.Sender.SendText(ctx.GID, content)
+	_, err := ctx.Sender.SendText(ctx, ctx.GID, content)
+	return err
 }
 
 func (ctx *Context) ReplayImg(filename string, file io.Reader) error {
-	return ctx.Sender.SendImg(ctx.GID, filename, file)
+	_, err := ctx.Sender.SendImg(ctx, ctx.GID, filename, file)
+	return err
 }
 
 func (ctx *Context) ReplayNetworkImg(src string) error {
-	return ctx.Sender.SendNetworkImg(ctx.GID, src)
+	_, err := ctx.Sender.SendNetworkImg(ctx, ctx.GID, src)
+	return err
+}
+
+func (ctx *Context) ReplayVideo(filename string, file io.Reader) error {
+	_, err := ctx.Sender.SendVideo(ctx, ctx.GID, filename, file)
+	return err
+}
+
+func (ctx *Context) ReplayNetworkVideo(src string) error {
+	_, err := ctx.Sender.SendNetworkVideo(ctx, ctx.GID, src)
+	return err
+}
+
+func (ctx *Context) ReplayFile(filename string, file io.Reader) error {
+	_, err := ctx.Sender.SendFile(ctx, ctx.GID, filename, file)
+	return err
+}
+
+func (ctx *Context) ReplayNetworkFile(src string, filename string) error {
+	_, err := ctx.Sender.SendNetworkFile(ctx, ctx.GID, src, filename)
+	return err
+}
+
+// UsePoint 扣除积分, 扣除发送消息的用户的积分时使用 DeductionKey 作为幂等键
+func (ctx *Context) UsePoint(gid string, uid string, point int, command string) (*Deduction, error) {
+	if gid != ctx.GID || uid != ctx.UID {
+		return ctx.Point.Pay(ctx, gid, uid, point, command)
+	}
+	return ctx.Point.Pay(WithDeductionKey(ctx, DeductionKey(ctx.Message, command)), gid, uid, point, command)
+}
+
+// PointBalance 发送消息的用户的积分
+func (ctx *Context) PointBalance() (int, error) {
+	return ctx.Point.Balance(ctx, ctx.GID, ctx.UID)
+}
+
+// RefundPoint 退还扣除的积分, 用于处理失败时补偿用户, deduction 为nil时不处理
+func (ctx *Context) RefundPoint(deduction *Deduction, reason string) (int, error) {
+	if deduction == nil {
+		return 0, nil
+	}
+	return ctx.Point.Refund(ctx, deduction, reason)
+}
+
+// GrantPoint 为群内用户增加积分
+func (ctx *Context) GrantPoint(uid string, point int, reason string) (int, error) {
+	return ctx.Point.Grant(ctx, ctx.GID, uid, point, reason)
 }
 
-func (ctx *Context) UsePoint(gid string, uid string, point int, command string) (int, error) {
-	return ctx.Point.Pay(gid, uid, point, command)
+// TransferPoint 将发送消息的用户的积分转给群内其他用户
+func (ctx *Context) TransferPoint(toUID string, point int) (int, error) {
+	return ctx.Point.Transfer(ctx, ctx.GID, ctx.UID, toUID, point)
 }
@@ -9,6 +9,7 @@ type (
 		GroupName string `json:"groupName,omitempty"`
 		UID       string `json:"uid,omitempty"`
 		Username  string `json:"username,omitempty"`
+		Account   string `json:"-"` // 收到消息的机器人账号
 	}
 
 	Quote struct {
@@ -52,6 +53,12 @@ type (
 		Name string `json:"name"` // 用户名
 	}
 
+	// EventJoinGroupUser 系统消息: 用户加入群聊
+	EventJoinGroupUser struct {
+		UID  string `json:"uid"`  // 用户id
+		Name string `json:"name"` // 用户名
+	}
+
 	Message struct {
 		BaseMessage
 		Content string  `json:"content"`
@@ -60,6 +67,6 @@ type (
 		Revoke  *Revoke `json:"revoke,omitempty"`
 		Media   *Media  `json:"media,omitempty"`
 		Event   string  `json:"event"`
-		Data    any     `json:"data"`
+		Data    any     `json:"data"` // 已注册的事件为对应类型, 未注册的事件为 json.RawMessage
 	}
 )
@@ -0,0 +1,18 @@
+package hub
+
+// Middleware 中间件, 调用 next 执行后续的中间件与插件, 不调用则中断处理
+type Middleware func(ctx *Context, next func() error) error
+
+// Chain 按顺序执行中间件, 最后执行 handler
+func Chain(ctx *Context, middlewares []Middleware, handler func() error) error {
+	var call func(i int) error
+	call = func(i int) error {
+		if i >= len(middlewares) {
+			return handler()
+		}
+		return middlewares[i](ctx, func() error {
+			return call(i + 1)
+		})
+	}
+	return call(0)
+}
@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// ReplyMode 回复方式
+type ReplyMode int
+
+const (
+	ReplyPlain   ReplyMode = iota // 直接回复
+	ReplyMention                  // @触发消息的用户
+	ReplyQuote                    // 引用触发的消息
+)
+
+// quoteLimit 引用内容的最大长度, 超出部分省略
+const quoteLimit = 20
+
+// MentionPrompt @消息发送者的回复提示
+func MentionPrompt(message *Message) string {
+	if message.Username == "" {
+		return ""
+	}
+	return "@" + message.Username
+}
+
+// QuotePrompt 引用消息的回复提示, 格式与微信引用一致
+func QuotePrompt(message *Message) string {
+	content := []rune(strings.TrimSpace(message.Content))
+	if len(content) > quoteLimit {
+		content = append(content[:quoteLimit], []rune("...")...)
+	}
+	return "「" + message.Username + ": " + string(content) + "」\n- - - - - - - - - - - - - - -"
+}
+
+// Prompt 按回复方式生成消息的回复提示
+func (m ReplyMode) Prompt(message *Message) string {
+	switch m {
+	case ReplyMention:
+		return MentionPrompt(message)
+	case ReplyQuote:
+		return QuotePrompt(message)
+	default:
+		return ""
+	}
+}
+
+// ReplayMention 回复文本并@触发消息的用户
+func (ctx *Context) ReplayMention(content string) error {
+	_, err := ctx.Sender.SendText(ctx, ctx.GID, content, WithPrompt(MentionPrompt(ctx.Message)))
+	return err
+}
+
+// ReplayQuote 回复文本并引用触发的消息
+func (ctx *Context) ReplayQuote(content string) error {
+	_, err := ctx.Sender.SendText(ctx, ctx.GID, content, WithPrompt(QuotePrompt(ctx.Message)))
+	return err
+}
+
+// promptSender 默认附加回复提示的发送者, 调用时传入的选项优先
+type promptSender struct {
+	SenderInterface
+	prompt string
+}
+
+// NewPromptSender 为经由 sender 发送的所有消息默认附加回复提示
+func NewPromptSender(sender SenderInterface, prompt string) SenderInterface {
+	if prompt == "" {
+		return sender
+	}
+	return &promptSender{SenderInterface: sender, prompt: prompt}
+}
+
+func (p *promptSender) options(opts []SendOption) []SendOption {
+	return append([]SendOption{WithPrompt(p.prompt)}, opts...)
+}
+
+func (p *promptSender) SendText(ctx context.Context, gid string, content string, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendText(ctx, gid, content, p.options(opts)...)
+}
+
+func (p *promptSender) SendNetworkImg(ctx context.Context, gid string, src string, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendNetworkImg(ctx, gid, src, p.options(opts)...)
+}
+
+func (p *promptSender) SendImg(ctx context.Context, gid string, filename string, file io.Reader, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendImg(ctx, gid, filename, file, p.options(opts)...)
+}
+
+func (p *promptSender) SendNetworkVideo(ctx context.Context, gid string, src string, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendNetworkVideo(ctx, gid, src, p.options(opts)...)
+}
+
+func (p *promptSender) SendVideo(ctx context.Context, gid string, filename string, file io.Reader, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendVideo(ctx, gid, filename, file, p.options(opts)...)
+}
+
+func (p *promptSender) SendNetworkFile(ctx context.Context, gid string, src string, filename string, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendNetworkFile(ctx, gid, src, filename, p.options(opts)...)
+}
+
+func (p *promptSender) SendFile(ctx context.Context, gid string, filename string, file io.Reader, opts ...SendOption) (*SendResult, error) {
+	return p.SenderInterface.SendFile(ctx, gid, filename, file, p.options(opts)...)
+}
@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+// recordSender 应用发送选项后记录消息
+type recordSender struct {
+	sent []SendMsgCommand
+}
+
+func (r *recordSender) record(cmd SendMsgCommand, opts []SendOption) (*SendResult, error) {
+	for _, opt := range opts {
+		opt(&cmd)
+	}
+	r.sent = append(r.sent, cmd)
+	return &SendResult{}, nil
+}
+
+func (r *recordSender) SendText(_ context.Context, gid string, content string, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeText, Body: content}, opts)
+}
+
+func (r *recordSender) SendNetworkImg(_ context.Context, gid string, src string, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeImage, Body: src}, opts)
+}
+
+func (r *recordSender) SendImg(_ context.Context, gid string, filename string, _ io.Reader, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeImage, Filename: filename}, opts)
+}
+
+func (r *recordSender) SendNetworkVideo(_ context.Context, gid string, src string, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeVideo, Body: src}, opts)
+}
+
+func (r *recordSender) SendVideo(_ context.Context, gid string, filename string, _ io.Reader, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeVideo, Filename: filename}, opts)
+}
+
+func (r *recordSender) SendNetworkFile(_ context.Context, gid string, src string, filename string, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeFile, Body: src, Filename: filename}, opts)
+}
+
+func (r *recordSender) SendFile(_ context.Context, gid string, filename string, _ io.Reader, opts ...SendOption) (*SendResult, error) {
+	return r.record(SendMsgCommand{Gid: gid, Type: SendTypeFile, Filename: filename}, opts)
+}
+
+func TestReplyModePrompt(t *testing.T) {
+	message := &Message{BaseMessage: BaseMessage{Username: "张三"}, Content: "  0123456789012345678901234  "}
+	tests := []struct {
+		mode ReplyMode
+		want string
+	}{
+		{ReplyPlain, ""},
+		{ReplyMention, "@张三"},
+		// 引用内容超过20个字符时省略
+		{ReplyQuote, "「张三: 01234567890123456789...」\n- - - - - - - - - - - - - - -"},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.Prompt(message); got != tt.want {
+			t.Fatalf("mode %d Prompt() = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+	if prompt := MentionPrompt(&Message{}); prompt != "" {
+		t.Fatalf("没有用户名时不@, prompt = %q", prompt)
+	}
+	if prompt := QuotePrompt(&Message{BaseMessage: BaseMessage{Username: "李四"}, Content: "你好"}); prompt != "「李四: 你好」\n- - - - - - - - - - - - - - -" {
+		t.Fatalf("prompt = %q", prompt)
+	}
+}
+
+func TestReplayMentionAndQuote(t *testing.T) {
+	sender := &recordSender{}
+	ctx := &Context{Message: &Message{BaseMessage: BaseMessage{GID: "gid", Username: "张三"}, Content: "原文"}, Sender: sender}
+	if err := ctx.ReplayMention("hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.ReplayQuote("hi"); err != nil {
+		t.Fatal(err)
+	}
+	if sender.sent[0].Prompt != "@张三" || sender.sent[1].Prompt != QuotePrompt(ctx.Message) {
+		t.Fatalf("sent = %+v", sender.sent)
+	}
+	// 回复提示随发送命令一起序列化
+	bs, err := json.Marshal(sender.sent[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), `"prompt":"@张三"`) {
+		t.Fatalf("json = %s", bs)
+	}
+}
+
+func TestPromptSender(t *testing.T) {
+	sender := &recordSender{}
+	if NewPromptSender(sender, "") != SenderInterface(sender) {
+		t.Fatal("回复提示为空时应直接返回原发送者")
+	}
+	prompted := NewPromptSender(sender, "@张三")
+	_, _ = prompted.SendText(context.Background(), "gid", "a")
+	_, _ = prompted.SendImg(context.Background(), "gid", "a.png", strings.NewReader("png"))
+	_, _ = prompted.SendNetworkFile(context.Background(), "gid", "http://example.com/a.pdf", "a.pdf")
+	// 调用时传入的选项优先
+	_, _ = prompted.SendText(context.Background(), "gid", "b", WithPrompt("@李四"))
+	want := []string{"@张三", "@张三", "@张三", "@李四"}
+	for i, prompt := range want {
+		if sender.sent[i].Prompt != prompt {
+			t.Fatalf("sent[%d] = %+v, want prompt %q", i, sender.sent[i], prompt)
+		}
+	}
+}
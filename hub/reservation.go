@@ -0,0 +1,118 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var ErrReservationClosed = errors.New("积分预留已确认或已取消")
+
+// Reservation 预留的积分, 确认前处理失败、panic或超时都会退还
+type Reservation struct {
+	point     PointInterface
+	deduction *Deduction
+	mu        sync.Mutex
+	closed    bool
+	stop      func() bool
+}
+
+// Reserve 预留发送消息的用户的积分, 积分立即扣除, 消息处理结束前未 Commit 时自动退还, ctx 已结束时不扣除
+func (ctx *Context) Reserve(point int, command string) (*Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deduction, err := ctx.UsePoint(ctx.GID, ctx.UID, point, command)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reservation{point: ctx.Point, deduction: deduction}
+	// 扣除期间 ctx 可能已结束, 此时回调立即执行, 持有锁直到 stop 赋值后回调才能取消预留
+	r.mu.Lock()
+	r.stop = context.AfterFunc(ctx, func() {
+		reason := "处理未完成"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "处理超时"
+		}
+		_ = r.Cancel(reason)
+	})
+	r.mu.Unlock()
+	ctx.reservations = append(ctx.reservations, r)
+	return r, nil
+}
+
+// CancelReservations 退还未确认的积分预留, 消息处理结束时调用
+func (ctx *Context) CancelReservations(reason string) {
+	for _, r := range ctx.reservations {
+		_ = r.Cancel(reason)
+	}
+	ctx.reservations = nil
+}
+
+// Deduction 预留时的扣除记录
+func (r *Reservation) Deduction() *Deduction {
+	return r.deduction
+}
+
+// close 标记预留已结束, 已结束时返回false
+func (r *Reservation) close() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return false
+	}
+	r.closed = true
+	r.stop()
+	return true
+}
+
+// Commit 确认扣除, 应在回复发送成功后调用, r 为nil时不做处理
+func (r *Reservation) Commit() error {
+	if r == nil {
+		return nil
+	}
+	if !r.close() {
+		return ErrReservationClosed
+	}
+	return nil
+}
+
+// Cancel 取消预留并退还积分, r 为nil时不做处理
+func (r *Reservation) Cancel(reason string) error {
+	if r == nil {
+		return nil
+	}
+	if !r.close() {
+		return ErrReservationClosed
+	}
+	// 消息处理可能已超时, 使用新的 ctx 退还
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := r.point.Refund(ctx, r.deduction, reason); err != nil {
+		slog.Error("退还预留积分失败", "deduction", r.deduction, "reason", reason, "err", err)
+		return err
+	}
+	slog.Info("退还预留积分", "gid", r.deduction.GID, "uid", r.deduction.UID, "point", r.deduction.Point, "command", r.deduction.Command, "reason", reason)
+	return nil
+}
+
+// PayFor 预留积分后执行 fn, fn 返回nil时确认扣除, 返回错误或panic时退还
+func (ctx *Context) PayFor(point int, command string, fn func() error) error {
+	r, err := ctx.Reserve(point, command)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			_ = r.Cancel("处理出错")
+			panic(e)
+		}
+	}()
+	if err := fn(); err != nil {
+		_ = r.Cancel(err.Error())
+		return err
+	}
+	return r.Commit()
+}
@@ -0,0 +1,211 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryPoint 内存中的积分, 记录退还的原因
+type memoryPoint struct {
+	mu      sync.Mutex
+	balance int
+	refunds []string
+	onPay   func() // 扣除时调用
+}
+
+func (p *memoryPoint) Pay(_ context.Context, gid string, uid string, point int, command string) (*Deduction, error) {
+	if p.onPay != nil {
+		p.onPay()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.balance < point {
+		return nil, fmt.Errorf("积分不足, 当前积分%d", p.balance)
+	}
+	p.balance -= point
+	return &Deduction{ID: "d1", GID: gid, UID: uid, Point: point, Command: command, Balance: p.balance}, nil
+}
+
+func (p *memoryPoint) Balance(context.Context, string, string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.balance, nil
+}
+
+func (p *memoryPoint) Refund(_ context.Context, deduction *Deduction, reason string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.balance += deduction.Point
+	p.refunds = append(p.refunds, reason)
+	return p.balance, nil
+}
+
+func (p *memoryPoint) Grant(context.Context, string, string, int, string) (int, error) {
+	return 0, errors.New("不支持")
+}
+
+func (p *memoryPoint) Transfer(context.Context, string, string, string, int) (int, error) {
+	return 0, errors.New("不支持")
+}
+
+func (p *memoryPoint) refunded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.refunds)
+}
+
+// waitRefunded 等待异步的退还完成
+func (p *memoryPoint) waitRefunded(t *testing.T, reasons ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !slices.Equal(p.refunded(), reasons) {
+		if time.Now().After(deadline) {
+			t.Fatalf("refunds = %v, want %v", p.refunded(), reasons)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newPointContext(c context.Context, p *memoryPoint) *Context {
+	ctx := &Context{Message: &Message{BaseMessage: BaseMessage{MsgID: "m1", GID: "gid", UID: "uid"}}, Point: p}
+	ctx.SetContext(c)
+	return ctx
+}
+
+func TestReservationCommit(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	ctx := newPointContext(context.Background(), p)
+	r, err := ctx.Reserve(10, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Deduction().Balance != 90 {
+		t.Fatalf("deduction = %+v", r.Deduction())
+	}
+	if err := r.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Commit(); !errors.Is(err, ErrReservationClosed) {
+		t.Fatalf("err = %v, want ErrReservationClosed", err)
+	}
+	if err := r.Cancel("测试"); !errors.Is(err, ErrReservationClosed) {
+		t.Fatalf("err = %v, want ErrReservationClosed", err)
+	}
+	ctx.CancelReservations("处理未完成")
+	if refunds := p.refunded(); len(refunds) != 0 {
+		t.Fatalf("已确认的预留不应退还: %v", refunds)
+	}
+}
+
+func TestCancelReservations(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	ctx := newPointContext(context.Background(), p)
+	r, err := ctx.Reserve(10, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.CancelReservations("处理未完成")
+	if refunds := p.refunded(); !slices.Equal(refunds, []string{"处理未完成"}) {
+		t.Fatalf("refunds = %v", refunds)
+	}
+	if err := r.Commit(); !errors.Is(err, ErrReservationClosed) {
+		t.Fatalf("err = %v, want ErrReservationClosed", err)
+	}
+	if balance, _ := p.Balance(ctx, "gid", "uid"); balance != 100 {
+		t.Fatalf("balance = %d", balance)
+	}
+}
+
+func TestReservationRefundsOnDeadline(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	c, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	ctx := newPointContext(c, p)
+	r, err := ctx.Reserve(10, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.waitRefunded(t, "处理超时")
+	if err := r.Commit(); !errors.Is(err, ErrReservationClosed) {
+		t.Fatalf("超时退还后不能确认, err = %v", err)
+	}
+}
+
+func TestReserveOnCanceledContext(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	ctx := newPointContext(c, p)
+	if _, err := ctx.Reserve(10, "nga"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if balance, _ := p.Balance(ctx, "gid", "uid"); balance != 100 {
+		t.Fatalf("ctx 已结束时不应扣除积分, balance = %d", balance)
+	}
+}
+
+func TestReserveWhenContextEndsDuringPay(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.onPay = cancel
+	ctx := newPointContext(c, p)
+	if _, err := ctx.Reserve(10, "nga"); err != nil {
+		t.Fatal(err)
+	}
+	p.waitRefunded(t, "处理未完成")
+	ctx.CancelReservations("处理未完成")
+	if refunds := p.refunded(); len(refunds) != 1 {
+		t.Fatalf("同一预留只应退还一次: %v", refunds)
+	}
+}
+
+func TestPayFor(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	ctx := newPointContext(context.Background(), p)
+	if err := ctx.PayFor(10, "nga", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	fnErr := errors.New("生成失败")
+	if err := ctx.PayFor(10, "nga", func() error { return fnErr }); !errors.Is(err, fnErr) {
+		t.Fatalf("err = %v, want %v", err, fnErr)
+	}
+	if err := ctx.PayFor(1000, "nga", func() error {
+		t.Fatal("积分不足时不应执行")
+		return nil
+	}); err == nil {
+		t.Fatal("积分不足时应返回错误")
+	}
+	if refunds := p.refunded(); !slices.Equal(refunds, []string{"生成失败"}) {
+		t.Fatalf("refunds = %v", refunds)
+	}
+	if balance, _ := p.Balance(ctx, "gid", "uid"); balance != 90 {
+		t.Fatalf("balance = %d", balance)
+	}
+}
+
+func TestPayForRefundsOnPanic(t *testing.T) {
+	p := &memoryPoint{balance: 100}
+	ctx := newPointContext(context.Background(), p)
+	func() {
+		defer func() {
+			if e := recover(); e != "出错了" {
+				t.Fatalf("panic 应继续向上传递, recover = %v", e)
+			}
+		}()
+		_ = ctx.PayFor(10, "nga", func() error {
+			panic("出错了")
+		})
+	}()
+	if refunds := p.refunded(); !slices.Equal(refunds, []string{"处理出错"}) {
+		t.Fatalf("refunds = %v", refunds)
+	}
+	if balance, _ := p.Balance(ctx, "gid", "uid"); balance != 100 {
+		t.Fatalf("balance = %d", balance)
+	}
+}
@@ -0,0 +1,539 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CommandPrefix 命令前缀
+const CommandPrefix = "#"
+
+// ArgType 参数类型
+type ArgType int
+
+const (
+	ArgString ArgType = iota // 单个字符串
+	ArgInt                   // 整数
+	ArgFloat                 // 小数
+	ArgBool                  // 布尔值, 作为选项时不需要跟值
+	ArgText                  // 剩余全部文本, 只能作为最后一个位置参数
+)
+
+func (t ArgType) String() string {
+	switch t {
+	case ArgInt:
+		return "整数"
+	case ArgFloat:
+		return "小数"
+	case ArgBool:
+		return "是/否"
+	case ArgText:
+		return "文本"
+	default:
+		return "字符串"
+	}
+}
+
+type (
+	// CommandHandler 命令处理函数
+	CommandHandler func(ctx *Context, args *Args) error
+
+	// ArgSpec 位置参数声明
+	ArgSpec struct {
+		Name     string  // 参数名
+		Type     ArgType // 参数类型
+		Required bool    // 是否必填
+		Default  string  // 未填写时的默认值
+		Usage    string  // 参数说明
+	}
+
+	// FlagSpec 选项参数声明, 通过 --name 值 / --name=值 / -s 值 传入
+	FlagSpec struct {
+		Name    string  // 选项名
+		Short   string  // 短选项名
+		Type    ArgType // 选项类型, 不支持 ArgText
+		Default string  // 未填写时的默认值
+		Usage   string  // 选项说明
+	}
+
+	// CommandSpec 命令声明
+	CommandSpec struct {
+		Name    string         // 命令名, 不含前缀
+		Aliases []string       // 别名, 不含前缀
+		Usage   string         // 命令说明
+		Args    []ArgSpec      // 位置参数
+		Flags   []FlagSpec     // 选项参数
+		Groups  []string       // 允许使用的群, 为空时不限制
+		Hidden  bool           // 不在帮助中展示
+		Price   int            // 每次使用消耗的积分, 由 middleware.Pricing 扣除, 0为免费
+		Handler CommandHandler // 处理函数
+	}
+
+	// Commander 声明命令的插件, 命令由Service统一路由
+	Commander interface {
+		Commands() []*CommandSpec
+	}
+)
+
+// EnabledIn 命令是否在指定群启用
+func (c *CommandSpec) EnabledIn(gid string) bool {
+	if len(c.Groups) == 0 {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Syntax 命令语法, 如 #txt2img [--steps 整数] <prompt...>
+func (c *CommandSpec) Syntax() string {
+	var sb strings.Builder
+	sb.WriteString(CommandPrefix + c.Name)
+	for _, f := range c.Flags {
+		sb.WriteString(" [--" + f.Name)
+		if f.Type != ArgBool {
+			sb.WriteString(" " + f.Type.String())
+		}
+		sb.WriteString("]")
+	}
+	for _, a := range c.Args {
+		name := a.Name
+		if a.Type == ArgText {
+			name += "..."
+		}
+		if a.Required {
+			sb.WriteString(" <" + name + ">")
+		} else {
+			sb.WriteString(" [" + name + "]")
+		}
+	}
+	return sb.String()
+}
+
+// Help 命令的详细帮助
+func (c *CommandSpec) Help() string {
+	var sb strings.Builder
+	sb.WriteString(c.Syntax())
+	if c.Usage != "" {
+		sb.WriteString("\n" + c.Usage)
+	}
+	if len(c.Aliases) > 0 {
+		aliases := make([]string, 0, len(c.Aliases))
+		for _, alias := range c.Aliases {
+			aliases = append(aliases, CommandPrefix+alias)
+		}
+		sb.WriteString("\n别名: " + strings.Join(aliases, " "))
+	}
+	if len(c.Args) > 0 {
+		sb.WriteString("\n参数:")
+		for _, a := range c.Args {
+			sb.WriteString(fmt.Sprintf("\n  %s(%s)", a.Name, a.Type))
+			if a.Usage != "" {
+				sb.WriteString(" " + a.Usage)
+			}
+			if a.Default != "" {
+				sb.WriteString(" 默认: " + a.Default)
+			}
+		}
+	}
+	if len(c.Flags) > 0 {
+		sb.WriteString("\n选项:")
+		for _, f := range c.Flags {
+			sb.WriteString("\n  --" + f.Name)
+			if f.Short != "" {
+				sb.WriteString(", -" + f.Short)
+			}
+			sb.WriteString("(" + f.Type.String() + ")")
+			if f.Usage != "" {
+				sb.WriteString(" " + f.Usage)
+			}
+			if f.Default != "" {
+				sb.WriteString(" 默认: " + f.Default)
+			}
+		}
+	}
+	return sb.String()
+}
+
+func (c *CommandSpec) validate() error {
+	if c.Name == "" {
+		return errors.New("命令名不能为空")
+	}
+	if c.Handler == nil {
+		return fmt.Errorf("命令[%s]未设置处理函数", c.Name)
+	}
+	for i, a := range c.Args {
+		if a.Type == ArgText && i != len(c.Args)-1 {
+			return fmt.Errorf("命令[%s]的文本参数[%s]必须是最后一个参数", c.Name, a.Name)
+		}
+	}
+	for _, f := range c.Flags {
+		if f.Type == ArgText {
+			return fmt.Errorf("命令[%s]的选项[%s]不支持文本类型", c.Name, f.Name)
+		}
+	}
+	return nil
+}
+
+// Args 解析后的命令参数
+type Args struct {
+	Raw    string // 命令名之后的原始文本
+	values map[string]string
+}
+
+// Has 参数是否由用户填写或有默认值
+func (a *Args) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+func (a *Args) String(name string) string {
+	return a.values[name]
+}
+
+func (a *Args) Int(name string) int {
+	v, _ := strconv.Atoi(a.values[name])
+	return v
+}
+
+func (a *Args) Float(name string) float64 {
+	v, _ := strconv.ParseFloat(a.values[name], 64)
+	return v
+}
+
+func (a *Args) Bool(name string) bool {
+	v, _ := parseBool(a.values[name])
+	return v
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", "0", "false", "no", "off", "否":
+		return false, nil
+	case "1", "true", "yes", "on", "是":
+		return true, nil
+	}
+	return false, fmt.Errorf("无法识别的布尔值: %s", s)
+}
+
+func checkType(t ArgType, value string) error {
+	switch t {
+	case ArgInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%s 不是整数", value)
+		}
+	case ArgFloat:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%s 不是数字", value)
+		}
+	case ArgBool:
+		if _, err := parseBool(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type token struct {
+	value string
+	start int
+}
+
+// tokenize 按空白切分参数, 支持双引号包裹含空格的参数
+func tokenize(s string) []token {
+	var (
+		tokens  []token
+		current strings.Builder
+		start   = -1
+		quote   rune
+	)
+	flush := func() {
+		if start >= 0 {
+			tokens = append(tokens, token{value: current.String(), start: start})
+		}
+		current.Reset()
+		start = -1
+	}
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote || (quote == '“' && r == '”') {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '“':
+			if start < 0 {
+				start = i
+			}
+			quote = r
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			if start < 0 {
+				start = i
+			}
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (c *CommandSpec) findFlag(name string, short bool) *FlagSpec {
+	for i := range c.Flags {
+		if (!short && c.Flags[i].Name == name) || (short && c.Flags[i].Short != "" && c.Flags[i].Short == name) {
+			return &c.Flags[i]
+		}
+	}
+	return nil
+}
+
+// parse 按命令声明解析参数文本
+func (c *CommandSpec) parse(raw string) (*Args, error) {
+	args := &Args{Raw: raw, values: map[string]string{}}
+	tokens := tokenize(raw)
+	pos := 0
+	for i := 0; i < len(tokens); i++ {
+		tk := tokens[i]
+		if flag, value, hasValue := c.matchFlag(tk.value); flag != nil {
+			if !hasValue && flag.Type != ArgBool {
+				if i+1 >= len(tokens) {
+					return nil, fmt.Errorf("选项 --%s 缺少值", flag.Name)
+				}
+				i++
+				value, hasValue = tokens[i].value, true
+			}
+			if !hasValue {
+				value = "true"
+			}
+			if err := checkType(flag.Type, value); err != nil {
+				return nil, fmt.Errorf("选项 --%s: %w", flag.Name, err)
+			}
+			args.values[flag.Name] = value
+			continue
+		}
+		if pos >= len(c.Args) {
+			return nil, fmt.Errorf("多余的参数: %s", tk.value)
+		}
+		if c.Args[pos].Type == ArgText {
+			args.values[c.Args[pos].Name] = strings.TrimSpace(raw[tk.start:])
+			pos++
+			break
+		}
+		if err := checkType(c.Args[pos].Type, tk.value); err != nil {
+			return nil, fmt.Errorf("参数 %s: %w", c.Args[pos].Name, err)
+		}
+		args.values[c.Args[pos].Name] = tk.value
+		pos++
+	}
+	for _, a := range c.Args {
+		if _, ok := args.values[a.Name]; ok {
+			continue
+		}
+		if a.Required {
+			return nil, fmt.Errorf("缺少参数: %s", a.Name)
+		}
+		if a.Default != "" {
+			args.values[a.Name] = a.Default
+		}
+	}
+	for _, f := range c.Flags {
+		if _, ok := args.values[f.Name]; !ok && f.Default != "" {
+			args.values[f.Name] = f.Default
+		}
+	}
+	return args, nil
+}
+
+// matchFlag 判断token是否为已声明的选项, 未声明的 -xxx 按位置参数处理(如负数)
+func (c *CommandSpec) matchFlag(s string) (flag *FlagSpec, value string, hasValue bool) {
+	var name string
+	short := false
+	switch {
+	case strings.HasPrefix(s, "--") && len(s) > 2:
+		name = s[2:]
+	case strings.HasPrefix(s, "-") && len(s) > 1:
+		name, short = s[1:], true
+	default:
+		return nil, "", false
+	}
+	if idx := strings.Index(name, "="); idx >= 0 {
+		name, value, hasValue = name[:idx], name[idx+1:], true
+	}
+	return c.findFlag(name, short), value, hasValue
+}
+
+type route struct {
+	name string
+	spec *CommandSpec
+}
+
+// Router 命令路由, 按最长命令名匹配
+type Router struct {
+	commands []*CommandSpec
+	routes   []route
+	filter   func(ctx *Context, spec *CommandSpec) bool
+}
+
+func NewRouter() *Router {
+	r := &Router{}
+	_ = r.Register(&CommandSpec{
+		Name:    "help",
+		Aliases: []string{"帮助"},
+		Usage:   "查看可用命令, 或查看指定命令的用法",
+		Args: []ArgSpec{
+			{Name: "command", Type: ArgString, Usage: "命令名"},
+		},
+		Handler: r.help,
+	})
+	return r
+}
+
+// Register 注册命令, 命令名或别名重复时返回错误
+func (r *Router) Register(specs ...*CommandSpec) error {
+	for _, spec := range specs {
+		if err := spec.validate(); err != nil {
+			return err
+		}
+		names := append([]string{spec.Name}, spec.Aliases...)
+		for _, name := range names {
+			if exist := r.lookup(name); exist != nil {
+				return fmt.Errorf("命令[%s]与命令[%s]重复", name, exist.Name)
+			}
+		}
+		r.commands = append(r.commands, spec)
+		for _, name := range names {
+			r.routes = append(r.routes, route{name: name, spec: spec})
+		}
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].name) > len(r.routes[j].name)
+	})
+	return nil
+}
+
+// SetFilter 设置路由过滤, 返回false时消息不交给该命令处理
+func (r *Router) SetFilter(filter func(ctx *Context, spec *CommandSpec) bool) {
+	r.filter = filter
+}
+
+// Unregister 移除命令
+func (r *Router) Unregister(specs ...*CommandSpec) {
+	removed := make(map[*CommandSpec]bool, len(specs))
+	for _, spec := range specs {
+		removed[spec] = true
+	}
+	commands := r.commands[:0]
+	for _, spec := range r.commands {
+		if !removed[spec] {
+			commands = append(commands, spec)
+		}
+	}
+	r.commands = commands
+	routes := r.routes[:0]
+	for _, rt := range r.routes {
+		if !removed[rt.spec] {
+			routes = append(routes, rt)
+		}
+	}
+	r.routes = routes
+}
+
+// Commands 已注册的命令, 按注册顺序
+func (r *Router) Commands() []*CommandSpec {
+	return r.commands
+}
+
+func (r *Router) lookup(name string) *CommandSpec {
+	name = strings.TrimPrefix(name, CommandPrefix)
+	for _, rt := range r.routes {
+		if rt.name == name {
+			return rt.spec
+		}
+	}
+	return nil
+}
+
+// Match 按最长命令名匹配消息内容, 命令名后必须是空白或结尾
+func (r *Router) Match(content string) (spec *CommandSpec, raw string, matched bool) {
+	content = strings.TrimLeftFunc(content, unicode.IsSpace)
+	if !strings.HasPrefix(content, CommandPrefix) {
+		return nil, "", false
+	}
+	content = content[len(CommandPrefix):]
+	for _, rt := range r.routes {
+		if !strings.HasPrefix(content, rt.name) {
+			continue
+		}
+		rest := content[len(rt.name):]
+		if next, _ := utf8.DecodeRuneInString(rest); rest != "" && !unicode.IsSpace(next) {
+			continue
+		}
+		return rt.spec, strings.TrimSpace(rest), true
+	}
+	return nil, "", false
+}
+
+// Resolve 匹配命令并解析参数, 结果保存到ctx, 未匹配到当前群启用的命令时 matched 为 false,
+// 参数错误时 err 为带用法的错误信息, ctx 中保存匹配到的命令, 参数为nil
+func (r *Router) Resolve(ctx *Context) (matched bool, err error) {
+	spec, raw, ok := r.Match(ctx.Content)
+	if !ok || !r.enabled(ctx, spec) {
+		return false, nil
+	}
+	ctx.command = spec
+	args, err := spec.parse(raw)
+	if err != nil {
+		return true, fmt.Errorf("%s\n用法: %s", err.Error(), spec.Syntax())
+	}
+	ctx.args = args
+	return true, nil
+}
+
+// Dispatch 匹配并执行命令, 参数错误时回复用法
+func (r *Router) Dispatch(ctx *Context) (matched bool, err error) {
+	if matched, err = r.Resolve(ctx); !matched {
+		return false, nil
+	}
+	if err != nil {
+		return true, ctx.ReplayText(err.Error())
+	}
+	return true, ctx.command.Handler(ctx, ctx.args)
+}
+
+// enabled 命令在当前群启用且未被路由过滤
+func (r *Router) enabled(ctx *Context, spec *CommandSpec) bool {
+	return spec.EnabledIn(ctx.GID) && (r.filter == nil || r.filter(ctx, spec))
+}
+
+func (r *Router) help(ctx *Context, args *Args) error {
+	if name := args.String("command"); name != "" {
+		spec := r.lookup(name)
+		if spec == nil || !r.enabled(ctx, spec) {
+			return ctx.ReplayText("未找到命令: " + name)
+		}
+		return ctx.ReplayText(spec.Help())
+	}
+	var sb strings.Builder
+	sb.WriteString("可用命令:")
+	for _, spec := range r.commands {
+		if spec.Hidden || !r.enabled(ctx, spec) {
+			continue
+		}
+		sb.WriteString("\n" + CommandPrefix + spec.Name)
+		if spec.Usage != "" {
+			sb.WriteString(" " + spec.Usage)
+		}
+	}
+	sb.WriteString("\n发送 #help 命令名 查看详细用法")
+	return ctx.ReplayText(sb.String())
+}
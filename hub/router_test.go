@@ -0,0 +1,293 @@
+package hub
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input  string
+		values []string
+		starts []int
+	}{
+		{"", nil, nil},
+		{"a b", []string{"a", "b"}, []int{0, 2}},
+		{"  a \t b  ", []string{"a", "b"}, []int{2, 6}},
+		{`"a b" c`, []string{"a b", "c"}, []int{0, 6}},
+		{`x“中文 引号”`, []string{"x中文 引号"}, []int{0}},
+		{`a"b c"d e`, []string{"ab cd", "e"}, []int{0, 8}},
+		{`""`, []string{""}, []int{0}},
+		// 引号未闭合时剩余文本作为一个参数
+		{`a "b c`, []string{"a", "b c"}, []int{0, 2}},
+	}
+	for _, tt := range tests {
+		tokens := tokenize(tt.input)
+		var values []string
+		var starts []int
+		for _, tk := range tokens {
+			values = append(values, tk.value)
+			starts = append(starts, tk.start)
+		}
+		if !slices.Equal(values, tt.values) || !slices.Equal(starts, tt.starts) {
+			t.Fatalf("tokenize(%q) = %q %v, want %q %v", tt.input, values, starts, tt.values, tt.starts)
+		}
+	}
+}
+
+func TestMatchFlag(t *testing.T) {
+	spec := &CommandSpec{Flags: []FlagSpec{
+		{Name: "steps", Short: "s", Type: ArgInt},
+		{Name: "verbose", Type: ArgBool},
+	}}
+	tests := []struct {
+		input    string
+		flag     string
+		value    string
+		hasValue bool
+	}{
+		{"--steps", "steps", "", false},
+		{"--steps=20", "steps", "20", true},
+		{"--steps=", "steps", "", true},
+		{"-s", "steps", "", false},
+		{"-s=5", "steps", "5", true},
+		{"--verbose", "verbose", "", false},
+		// 未声明的选项按位置参数处理
+		{"-v", "", "", false},
+		{"--unknown", "", "", false},
+		{"-5", "", "", false},
+		{"-", "", "", false},
+		{"--", "", "", false},
+		{"steps", "", "", false},
+	}
+	for _, tt := range tests {
+		flag, value, hasValue := spec.matchFlag(tt.input)
+		name := ""
+		if flag != nil {
+			name = flag.Name
+		}
+		if name != tt.flag || value != tt.value || hasValue != tt.hasValue {
+			t.Fatalf("matchFlag(%q) = %q %q %v, want %q %q %v", tt.input, name, value, hasValue, tt.flag, tt.value, tt.hasValue)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	draw := &CommandSpec{
+		Name: "draw",
+		Args: []ArgSpec{
+			{Name: "count", Type: ArgInt, Required: true},
+			{Name: "prompt", Type: ArgText},
+		},
+		Flags: []FlagSpec{
+			{Name: "steps", Short: "s", Type: ArgInt, Default: "10"},
+			{Name: "scale", Type: ArgFloat},
+			{Name: "hd", Type: ArgBool},
+		},
+	}
+	pair := &CommandSpec{
+		Name: "pair",
+		Args: []ArgSpec{
+			{Name: "a", Type: ArgString, Required: true},
+			{Name: "b", Type: ArgString, Default: "默认"},
+		},
+	}
+	tests := []struct {
+		spec  *CommandSpec
+		input string
+		want  map[string]string
+		err   string
+	}{
+		{draw, "3", map[string]string{"count": "3", "steps": "10"}, ""},
+		{draw, "3 a cat", map[string]string{"count": "3", "prompt": "a cat", "steps": "10"}, ""},
+		// 文本参数取剩余的原始文本, 保留其中的空白、引号及选项
+		{draw, `--steps 20 3 a  "cat" --hd`, map[string]string{"count": "3", "prompt": `a  "cat" --hd`, "steps": "20"}, ""},
+		{draw, "-s=30 --scale 1.5 --hd 3", map[string]string{"count": "3", "steps": "30", "scale": "1.5", "hd": "true"}, ""},
+		{draw, "--hd=否 -5", map[string]string{"count": "-5", "steps": "10", "hd": "否"}, ""},
+		{draw, "", nil, "缺少参数: count"},
+		{draw, "three", nil, "参数 count: three 不是整数"},
+		{draw, "3 --steps", nil, "选项 --steps 缺少值"},
+		{draw, "--steps=abc 3", nil, "选项 --steps: abc 不是整数"},
+		{draw, "--scale x 3", nil, "选项 --scale: x 不是数字"},
+		{draw, "--hd=maybe 3", nil, "选项 --hd: 无法识别的布尔值: maybe"},
+		{pair, "x", map[string]string{"a": "x", "b": "默认"}, ""},
+		{pair, `"x y" z`, map[string]string{"a": "x y", "b": "z"}, ""},
+		{pair, "x y z", nil, "多余的参数: z"},
+	}
+	for _, tt := range tests {
+		args, err := tt.spec.parse(tt.input)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("parse(%q) err = %v, want %q", tt.input, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parse(%q) err = %v", tt.input, err)
+		}
+		if len(args.values) != len(tt.want) {
+			t.Fatalf("parse(%q) = %v, want %v", tt.input, args.values, tt.want)
+		}
+		for name, value := range tt.want {
+			if !args.Has(name) || args.String(name) != value {
+				t.Fatalf("parse(%q) = %v, want %v", tt.input, args.values, tt.want)
+			}
+		}
+	}
+}
+
+func TestArgsTypedValues(t *testing.T) {
+	args := &Args{values: map[string]string{"n": "3", "f": "1.5", "b": "是"}}
+	if args.Int("n") != 3 || args.Float("f") != 1.5 || !args.Bool("b") || args.Bool("missing") || args.Has("missing") {
+		t.Fatalf("args = %v", args.values)
+	}
+}
+
+func TestRegisterValidates(t *testing.T) {
+	handler := func(*Context, *Args) error { return nil }
+	tests := []struct {
+		name string
+		spec *CommandSpec
+	}{
+		{"命令名为空", &CommandSpec{Handler: handler}},
+		{"没有处理函数", &CommandSpec{Name: "a"}},
+		{"文本参数不是最后一个", &CommandSpec{Name: "a", Handler: handler, Args: []ArgSpec{{Name: "t", Type: ArgText}, {Name: "n"}}}},
+		{"文本类型的选项", &CommandSpec{Name: "a", Handler: handler, Flags: []FlagSpec{{Name: "t", Type: ArgText}}}},
+		{"与 help 的别名重复", &CommandSpec{Name: "帮助", Handler: handler}},
+		{"别名与命令名重复", &CommandSpec{Name: "a", Aliases: []string{"help"}, Handler: handler}},
+	}
+	for _, tt := range tests {
+		if err := NewRouter().Register(tt.spec); err == nil {
+			t.Fatalf("%s: 应返回错误", tt.name)
+		}
+	}
+}
+
+func TestRouterMatchesLongestName(t *testing.T) {
+	r := NewRouter()
+	handler := func(*Context, *Args) error { return nil }
+	same := &CommandSpec{Name: "same", Handler: handler}
+	setu := &CommandSpec{Name: "same_setu", Aliases: []string{"色图"}, Handler: handler}
+	// 先注册较短的命令名, 匹配时仍优先较长的命令名
+	if err := r.Register(same, setu); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		content string
+		spec    *CommandSpec
+		raw     string
+	}{
+		{"#same_setu 猫", setu, "猫"},
+		{"#same 猫", same, "猫"},
+		{"  #same\n猫 ", same, "猫"},
+		{"#same", same, ""},
+		{"#色图", setu, ""},
+		{"#samex", nil, ""},
+		{"#same_setux", nil, ""},
+		{"same", nil, ""},
+		{"#", nil, ""},
+	}
+	for _, tt := range tests {
+		spec, raw, matched := r.Match(tt.content)
+		if spec != tt.spec || raw != tt.raw || matched != (tt.spec != nil) {
+			t.Fatalf("Match(%q) = %v %q %v, want %v %q", tt.content, spec, raw, matched, tt.spec, tt.raw)
+		}
+	}
+	r.Unregister(setu)
+	if spec, _, _ := r.Match("#same_setu 猫"); spec != nil {
+		t.Fatalf("移除后不应匹配: %v", spec)
+	}
+}
+
+// newCommandContext 以 content 为消息内容创建上下文, 回复记录在返回的 recordSender 中
+func newCommandContext(gid string, content string) (*Context, *recordSender) {
+	sender := &recordSender{}
+	ctx := &Context{Message: &Message{BaseMessage: BaseMessage{GID: gid}, Content: content}, Sender: sender}
+	ctx.SetContext(context.Background())
+	return ctx, sender
+}
+
+func TestRouterDispatch(t *testing.T) {
+	var got *Args
+	r := NewRouter()
+	_ = r.Register(&CommandSpec{
+		Name:    "draw",
+		Args:    []ArgSpec{{Name: "count", Type: ArgInt, Required: true}, {Name: "prompt", Type: ArgText}},
+		Groups:  []string{"g1"},
+		Handler: func(ctx *Context, args *Args) error { got = args; return nil },
+	})
+	ctx, _ := newCommandContext("g1", "#draw 2 两只猫")
+	if matched, err := r.Dispatch(ctx); !matched || err != nil {
+		t.Fatalf("matched = %v, err = %v", matched, err)
+	}
+	if got.Int("count") != 2 || got.String("prompt") != "两只猫" || ctx.MatchedCommand().Name != "draw" {
+		t.Fatalf("args = %v", got.values)
+	}
+	// 参数错误时回复用法, 不执行命令
+	got = nil
+	ctx, sender := newCommandContext("g1", "#draw 两只猫")
+	if matched, err := r.Dispatch(ctx); !matched || err != nil {
+		t.Fatalf("matched = %v, err = %v", matched, err)
+	}
+	if got != nil || len(sender.sent) != 1 || sender.sent[0].Body != "参数 count: 两只猫 不是整数\n用法: #draw <count> [prompt...]" {
+		t.Fatalf("args = %v, sent = %+v", got, sender.sent)
+	}
+	// 未启用命令的群不匹配
+	ctx, _ = newCommandContext("g2", "#draw 2")
+	if matched, _ := r.Dispatch(ctx); matched {
+		t.Fatal("命令未在群 g2 启用")
+	}
+	r.SetFilter(func(*Context, *CommandSpec) bool { return false })
+	ctx, _ = newCommandContext("g1", "#draw 2")
+	if matched, _ := r.Dispatch(ctx); matched {
+		t.Fatal("被过滤的命令不应匹配")
+	}
+}
+
+func TestRouterHelp(t *testing.T) {
+	r := NewRouter()
+	handler := func(*Context, *Args) error { return nil }
+	draw := &CommandSpec{
+		Name:    "draw",
+		Aliases: []string{"画"},
+		Usage:   "画图",
+		Args:    []ArgSpec{{Name: "prompt", Type: ArgText, Required: true, Usage: "描述"}},
+		Flags:   []FlagSpec{{Name: "steps", Short: "s", Type: ArgInt, Default: "10", Usage: "步数"}},
+		Handler: handler,
+	}
+	_ = r.Register(
+		draw,
+		&CommandSpec{Name: "secret", Hidden: true, Handler: handler},
+		&CommandSpec{Name: "vip", Usage: "仅限g2", Groups: []string{"g2"}, Handler: handler},
+	)
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"#help", "可用命令:\n#help 查看可用命令, 或查看指定命令的用法\n#draw 画图\n发送 #help 命令名 查看详细用法"},
+		{"#帮助 画", draw.Help()},
+		{"#help #draw", draw.Help()},
+		{"#help vip", "未找到命令: vip"},
+		{"#help nope", "未找到命令: nope"},
+	}
+	for _, tt := range tests {
+		ctx, sender := newCommandContext("g1", tt.content)
+		if matched, err := r.Dispatch(ctx); !matched || err != nil {
+			t.Fatalf("%q: matched = %v, err = %v", tt.content, matched, err)
+		}
+		if len(sender.sent) != 1 || sender.sent[0].Body != tt.want {
+			t.Fatalf("%q: sent = %+v, want %q", tt.content, sender.sent, tt.want)
+		}
+	}
+	want := "#draw [--steps 整数] <prompt...>\n画图\n别名: #画\n参数:\n  prompt(文本) 描述\n选项:\n  --steps, -s(整数) 步数 默认: 10"
+	if help := draw.Help(); help != want {
+		t.Fatalf("Help() = %q, want %q", help, want)
+	}
+	ctx, sender := newCommandContext("g2", "#help")
+	_, _ = r.Dispatch(ctx)
+	if len(sender.sent) != 1 || !strings.Contains(sender.sent[0].Body, "#vip 仅限g2") {
+		t.Fatalf("群 g2 的帮助应包含 #vip: %+v", sender.sent)
+	}
+}
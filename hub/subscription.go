@@ -0,0 +1,78 @@
+package hub
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type (
+	// Subscription 插件订阅的消息, 零值表示接收全部消息
+	Subscription struct {
+		MsgTypes []int    // 消息类型, 为空时不限制
+		Events   []string // 事件名, 为空时不限制
+		Groups   []string // 群白名单, 为空时不限制
+		AtBot    bool     // 仅接收@机器人的消息
+		Quote    bool     // 仅接收带引用的消息
+		Media    bool     // 仅接收带媒体的消息
+	}
+
+	// Subscriber 声明订阅的插件, 未实现时接收全部消息
+	Subscriber interface {
+		Subscription() Subscription
+	}
+)
+
+// MatchGroup 群是否在白名单内
+func (s Subscription) MatchGroup(gid string) bool {
+	return len(s.Groups) == 0 || slices.Contains(s.Groups, gid)
+}
+
+// Match 消息是否符合订阅
+func (s Subscription) Match(message *Message) bool {
+	if len(s.MsgTypes) > 0 && !slices.Contains(s.MsgTypes, message.MsgType) {
+		return false
+	}
+	if len(s.Events) > 0 && !slices.Contains(s.Events, message.Event) {
+		return false
+	}
+	if !s.MatchGroup(message.GID) {
+		return false
+	}
+	if s.AtBot && (message.At == nil || !message.At.Bot) {
+		return false
+	}
+	if s.Quote && message.Quote == nil {
+		return false
+	}
+	if s.Media && message.Media == nil {
+		return false
+	}
+	return true
+}
+
+func (s Subscription) String() string {
+	var parts []string
+	if len(s.MsgTypes) > 0 {
+		parts = append(parts, fmt.Sprintf("msgType=%v", s.MsgTypes))
+	}
+	if len(s.Events) > 0 {
+		parts = append(parts, "event="+strings.Join(s.Events, ","))
+	}
+	if len(s.Groups) > 0 {
+		parts = append(parts, "group="+strings.Join(s.Groups, ","))
+	}
+	if s.AtBot {
+		parts = append(parts, "@bot")
+	}
+	if s.Quote {
+		parts = append(parts, "quote")
+	}
+	if s.Media {
+		parts = append(parts, "media")
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, " ")
+}
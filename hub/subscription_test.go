@@ -0,0 +1,59 @@
+package hub
+
+import "testing"
+
+func TestSubscriptionMatch(t *testing.T) {
+	text := &Message{BaseMessage: BaseMessage{MsgType: 1, GID: "g1"}, Content: "hello"}
+	event := &Message{BaseMessage: BaseMessage{MsgType: 10000, GID: "g1"}, Event: "exitGroup"}
+	atBot := &Message{BaseMessage: BaseMessage{MsgType: 1, GID: "g1"}, At: &At{Bot: true}}
+	atUser := &Message{BaseMessage: BaseMessage{MsgType: 1, GID: "g1"}, At: &At{UID: "u1"}}
+	quote := &Message{BaseMessage: BaseMessage{MsgType: 1, GID: "g2"}, Quote: &Quote{Content: "原文"}}
+	media := &Message{BaseMessage: BaseMessage{MsgType: 3, GID: "g1"}, Media: &Media{Filename: "a.png"}}
+	tests := []struct {
+		name         string
+		subscription Subscription
+		message      *Message
+		want         bool
+	}{
+		{"零值接收全部消息", Subscription{}, event, true},
+		{"消息类型匹配", Subscription{MsgTypes: []int{1, 3}}, media, true},
+		{"消息类型不匹配", Subscription{MsgTypes: []int{1}}, media, false},
+		{"事件匹配", Subscription{Events: []string{"exitGroup"}}, event, true},
+		{"事件不匹配", Subscription{Events: []string{"renameGroup"}}, event, false},
+		{"限定事件时不接收普通消息", Subscription{Events: []string{"exitGroup"}}, text, false},
+		{"群在白名单内", Subscription{Groups: []string{"g1"}}, text, true},
+		{"群不在白名单内", Subscription{Groups: []string{"g1"}}, quote, false},
+		{"@机器人", Subscription{AtBot: true}, atBot, true},
+		{"@其他用户", Subscription{AtBot: true}, atUser, false},
+		{"没有@", Subscription{AtBot: true}, text, false},
+		{"带引用", Subscription{Quote: true}, quote, true},
+		{"不带引用", Subscription{Quote: true}, text, false},
+		{"带媒体", Subscription{Media: true}, media, true},
+		{"不带媒体", Subscription{Media: true}, text, false},
+		{"所有条件同时满足", Subscription{MsgTypes: []int{1}, Groups: []string{"g1"}, AtBot: true}, atBot, true},
+		{"任一条件不满足", Subscription{MsgTypes: []int{1}, Groups: []string{"g2"}, AtBot: true}, atBot, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.subscription.Match(tt.message); got != tt.want {
+				t.Fatalf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptionString(t *testing.T) {
+	tests := []struct {
+		subscription Subscription
+		want         string
+	}{
+		{Subscription{}, "*"},
+		{Subscription{MsgTypes: []int{1, 3}, Groups: []string{"g1", "g2"}}, "msgType=[1 3] group=g1,g2"},
+		{Subscription{Events: []string{"exitGroup"}, AtBot: true, Quote: true, Media: true}, "event=exitGroup @bot quote media"},
+	}
+	for _, tt := range tests {
+		if got := tt.subscription.String(); got != tt.want {
+			t.Fatalf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package hubtest
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"wechat-hub-plugin/hub"
+)
+
+// AssertReplyCount 断言发送的消息数
+func AssertReplyCount(t testing.TB, sender *Sender, count int) {
+	t.Helper()
+	if replies := sender.Replies(); len(replies) != count {
+		t.Fatalf("期望发送%d条消息, 实际发送%d条: %+v", count, len(replies), replies)
+	}
+}
+
+// AssertNoReply 断言没有发送消息
+func AssertNoReply(t testing.TB, sender *Sender) {
+	t.Helper()
+	AssertReplyCount(t, sender, 0)
+}
+
+// AssertText 断言发送过内容完全一致的文本消息
+func AssertText(t testing.TB, sender *Sender, content string) {
+	t.Helper()
+	if texts := sender.Texts(); !slices.Contains(texts, content) {
+		t.Fatalf("未发送文本 %q, 已发送: %q", content, texts)
+	}
+}
+
+// AssertTextContains 断言发送过包含 substr 的文本消息
+func AssertTextContains(t testing.TB, sender *Sender, substr string) {
+	t.Helper()
+	texts := sender.Texts()
+	for _, text := range texts {
+		if strings.Contains(text, substr) {
+			return
+		}
+	}
+	t.Fatalf("未发送包含 %q 的文本, 已发送: %q", substr, texts)
+}
+
+// AssertReplyType 断言第 index 条发送的消息类型, 类型见 hub.SendTypeText 等
+func AssertReplyType(t testing.TB, sender *Sender, index int, sendType int) Reply {
+	t.Helper()
+	replies := sender.Replies()
+	if index >= len(replies) {
+		t.Fatalf("期望至少发送%d条消息, 实际发送%d条", index+1, len(replies))
+	}
+	if replies[index].Type != sendType {
+		t.Fatalf("第%d条消息期望类型%d, 实际为%d", index+1, sendType, replies[index].Type)
+	}
+	return replies[index]
+}
+
+// AssertPrompt 断言第 index 条发送的消息带有回复提示
+func AssertPrompt(t testing.TB, sender *Sender, index int, prompt string) {
+	t.Helper()
+	replies := sender.Replies()
+	if index >= len(replies) {
+		t.Fatalf("期望至少发送%d条消息, 实际发送%d条", index+1, len(replies))
+	}
+	if reply := replies[index]; reply.Prompt != prompt {
+		t.Fatalf("第%d条消息期望回复提示 %q, 实际为 %q", index+1, prompt, reply.Prompt)
+	}
+}
+
+// AssertMention 断言第 index 条发送的消息@了触发消息的用户
+func AssertMention(t testing.TB, sender *Sender, index int, message *hub.Message) {
+	t.Helper()
+	AssertPrompt(t, sender, index, hub.MentionPrompt(message))
+}
+
+// AssertPaid 断言用户因 command 合计扣除了 point 积分, 已退还的积分不计入
+func AssertPaid(t testing.TB, p *Point, uid string, command string, point int) {
+	t.Helper()
+	total := 0
+	for _, payment := range p.Payments() {
+		if payment.UID == uid && (payment.Command == command || payment.Command == "refund:"+command) {
+			total += payment.Point
+		}
+	}
+	if total != point {
+		t.Fatalf("用户 %s 因 %s 期望扣除%d积分, 实际扣除%d", uid, command, point, total)
+	}
+}
@@ -0,0 +1,359 @@
+package hubtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"wechat-hub-plugin/hub"
+)
+
+type (
+	// Reply 记录的一次发送
+	Reply struct {
+		hub.SendMsgCommand
+		Data []byte // 上传文件的内容
+	}
+
+	// Sender 记录所有发送的 SenderInterface, 不会真正发送
+	Sender struct {
+		mu      sync.Mutex
+		replies []Reply
+		Err     error // 不为nil时所有发送返回该错误
+	}
+)
+
+func NewSender() *Sender {
+	return &Sender{}
+}
+
+func (s *Sender) record(ctx context.Context, cmd hub.SendMsgCommand, file io.Reader, opts []hub.SendOption) (*hub.SendResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(&cmd)
+	}
+	reply := Reply{SendMsgCommand: cmd}
+	if file != nil {
+		bs, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		reply.Data = bs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	s.replies = append(s.replies, reply)
+	return &hub.SendResult{MsgID: "reply-" + strconv.Itoa(len(s.replies))}, nil
+}
+
+func (s *Sender) SendText(ctx context.Context, gid string, content string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeText, Body: content}, nil, opts)
+}
+
+func (s *Sender) SendNetworkImg(ctx context.Context, gid string, src string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeImage, Body: src}, nil, opts)
+}
+
+func (s *Sender) SendImg(ctx context.Context, gid string, filename string, file io.Reader, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeImage, Filename: filename}, file, opts)
+}
+
+func (s *Sender) SendNetworkVideo(ctx context.Context, gid string, src string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeVideo, Body: src}, nil, opts)
+}
+
+func (s *Sender) SendVideo(ctx context.Context, gid string, filename string, file io.Reader, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeVideo, Filename: filename}, file, opts)
+}
+
+func (s *Sender) SendNetworkFile(ctx context.Context, gid string, src string, filename string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeFile, Body: src, Filename: filename}, nil, opts)
+}
+
+func (s *Sender) SendFile(ctx context.Context, gid string, filename string, file io.Reader, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.record(ctx, hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeFile, Filename: filename}, file, opts)
+}
+
+// Replies 按发送顺序返回记录的发送
+func (s *Sender) Replies() []Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Reply(nil), s.replies...)
+}
+
+// Texts 记录的文本消息内容
+func (s *Sender) Texts() []string {
+	var texts []string
+	for _, reply := range s.Replies() {
+		if reply.Type == hub.SendTypeText {
+			texts = append(texts, reply.Body)
+		}
+	}
+	return texts
+}
+
+// Reset 清空记录
+func (s *Sender) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = nil
+}
+
+type (
+	// Payment 记录的一次积分变动, 扣除为正数, 退还及增加为负数
+	Payment struct {
+		GID     string
+		UID     string
+		Point   int
+		Command string
+	}
+
+	// Point 内存中的积分, 记录所有积分变动
+	Point struct {
+		mu         sync.Mutex
+		balances   map[string]int
+		payments   []Payment
+		deductions map[string]*hub.Deduction
+		keys       map[string]*hub.Deduction // 按幂等键记录的扣除
+		Default    int                       // 未设置余额的用户的初始积分
+		Err        error                     // 不为nil时所有操作返回该错误
+	}
+)
+
+func NewPoint(defaultBalance int) *Point {
+	return &Point{balances: map[string]int{}, deductions: map[string]*hub.Deduction{}, keys: map[string]*hub.Deduction{}, Default: defaultBalance}
+}
+
+func pointKey(gid, uid string) string {
+	return gid + "/" + uid
+}
+
+// SetBalance 设置用户积分
+func (p *Point) SetBalance(gid, uid string, balance int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.balances[pointKey(gid, uid)] = balance
+}
+
+func (p *Point) balanceLocked(gid, uid string) int {
+	if balance, ok := p.balances[pointKey(gid, uid)]; ok {
+		return balance
+	}
+	return p.Default
+}
+
+// changeLocked 变动积分并记录, point 为正数时扣除, 积分不足时返回错误
+func (p *Point) changeLocked(gid, uid string, point int, command string) (int, error) {
+	balance := p.balanceLocked(gid, uid)
+	if point > 0 && balance < point {
+		return balance, fmt.Errorf("积分不足, 当前积分%d", balance)
+	}
+	balance -= point
+	p.balances[pointKey(gid, uid)] = balance
+	p.payments = append(p.payments, Payment{GID: gid, UID: uid, Point: point, Command: command})
+	return balance, nil
+}
+
+func (p *Point) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.Err
+}
+
+// Pay 扣除积分, 积分不足时返回错误
+func (p *Point) Pay(ctx context.Context, gid string, uid string, point int, command string) (*hub.Deduction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.check(ctx); err != nil {
+		return nil, err
+	}
+	// 与积分服务一致, 相同幂等键只扣除一次
+	key := hub.DeductionKeyFrom(ctx)
+	if deduction, ok := p.keys[key]; ok && key != "" {
+		d := *deduction
+		return &d, nil
+	}
+	balance, err := p.changeLocked(gid, uid, point, command)
+	if err != nil {
+		return nil, err
+	}
+	deduction := &hub.Deduction{
+		ID:      "deduction-" + strconv.Itoa(len(p.payments)),
+		Key:     key,
+		GID:     gid,
+		UID:     uid,
+		Point:   point,
+		Command: command,
+		Balance: balance,
+	}
+	p.deductions[deduction.ID] = deduction
+	if key != "" {
+		p.keys[key] = deduction
+	}
+	return deduction, nil
+}
+
+// Balance 用户当前积分
+func (p *Point) Balance(ctx context.Context, gid string, uid string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.check(ctx); err != nil {
+		return 0, err
+	}
+	return p.balanceLocked(gid, uid), nil
+}
+
+// Refund 退还扣除的积分, 同一次扣除只能退还一次
+func (p *Point) Refund(ctx context.Context, deduction *hub.Deduction, reason string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.check(ctx); err != nil {
+		return 0, err
+	}
+	if _, ok := p.deductions[deduction.ID]; !ok {
+		return 0, fmt.Errorf("扣除记录 %s 不存在或已退还", deduction.ID)
+	}
+	delete(p.deductions, deduction.ID)
+	return p.changeLocked(deduction.GID, deduction.UID, -deduction.Point, "refund:"+deduction.Command)
+}
+
+// Grant 增加积分
+func (p *Point) Grant(ctx context.Context, gid string, uid string, point int, reason string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.check(ctx); err != nil {
+		return 0, err
+	}
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	return p.changeLocked(gid, uid, -point, "grant:"+reason)
+}
+
+// Transfer 转移积分, 返回转出用户的积分
+func (p *Point) Transfer(ctx context.Context, gid string, fromUID string, toUID string, point int) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.check(ctx); err != nil {
+		return 0, err
+	}
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	balance, err := p.changeLocked(gid, fromUID, point, "transfer:"+toUID)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = p.changeLocked(gid, toUID, -point, "transfer:"+fromUID)
+	return balance, nil
+}
+
+// Payments 按顺序返回积分变动记录
+func (p *Point) Payments() []Payment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Payment(nil), p.payments...)
+}
+
+type (
+	// Query 记录的一次查询
+	Query struct {
+		SQL  string
+		Args []any
+	}
+
+	// DB 按SQL返回预设结果的 DBInterface, 记录所有查询
+	DB struct {
+		mu      sync.Mutex
+		results map[string][]map[string]any
+		queries []Query
+		Err     error // 不为nil时所有查询返回该错误
+	}
+)
+
+func NewDB() *DB {
+	return &DB{results: map[string][]map[string]any{}}
+}
+
+// SetResult 设置SQL的查询结果, 未设置的SQL返回空结果
+func (d *DB) SetResult(sql string, rows ...map[string]any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.results[sql] = rows
+}
+
+func (d *DB) Query(sql string, args ...any) (map[string]any, error) {
+	rows, err := d.QueryAll(sql, args...)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return rows[0], nil
+}
+
+func (d *DB) QueryAll(sql string, args ...any) ([]map[string]any, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, Query{SQL: sql, Args: args})
+	if d.Err != nil {
+		return nil, d.Err
+	}
+	return d.results[sql], nil
+}
+
+// Queries 按顺序返回记录的查询
+func (d *DB) Queries() []Query {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Query(nil), d.queries...)
+}
+
+// Env 插件运行需要的替身
+type Env struct {
+	Sender *Sender
+	Point  *Point
+	DB     *DB
+}
+
+// NewEnv 创建替身, 用户初始积分为100
+func NewEnv() *Env {
+	return &Env{Sender: NewSender(), Point: NewPoint(100), DB: NewDB()}
+}
+
+// Context 以替身创建消息的处理上下文
+func (e *Env) Context(ctx context.Context, message *hub.Message) *hub.Context {
+	c := &hub.Context{Message: message, Sender: e.Sender, Point: e.Point, DB: e.DB}
+	c.SetContext(ctx)
+	return c
+}
+
+// Dispatch 以单个插件处理消息: 匹配插件命令时执行命令, 否则交给 Handler.
+// 只用于测试插件自身的逻辑, 不经过 Service 的中间件, 也不按账号过滤插件及命令,
+// 需要这些行为时在 main 包的测试中以本包的替身创建 Service, 通过 Service.Handle 处理消息
+func (e *Env) Dispatch(ctx context.Context, plugin hub.Plugin, message *hub.Message) error {
+	c := e.Context(ctx, message)
+	// 与 Service 一致, 处理结束时退还未确认的积分预留
+	defer c.CancelReservations("处理未完成")
+	if commander, ok := plugin.(hub.Commander); ok {
+		router := hub.NewRouter()
+		if err := router.Register(commander.Commands()...); err != nil {
+			return err
+		}
+		if matched, err := router.Dispatch(c); matched {
+			return err
+		}
+	}
+	if handler, ok := plugin.(hub.Handler); ok {
+		if subscriber, ok := plugin.(hub.Subscriber); ok && !subscriber.Subscription().Match(message) {
+			return nil
+		}
+		return handler.Handle(c)
+	}
+	return nil
+}
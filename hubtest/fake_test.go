@@ -0,0 +1,164 @@
+package hubtest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"wechat-hub-plugin/hub"
+)
+
+func TestSenderRecordsReplies(t *testing.T) {
+	s := NewSender()
+	ctx := context.Background()
+	if result, err := s.SendText(ctx, "gid", "hello", hub.WithPrompt("@user")); err != nil || result.MsgID != "reply-1" {
+		t.Fatalf("result = %+v, err = %v", result, err)
+	}
+	if _, err := s.SendImg(ctx, "gid", "a.png", strings.NewReader("png")); err != nil {
+		t.Fatal(err)
+	}
+	AssertReplyCount(t, s, 2)
+	AssertText(t, s, "hello")
+	AssertPrompt(t, s, 0, "@user")
+	if reply := AssertReplyType(t, s, 1, hub.SendTypeImage); reply.Filename != "a.png" || string(reply.Data) != "png" {
+		t.Fatalf("reply = %+v", reply)
+	}
+	s.Reset()
+	AssertNoReply(t, s)
+}
+
+func TestSenderErrors(t *testing.T) {
+	s := NewSender()
+	s.Err = errors.New("发送失败")
+	if _, err := s.SendText(context.Background(), "gid", "hello"); !errors.Is(err, s.Err) {
+		t.Fatalf("err = %v", err)
+	}
+	s.Err = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.SendText(ctx, "gid", "hello"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	AssertNoReply(t, s)
+}
+
+func TestPointPayAndRefund(t *testing.T) {
+	p := NewPoint(100)
+	ctx := context.Background()
+	deduction, err := p.Pay(ctx, "gid", "uid", 30, "nga")
+	if err != nil || deduction.Balance != 70 {
+		t.Fatalf("deduction = %+v, err = %v", deduction, err)
+	}
+	if _, err := p.Pay(ctx, "gid", "uid", 100, "nga"); err == nil {
+		t.Fatal("积分不足时应返回错误")
+	}
+	if balance, err := p.Refund(ctx, deduction, "测试"); err != nil || balance != 100 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if _, err := p.Refund(ctx, deduction, "测试"); err == nil {
+		t.Fatal("同一次扣除不应退还两次")
+	}
+	AssertPaid(t, p, "uid", "nga", 0)
+}
+
+func TestPointPayIsIdempotentByKey(t *testing.T) {
+	p := NewPoint(100)
+	ctx := hub.WithDeductionKey(context.Background(), "msg-1:nga")
+	first, err := p.Pay(ctx, "gid", "uid", 10, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Pay(ctx, "gid", "uid", 10, "nga")
+	if err != nil || second.ID != first.ID {
+		t.Fatalf("相同幂等键应返回同一扣除记录, first = %+v, second = %+v, err = %v", first, second, err)
+	}
+	AssertPaid(t, p, "uid", "nga", 10)
+}
+
+func TestPointGrantAndTransfer(t *testing.T) {
+	p := NewPoint(0)
+	p.SetBalance("gid", "a", 50)
+	ctx := context.Background()
+	if balance, err := p.Grant(ctx, "gid", "a", 10, "奖励"); err != nil || balance != 60 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if balance, err := p.Transfer(ctx, "gid", "a", "b", 20); err != nil || balance != 40 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if balance, _ := p.Balance(ctx, "gid", "b"); balance != 20 {
+		t.Fatalf("b balance = %d", balance)
+	}
+	if _, err := p.Transfer(ctx, "gid", "b", "a", 30); err == nil {
+		t.Fatal("积分不足时不应转出")
+	}
+	p.Err = errors.New("积分服务不可用")
+	if _, err := p.Balance(ctx, "gid", "a"); !errors.Is(err, p.Err) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestDBReturnsPresetResults(t *testing.T) {
+	db := NewDB()
+	db.SetResult("select 1", map[string]any{"a": 1}, map[string]any{"a": 2})
+	row, err := db.Query("select 1", "x")
+	if err != nil || row["a"] != 1 {
+		t.Fatalf("row = %v, err = %v", row, err)
+	}
+	if rows, _ := db.QueryAll("select 2"); len(rows) != 0 {
+		t.Fatalf("未设置的SQL应返回空结果: %v", rows)
+	}
+	queries := db.Queries()
+	if len(queries) != 2 || queries[0].SQL != "select 1" || queries[0].Args[0] != "x" {
+		t.Fatalf("queries = %+v", queries)
+	}
+}
+
+// testPlugin 带命令及消息处理的插件
+type testPlugin struct{}
+
+func (testPlugin) Subscription() hub.Subscription {
+	return hub.Subscription{Groups: []string{"gid"}}
+}
+
+func (testPlugin) Handle(ctx *hub.Context) error {
+	return ctx.ReplayText("handled")
+}
+
+func (testPlugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{Name: "echo", Args: []hub.ArgSpec{{Name: "text", Type: hub.ArgText, Required: true}}, Handler: func(ctx *hub.Context, args *hub.Args) error {
+			return ctx.ReplayText(args.String("text"))
+		}},
+		{Name: "pay", Handler: func(ctx *hub.Context, _ *hub.Args) error {
+			// 预留后未确认, 处理结束时应退还
+			_, err := ctx.Reserve(10, "pay")
+			return err
+		}},
+	}
+}
+
+func TestEnvDispatch(t *testing.T) {
+	env := NewEnv()
+	ctx := context.Background()
+	if err := env.Dispatch(ctx, testPlugin{}, NewCommand("echo", "hello").Build()); err != nil {
+		t.Fatal(err)
+	}
+	AssertText(t, env.Sender, "hello")
+	if err := env.Dispatch(ctx, testPlugin{}, NewCommand("echo", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	AssertTextContains(t, env.Sender, "用法: #echo")
+	if err := env.Dispatch(ctx, testPlugin{}, NewMessage("hi").Build()); err != nil {
+		t.Fatal(err)
+	}
+	AssertText(t, env.Sender, "handled")
+	env.Sender.Reset()
+	if err := env.Dispatch(ctx, testPlugin{}, NewMessage("hi").Group("other", "other").Build()); err != nil {
+		t.Fatal(err)
+	}
+	AssertNoReply(t, env.Sender)
+	if err := env.Dispatch(ctx, testPlugin{}, NewCommand("pay", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	AssertPaid(t, env.Point, "uid", "pay", 0)
+}
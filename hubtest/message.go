@@ -0,0 +1,128 @@
+// Package hubtest 插件测试工具, 提供记录调用的 Sender/Point/DB 替身、消息构造器、回复断言及内存中的hub服务
+package hubtest
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+var msgSeq atomic.Int64
+
+// MessageBuilder 消息构造器, 默认为群 "gid" 中用户 "uid" 发送的文本消息
+type MessageBuilder struct {
+	message hub.Message
+}
+
+// NewMessage 以文本内容创建消息
+func NewMessage(content string) *MessageBuilder {
+	return &MessageBuilder{message: hub.Message{
+		BaseMessage: hub.BaseMessage{
+			MsgType:   1,
+			Time:      time.Now().Unix(),
+			MsgID:     "msg-" + strconv.FormatInt(msgSeq.Add(1), 10),
+			GID:       "gid",
+			GroupName: "group",
+			UID:       "uid",
+			Username:  "user",
+		},
+		Content: content,
+	}}
+}
+
+// NewCommand 创建 #name args 形式的命令消息
+func NewCommand(name string, args string) *MessageBuilder {
+	content := hub.CommandPrefix + name
+	if args != "" {
+		content += " " + args
+	}
+	return NewMessage(content)
+}
+
+// NewEvent 创建系统事件消息, data 按事件注册的类型解析
+func NewEvent(event string, data any) *MessageBuilder {
+	b := NewMessage("")
+	b.message.Event = event
+	b.message.Data = data
+	return b
+}
+
+func (b *MessageBuilder) Type(msgType int) *MessageBuilder {
+	b.message.MsgType = msgType
+	return b
+}
+
+func (b *MessageBuilder) ID(msgID string) *MessageBuilder {
+	b.message.MsgID = msgID
+	return b
+}
+
+func (b *MessageBuilder) Group(gid string, name string) *MessageBuilder {
+	b.message.GID = gid
+	b.message.GroupName = name
+	return b
+}
+
+func (b *MessageBuilder) User(uid string, name string) *MessageBuilder {
+	b.message.UID = uid
+	b.message.Username = name
+	return b
+}
+
+func (b *MessageBuilder) Account(account string) *MessageBuilder {
+	b.message.Account = account
+	return b
+}
+
+func (b *MessageBuilder) Time(t time.Time) *MessageBuilder {
+	b.message.Time = t.Unix()
+	return b
+}
+
+// Quote 引用指定用户的消息
+func (b *MessageBuilder) Quote(uid string, name string, content string) *MessageBuilder {
+	b.message.Quote = &hub.Quote{UID: uid, Name: name, Content: content}
+	return b
+}
+
+// At @指定用户, 并在内容前追加 @name
+func (b *MessageBuilder) At(uid string, name string) *MessageBuilder {
+	b.message.At = &hub.At{UID: uid, Name: name, Offset: 0, Length: len([]rune(name)) + 1}
+	b.message.Content = "@" + name + " " + b.message.Content
+	return b
+}
+
+// AtBot @机器人
+func (b *MessageBuilder) AtBot(name string) *MessageBuilder {
+	b.At("bot", name)
+	b.message.At.Bot = true
+	return b
+}
+
+// Media 附带媒体文件
+func (b *MessageBuilder) Media(filename string, src string) *MessageBuilder {
+	b.message.Media = &hub.Media{Filename: filename, Src: src}
+	return b
+}
+
+// Build 经过一次序列化与反序列化, 得到与从hub收到时一致的消息
+func (b *MessageBuilder) Build() *hub.Message {
+	bs := b.JSON()
+	message := &hub.Message{}
+	if err := json.Unmarshal(bs, message); err != nil {
+		panic(err)
+	}
+	message.Account = b.message.Account
+	return message
+}
+
+// JSON hub发送的消息内容
+func (b *MessageBuilder) JSON() []byte {
+	bs, err := json.Marshal(b.message)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
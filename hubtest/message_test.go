@@ -0,0 +1,50 @@
+package hubtest
+
+import (
+	"context"
+	"testing"
+	"wechat-hub-plugin/hub"
+)
+
+func TestMessageBuilderDefaults(t *testing.T) {
+	first, second := NewMessage("hello").Build(), NewMessage("hello").Build()
+	if first.GID != "gid" || first.UID != "uid" || first.Content != "hello" || first.MsgType != 1 {
+		t.Fatalf("message = %+v", first)
+	}
+	if first.MsgID == "" || first.MsgID == second.MsgID {
+		t.Fatalf("消息id应唯一: %q %q", first.MsgID, second.MsgID)
+	}
+	if content := NewCommand("nga", "a b").Build().Content; content != hub.CommandPrefix+"nga a b" {
+		t.Fatalf("content = %q", content)
+	}
+}
+
+func TestMessageBuilderOptions(t *testing.T) {
+	message := NewMessage("hello").
+		ID("m1").
+		Group("g1", "群1").
+		User("u1", "用户1").
+		Account("bot").
+		AtBot("机器人").
+		Quote("u2", "用户2", "原文").
+		Media("a.png", "http://example.com/a.png").
+		Build()
+	if message.MsgID != "m1" || message.GID != "g1" || message.UID != "u1" || message.Account != "bot" {
+		t.Fatalf("message = %+v", message)
+	}
+	if message.Content != "@机器人 hello" || message.At == nil || !message.At.Bot {
+		t.Fatalf("@机器人 content = %q, at = %+v", message.Content, message.At)
+	}
+	if message.Quote == nil || message.Quote.Content != "原文" || message.Media == nil || message.Media.Filename != "a.png" {
+		t.Fatalf("quote = %+v, media = %+v", message.Quote, message.Media)
+	}
+}
+
+func TestNewEventDecodesData(t *testing.T) {
+	message := NewEvent(hub.EventNameExitGroup, []hub.EventExitGroupUser{{UID: "u1", Name: "用户1"}}).Build()
+	ctx := NewEnv().Context(context.Background(), message)
+	users, ok := ctx.ExitUsers()
+	if !ok || len(users) != 1 || users[0].Name != "用户1" {
+		t.Fatalf("users = %+v, ok = %v", users, ok)
+	}
+}
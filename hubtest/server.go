@@ -0,0 +1,177 @@
+package hubtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+type (
+	hubConn struct {
+		mu   sync.Mutex
+		conn *websocket.Conn
+	}
+
+	// Hub 内存中的hub服务, 供 redirect.WSClientRedirector 连接, 记录收到的命令
+	Hub struct {
+		server   *httptest.Server
+		URL      string // websocket地址
+		Respond  bool   // 为带请求id的命令回复成功响应
+		mu       sync.Mutex
+		conns    []*hubConn
+		commands []hub.Command
+		changed  chan struct{}
+	}
+)
+
+// NewHub 启动hub服务, 测试结束时关闭
+func NewHub(t testing.TB) *Hub {
+	h := &Hub{Respond: true, changed: make(chan struct{})}
+	h.server = httptest.NewServer(http.HandlerFunc(h.serve))
+	h.URL = "ws" + strings.TrimPrefix(h.server.URL, "http")
+	t.Cleanup(h.Close)
+	return h
+}
+
+func (h *Hub) notifyLocked() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *Hub) serve(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &hubConn{conn: conn}
+	h.mu.Lock()
+	h.conns = append(h.conns, c)
+	h.notifyLocked()
+	h.mu.Unlock()
+	defer h.remove(c)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		command := hub.Command{}
+		if err := json.Unmarshal(data, &command); err != nil {
+			continue
+		}
+		h.mu.Lock()
+		h.commands = append(h.commands, command)
+		seq := len(h.commands)
+		h.notifyLocked()
+		respond := h.Respond
+		h.mu.Unlock()
+		if respond && command.ID != "" {
+			bs, _ := json.Marshal(hub.CommandResponse{ID: command.ID, Data: hub.SendResult{MsgID: "hub-" + strconv.Itoa(seq)}})
+			_ = c.write(bs)
+		}
+	}
+}
+
+func (h *Hub) remove(c *hubConn) {
+	_ = c.conn.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, conn := range h.conns {
+		if conn == c {
+			h.conns = append(h.conns[:i], h.conns[i+1:]...)
+			break
+		}
+	}
+	h.notifyLocked()
+}
+
+func (c *hubConn) write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// wait 等待 cond 成立, 超时返回错误
+func (h *Hub) wait(timeout time.Duration, cond func() bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for {
+		h.mu.Lock()
+		ok, changed := cond(), h.changed
+		h.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// WaitConnected 等待插件连接
+func (h *Hub) WaitConnected(timeout time.Duration) error {
+	return h.wait(timeout, func() bool { return len(h.conns) > 0 })
+}
+
+// Send 向所有连接推送消息
+func (h *Hub) Send(message *hub.Message) error {
+	bs, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return h.SendRaw(bs)
+}
+
+// SendRaw 向所有连接推送原始数据
+func (h *Hub) SendRaw(data []byte) error {
+	h.mu.Lock()
+	conns := append([]*hubConn(nil), h.conns...)
+	h.mu.Unlock()
+	if len(conns) == 0 {
+		return errors.New("没有连接")
+	}
+	var errs []error
+	for _, c := range conns {
+		errs = append(errs, c.write(data))
+	}
+	return errors.Join(errs...)
+}
+
+// Commands 按顺序返回收到的命令
+func (h *Hub) Commands() []hub.Command {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]hub.Command(nil), h.commands...)
+}
+
+// WaitCommands 等待收到至少 count 条命令
+func (h *Hub) WaitCommands(count int, timeout time.Duration) ([]hub.Command, error) {
+	err := h.wait(timeout, func() bool { return len(h.commands) >= count })
+	return h.Commands(), err
+}
+
+// Disconnect 断开所有连接, 用于测试重连
+func (h *Hub) Disconnect() {
+	h.mu.Lock()
+	conns := append([]*hubConn(nil), h.conns...)
+	h.mu.Unlock()
+	for _, c := range conns {
+		_ = c.conn.Close()
+	}
+}
+
+func (h *Hub) Close() {
+	h.Disconnect()
+	h.server.Close()
+}
@@ -0,0 +1,110 @@
+package hubtest
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+// dialHub 以插件的身份连接hub
+func dialHub(t *testing.T, h *Hub) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(h.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if err := h.WaitConnected(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func writeCommand(t *testing.T, conn *websocket.Conn, command hub.Command) {
+	t.Helper()
+	bs, _ := json.Marshal(command)
+	if err := conn.WriteMessage(websocket.TextMessage, bs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHubPushesMessages(t *testing.T) {
+	h := NewHub(t)
+	conn := dialHub(t, h)
+	if err := h.Send(NewMessage("hello").ID("m1").Build()); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := hub.Message{}
+	if err := json.Unmarshal(data, &message); err != nil || message.MsgID != "m1" || message.Content != "hello" {
+		t.Fatalf("message = %s, err = %v", data, err)
+	}
+}
+
+func TestHubRecordsAndRespondsCommands(t *testing.T) {
+	h := NewHub(t)
+	conn := dialHub(t, h)
+	writeCommand(t, conn, hub.Command{Command: "sendMessage", Param: hub.SendMsgCommand{Gid: "gid", Body: "a"}})
+	writeCommand(t, conn, hub.Command{ID: "r1", Command: "sendMessage", Param: hub.SendMsgCommand{Gid: "gid", Body: "b"}})
+	commands, err := h.WaitCommands(2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commands[0].Param.Body != "a" || commands[1].ID != "r1" {
+		t.Fatalf("commands = %+v", commands)
+	}
+	// 只回复带请求id的命令
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := hub.ResponseID(data); !ok || id != "r1" {
+		t.Fatalf("response = %s", data)
+	}
+	resp := hub.CommandResponse{}
+	if err := json.Unmarshal(data, &resp); err != nil || resp.Data.MsgID != "hub-2" {
+		t.Fatalf("response = %s, err = %v", data, err)
+	}
+}
+
+func TestHubWithoutRespond(t *testing.T) {
+	h := NewHub(t)
+	h.Respond = false
+	conn := dialHub(t, h)
+	writeCommand(t, conn, hub.Command{ID: "r1", Command: "sendMessage"})
+	if _, err := h.WaitCommands(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("不应回复响应: %s", data)
+	}
+}
+
+func TestHubDisconnect(t *testing.T) {
+	h := NewHub(t)
+	conn := dialHub(t, h)
+	h.Disconnect()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("断开后读取应失败")
+	}
+	if err := h.wait(time.Second, func() bool { return len(h.conns) == 0 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Send(NewMessage("hello").Build()); err == nil {
+		t.Fatal("没有连接时推送应返回错误")
+	}
+	if _, err := h.WaitCommands(1, 20*time.Millisecond); err == nil {
+		t.Fatal("未收到命令时应超时")
+	}
+}
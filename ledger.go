@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+const (
+	ledgerPay         = "pay"
+	ledgerRefund      = "refund"
+	ledgerGrant       = "grant"
+	ledgerTransferOut = "transfer_out"
+	ledgerTransferIn  = "transfer_in"
+
+	ledgerUnsynced = 0 // 未同步到积分服务
+	ledgerSynced   = 1 // 已同步
+	ledgerRejected = 2 // 积分服务拒绝, 需要人工对账
+)
+
+// ledgerMigrations 按顺序执行的建表语句, 已执行的版本记录在 point_ledger_migrations 中, 只能追加
+var ledgerMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS point_balance (
+		gid VARCHAR(64) NOT NULL,
+		uid VARCHAR(64) NOT NULL,
+		balance INT NOT NULL DEFAULT 0,
+		updated_at DATETIME NOT NULL,
+		PRIMARY KEY (gid, uid)
+	) DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS point_ledger (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		gid VARCHAR(64) NOT NULL,
+		uid VARCHAR(64) NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		amount INT NOT NULL,
+		balance INT NOT NULL,
+		command VARCHAR(64) NOT NULL DEFAULT '',
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		peer_uid VARCHAR(64) NOT NULL DEFAULT '',
+		ref_id BIGINT NULL,
+		idem_key VARCHAR(191) NULL,
+		synced TINYINT NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (id),
+		UNIQUE KEY uk_idem_key (idem_key),
+		KEY idx_user (gid, uid),
+		KEY idx_ref (ref_id),
+		KEY idx_synced (synced, id)
+	) DEFAULT CHARSET=utf8mb4`,
+}
+
+var (
+	errLedgerUnavailable = errors.New("积分服务不可用")
+	errLedgerRefunded    = errors.New("该扣除已退还, 请重新发起")
+)
+
+type (
+	// LedgerEntry 一条积分变动记录, 扣除及转出为负数
+	LedgerEntry struct {
+		ID        int64     `json:"id"`
+		GID       string    `json:"gid"`
+		UID       string    `json:"uid"`
+		Kind      string    `json:"kind"`
+		Amount    int       `json:"amount"`
+		Balance   int       `json:"balance"`
+		Command   string    `json:"command,omitempty"`
+		Reason    string    `json:"reason,omitempty"`
+		PeerUID   string    `json:"peerUid,omitempty"`
+		RefID     int64     `json:"refId,omitempty"`
+		Key       string    `json:"key,omitempty"`
+		Synced    int       `json:"synced"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	// Ledger 保存在本地数据库中的积分, 积分服务未配置或不可用时代替 PointManage
+	Ledger struct {
+		db      *sql.DB
+		initial int
+		remote  hub.PointInterface
+	}
+
+	LedgerOption func(l *Ledger)
+)
+
+// LedgerInitialBalance 新用户的初始积分
+func LedgerInitialBalance(balance int) LedgerOption {
+	return func(l *Ledger) {
+		l.initial = balance
+	}
+}
+
+// LedgerRemote 远程积分服务, 新用户的初始积分从积分服务读取, Sync 将本地变动同步到积分服务
+func LedgerRemote(remote hub.PointInterface) LedgerOption {
+	return func(l *Ledger) {
+		l.remote = remote
+	}
+}
+
+func NewLedger(db *sql.DB, options ...LedgerOption) *Ledger {
+	l := &Ledger{db: db}
+	for _, option := range options {
+		option(l)
+	}
+	return l
+}
+
+// Migrate 创建或升级积分表
+func (l *Ledger) Migrate(ctx context.Context) error {
+	if _, err := l.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS point_ledger_migrations (
+		version INT NOT NULL,
+		applied_at DATETIME NOT NULL,
+		PRIMARY KEY (version)
+	)`); err != nil {
+		return fmt.Errorf("创建积分迁移表失败: %w", err)
+	}
+	var version int
+	if err := l.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM point_ledger_migrations").Scan(&version); err != nil {
+		return fmt.Errorf("读取积分表版本失败: %w", err)
+	}
+	for i := version; i < len(ledgerMigrations); i++ {
+		if _, err := l.db.ExecContext(ctx, ledgerMigrations[i]); err != nil {
+			return fmt.Errorf("积分表迁移%d失败: %w", i+1, err)
+		}
+		if _, err := l.db.ExecContext(ctx, "INSERT INTO point_ledger_migrations (version, applied_at) VALUES (?, ?)", i+1, time.Now()); err != nil {
+			return fmt.Errorf("记录积分表版本失败: %w", err)
+		}
+		slog.Info("积分表迁移完成", "version", i+1)
+	}
+	return nil
+}
+
+// tx 在事务中执行 fn, fn 返回错误时回滚
+func (l *Ledger) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return dbError(err)
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return dbError(err)
+	}
+	return nil
+}
+
+// initialBalance 新用户的初始积分, 配置了积分服务时读取积分服务中的积分
+func (l *Ledger) initialBalance(ctx context.Context, gid string, uid string) int {
+	if l.remote == nil {
+		return l.initial
+	}
+	balance, err := l.remote.Balance(ctx, gid, uid)
+	if err != nil {
+		slog.Warn("读取积分服务中的积分失败 使用初始积分", "gid", gid, "uid", uid, "initial", l.initial, "err", err)
+		return l.initial
+	}
+	return balance
+}
+
+// ensureBalance 用户不存在时以初始积分创建, 需在开启事务前调用, 读取积分服务时不持有锁
+func (l *Ledger) ensureBalance(ctx context.Context, gid string, uids ...string) error {
+	for _, uid := range uids {
+		var exists int
+		err := l.db.QueryRowContext(ctx, "SELECT 1 FROM point_balance WHERE gid = ? AND uid = ?", gid, uid).Scan(&exists)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return dbError(err)
+		}
+		if _, err := l.db.ExecContext(ctx, "INSERT IGNORE INTO point_balance (gid, uid, balance, updated_at) VALUES (?, ?, ?, ?)",
+			gid, uid, l.initialBalance(ctx, gid, uid), time.Now()); err != nil {
+			return dbError(err)
+		}
+	}
+	return nil
+}
+
+// lockBalance 锁定并返回用户的积分, 用户需已由 ensureBalance 创建
+func (l *Ledger) lockBalance(ctx context.Context, tx *sql.Tx, gid string, uid string) (int, error) {
+	var balance int
+	if err := tx.QueryRowContext(ctx, "SELECT balance FROM point_balance WHERE gid = ? AND uid = ? FOR UPDATE", gid, uid).Scan(&balance); err != nil {
+		return 0, dbError(err)
+	}
+	return balance, nil
+}
+
+// change 修改用户积分并记录变动, 返回变动记录的id及变动后的积分
+func (l *Ledger) change(ctx context.Context, tx *sql.Tx, entry LedgerEntry) (int64, int, error) {
+	balance, err := l.lockBalance(ctx, tx, entry.GID, entry.UID)
+	if err != nil {
+		return 0, 0, err
+	}
+	balance += entry.Amount
+	if balance < 0 {
+		return 0, 0, fmt.Errorf("积分不足, 当前%d积分", balance-entry.Amount)
+	}
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, "UPDATE point_balance SET balance = ?, updated_at = ? WHERE gid = ? AND uid = ?", balance, now, entry.GID, entry.UID); err != nil {
+		return 0, 0, dbError(err)
+	}
+	var refID, key any
+	if entry.RefID != 0 {
+		refID = entry.RefID
+	}
+	if entry.Key != "" {
+		key = entry.Key
+	}
+	result, err := tx.ExecContext(ctx, "INSERT INTO point_ledger (gid, uid, kind, amount, balance, command, reason, peer_uid, ref_id, idem_key, synced, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		entry.GID, entry.UID, entry.Kind, entry.Amount, balance, entry.Command, entry.Reason, entry.PeerUID, refID, key, ledgerUnsynced, now)
+	if err != nil {
+		return 0, 0, dbError(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, 0, dbError(err)
+	}
+	return id, balance, nil
+}
+
+// deductionByKey 按幂等键查找已有的扣除, 不存在时返回 sql.ErrNoRows, 已退还时返回 errLedgerRefunded
+func (l *Ledger) deductionByKey(ctx context.Context, key string) (*hub.Deduction, error) {
+	deduction := &hub.Deduction{Key: key}
+	var id int64
+	var refunded int
+	err := l.db.QueryRowContext(ctx, "SELECT id, gid, uid, -amount, command, balance, (SELECT COUNT(*) FROM point_ledger r WHERE r.ref_id = p.id AND r.kind = ?) FROM point_ledger p WHERE idem_key = ? AND kind = ?", ledgerRefund, key, ledgerPay).
+		Scan(&id, &deduction.GID, &deduction.UID, &deduction.Point, &deduction.Command, &deduction.Balance, &refunded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, dbError(err)
+	}
+	deduction.ID = strconv.FormatInt(id, 10)
+	if refunded > 0 {
+		// 已退还的扣除不能当作扣除成功, 否则命令会在没有扣除积分的情况下执行
+		slog.Warn("重复的扣除已退还", "key", key, "deduction", deduction)
+		return nil, errLedgerRefunded
+	}
+	return deduction, nil
+}
+
+func (l *Ledger) Pay(ctx context.Context, gid string, uid string, point int, command string) (*hub.Deduction, error) {
+	if point <= 0 {
+		return nil, fmt.Errorf("积分必须大于0")
+	}
+	key := hub.DeductionKeyFrom(ctx)
+	if key != "" {
+		deduction, err := l.deductionByKey(ctx, key)
+		if err == nil {
+			slog.Info("重复的扣除 返回已有记录", "key", key, "deduction", deduction)
+			return deduction, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+	if err := l.ensureBalance(ctx, gid, uid); err != nil {
+		return nil, err
+	}
+	deduction := &hub.Deduction{Key: key, GID: gid, UID: uid, Point: point, Command: command}
+	err := l.tx(ctx, func(tx *sql.Tx) error {
+		id, balance, err := l.change(ctx, tx, LedgerEntry{GID: gid, UID: uid, Kind: ledgerPay, Amount: -point, Command: command, Key: key})
+		if err != nil {
+			return err
+		}
+		deduction.ID = strconv.FormatInt(id, 10)
+		deduction.Balance = balance
+		return nil
+	})
+	if err != nil {
+		// 并发的相同扣除已经写入
+		if key != "" {
+			existing, e := l.deductionByKey(ctx, key)
+			if e == nil {
+				slog.Info("重复的扣除 返回已有记录", "key", key, "deduction", existing)
+				return existing, nil
+			}
+			if errors.Is(e, errLedgerRefunded) {
+				return nil, e
+			}
+		}
+		slog.Error("pay point failed", "gid", gid, "uid", uid, "point", point, "command", command, "key", key, "error", err)
+		return nil, err
+	}
+	slog.Info("pay point", "gid", gid, "uid", uid, "point", point, "command", command, "deduction", deduction.ID)
+	return deduction, nil
+}
+
+func (l *Ledger) Balance(ctx context.Context, gid string, uid string) (int, error) {
+	var balance int
+	err := l.db.QueryRowContext(ctx, "SELECT balance FROM point_balance WHERE gid = ? AND uid = ?", gid, uid).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return l.initialBalance(ctx, gid, uid), nil
+	}
+	if err != nil {
+		return 0, dbError(err)
+	}
+	return balance, nil
+}
+
+func (l *Ledger) Refund(ctx context.Context, deduction *hub.Deduction, reason string) (int, error) {
+	var refID int64
+	if deduction.ID != "" {
+		id, err := strconv.ParseInt(deduction.ID, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("扣除记录 %s 不存在", deduction.ID)
+		}
+		refID = id
+	}
+	if err := l.ensureBalance(ctx, deduction.GID, deduction.UID); err != nil {
+		return 0, err
+	}
+	var balance int
+	err := l.tx(ctx, func(tx *sql.Tx) error {
+		if refID != 0 {
+			var paid, refunded int
+			// 锁定扣除记录, 同一扣除的并发退还依次执行
+			if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM point_ledger WHERE id = ? AND kind = ? FOR UPDATE", refID, ledgerPay).Scan(&paid); err != nil {
+				return dbError(err)
+			}
+			if paid == 0 {
+				return fmt.Errorf("扣除记录 %s 不存在", deduction.ID)
+			}
+			if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM point_ledger WHERE ref_id = ? AND kind = ?", refID, ledgerRefund).Scan(&refunded); err != nil {
+				return dbError(err)
+			}
+			if refunded > 0 {
+				return fmt.Errorf("积分已退还")
+			}
+		}
+		var err error
+		_, balance, err = l.change(ctx, tx, LedgerEntry{GID: deduction.GID, UID: deduction.UID, Kind: ledgerRefund, Amount: deduction.Point, Command: deduction.Command, Reason: reason, RefID: refID})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("refund point", "deduction", deduction, "reason", reason)
+	return balance, nil
+}
+
+func (l *Ledger) Grant(ctx context.Context, gid string, uid string, point int, reason string) (int, error) {
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	if err := l.ensureBalance(ctx, gid, uid); err != nil {
+		return 0, err
+	}
+	var balance int
+	err := l.tx(ctx, func(tx *sql.Tx) error {
+		var err error
+		_, balance, err = l.change(ctx, tx, LedgerEntry{GID: gid, UID: uid, Kind: ledgerGrant, Amount: point, Reason: reason})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("grant point", "gid", gid, "uid", uid, "point", point, "reason", reason)
+	return balance, nil
+}
+
+func (l *Ledger) Transfer(ctx context.Context, gid string, fromUID string, toUID string, point int) (int, error) {
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	if fromUID == toUID {
+		return 0, fmt.Errorf("不能转给自己")
+	}
+	if err := l.ensureBalance(ctx, gid, fromUID, toUID); err != nil {
+		return 0, err
+	}
+	var balance int
+	err := l.tx(ctx, func(tx *sql.Tx) error {
+		// 按固定顺序加锁, 避免相互转账时死锁
+		first, second := fromUID, toUID
+		if second < first {
+			first, second = second, first
+		}
+		for _, uid := range []string{first, second} {
+			if _, err := l.lockBalance(ctx, tx, gid, uid); err != nil {
+				return err
+			}
+		}
+		var err error
+		if _, balance, err = l.change(ctx, tx, LedgerEntry{GID: gid, UID: fromUID, Kind: ledgerTransferOut, Amount: -point, PeerUID: toUID}); err != nil {
+			return err
+		}
+		_, _, err = l.change(ctx, tx, LedgerEntry{GID: gid, UID: toUID, Kind: ledgerTransferIn, Amount: point, PeerUID: fromUID})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("transfer point", "gid", gid, "from", fromUID, "to", toUID, "point", point)
+	return balance, nil
+}
+
+// dbError 记录数据库错误, 返回给用户的错误不包含数据库信息
+func dbError(err error) error {
+	slog.Error("积分数据库操作失败", "err", err)
+	return errLedgerUnavailable
+}
+
+// entries 按id顺序读取 id 之后的变动记录, synced 小于0时不按同步状态过滤
+func (l *Ledger) entries(ctx context.Context, after int64, synced int, limit int) ([]LedgerEntry, error) {
+	query := "SELECT id, gid, uid, kind, amount, balance, command, reason, peer_uid, COALESCE(ref_id, 0), COALESCE(idem_key, ''), synced, UNIX_TIMESTAMP(created_at) FROM point_ledger WHERE id > ?"
+	args := []any{after}
+	if synced >= 0 {
+		query += " AND synced = ?"
+		args = append(args, synced)
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, limit)
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		var createdAt int64
+		// 不依赖 DSN 中的 parseTime 参数
+		if err := rows.Scan(&e.ID, &e.GID, &e.UID, &e.Kind, &e.Amount, &e.Balance, &e.Command, &e.Reason, &e.PeerUID, &e.RefID, &e.Key, &e.Synced, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Export 将变动记录按行写入JSON, 用于导入积分服务或对账, unsyncedOnly 为true时只导出未同步的记录
+func (l *Ledger) Export(ctx context.Context, w io.Writer, unsyncedOnly bool) (int, error) {
+	synced := -1
+	if unsyncedOnly {
+		synced = ledgerUnsynced
+	}
+	encoder := json.NewEncoder(w)
+	count := 0
+	var after int64
+	for {
+		entries, err := l.entries(ctx, after, synced, 500)
+		if err != nil {
+			return count, err
+		}
+		if len(entries) == 0 {
+			return count, nil
+		}
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return count, err
+			}
+			count++
+		}
+		after = entries[len(entries)-1].ID
+	}
+}
+
+// ledgerKey 同步到积分服务时使用的幂等键
+func ledgerKey(id int64) string {
+	return "ledger/" + strconv.FormatInt(id, 10)
+}
+
+// sync 将一条变动记录同步到积分服务
+func (l *Ledger) sync(ctx context.Context, entry LedgerEntry) error {
+	switch entry.Kind {
+	case ledgerPay:
+		_, err := l.remote.Pay(hub.WithDeductionKey(ctx, ledgerKey(entry.ID)), entry.GID, entry.UID, -entry.Amount, entry.Command)
+		return err
+	case ledgerRefund:
+		deduction := &hub.Deduction{GID: entry.GID, UID: entry.UID, Point: entry.Amount, Command: entry.Command}
+		if entry.RefID != 0 {
+			deduction.Key = ledgerKey(entry.RefID)
+		}
+		_, err := l.remote.Refund(ctx, deduction, entry.Reason)
+		return err
+	case ledgerGrant:
+		_, err := l.remote.Grant(ctx, entry.GID, entry.UID, entry.Amount, entry.Reason)
+		return err
+	case ledgerTransferOut:
+		_, err := l.remote.Transfer(ctx, entry.GID, entry.UID, entry.PeerUID, -entry.Amount)
+		return err
+	case ledgerTransferIn:
+		// 与转出记录一同同步
+		return nil
+	default:
+		return fmt.Errorf("未知的积分变动类型 %s", entry.Kind)
+	}
+}
+
+// Sync 按顺序将未同步的变动记录同步到积分服务, 积分服务无响应时停止, 拒绝的记录标记后跳过, 返回同步成功的记录数
+// 只有扣除带幂等键, 其他记录在标记完成前中断可能重复同步, 需要按导出记录对账
+func (l *Ledger) Sync(ctx context.Context) (int, error) {
+	if l.remote == nil {
+		return 0, nil
+	}
+	count := 0
+	var after int64
+	for {
+		entries, err := l.entries(ctx, after, ledgerUnsynced, 100)
+		if err != nil || len(entries) == 0 {
+			return count, err
+		}
+		for _, entry := range entries {
+			status := ledgerSynced
+			if err := l.sync(ctx, entry); err != nil {
+				if errors.Is(err, errPointUnreachable) || ctx.Err() != nil {
+					return count, err
+				}
+				slog.Error("积分服务拒绝同步的记录", "entry", entry, "err", err)
+				status = ledgerRejected
+			}
+			if _, err := l.db.ExecContext(ctx, "UPDATE point_ledger SET synced = ? WHERE id = ?", status, entry.ID); err != nil {
+				return count, err
+			}
+			if status == ledgerSynced {
+				count++
+			}
+			after = entry.ID
+		}
+	}
+}
+
+// SyncEvery 定期同步到积分服务, ctx 取消时返回
+func (l *Ledger) SyncEvery(ctx context.Context, interval time.Duration) {
+	if l.remote == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if count, err := l.Sync(ctx); err != nil {
+				slog.Warn("同步积分到积分服务失败", "synced", count, "err", err)
+			} else if count > 0 {
+				slog.Info("同步积分到积分服务", "synced", count)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	_ "github.com/go-sql-driver/mysql"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+)
+
+// 需要可写的 MySQL 测试库, 运行前会删除积分相关的表:
+// LEDGER_TEST_DSN='user:pass@tcp(127.0.0.1:3306)/test' go test -tags integration -run Ledger .
+
+// newTestLedger 连接 LEDGER_TEST_DSN 并重建积分表
+func newTestLedger(t *testing.T, options ...LedgerOption) *Ledger {
+	t.Helper()
+	dsn := os.Getenv("LEDGER_TEST_DSN")
+	if dsn == "" {
+		t.Skip("LEDGER_TEST_DSN 未设置")
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for _, table := range []string{"point_ledger", "point_balance", "point_ledger_migrations"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := NewLedger(db, options...)
+	if err := l.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// syncStatus 按id顺序返回变动记录的同步状态
+func syncStatus(t *testing.T, l *Ledger) []int {
+	t.Helper()
+	entries, err := l.entries(context.Background(), 0, -1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status []int
+	for _, entry := range entries {
+		status = append(status, entry.Synced)
+	}
+	return status
+}
+
+func TestLedgerMigrate(t *testing.T) {
+	l := newTestLedger(t)
+	// 重复执行不会再次迁移
+	if err := l.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var versions int
+	if err := l.db.QueryRow("SELECT COUNT(*) FROM point_ledger_migrations").Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(ledgerMigrations) {
+		t.Fatalf("versions = %d, want %d", versions, len(ledgerMigrations))
+	}
+}
+
+func TestLedgerPayIsIdempotent(t *testing.T) {
+	l := newTestLedger(t, LedgerInitialBalance(100))
+	ctx := hub.WithDeductionKey(context.Background(), "m1")
+	first, err := l.Pay(ctx, "gid", "uid", 30, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := l.Pay(ctx, "gid", "uid", 30, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *first != *second || first.Balance != 70 {
+		t.Fatalf("first = %+v, second = %+v", first, second)
+	}
+	if balance, _ := l.Balance(context.Background(), "gid", "uid"); balance != 70 {
+		t.Fatalf("相同幂等键只扣除一次, balance = %d", balance)
+	}
+	// 已退还的扣除不能作为重复扣除的结果返回
+	if _, err := l.Refund(context.Background(), first, "失败"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Pay(ctx, "gid", "uid", 30, "nga"); !errors.Is(err, errLedgerRefunded) {
+		t.Fatalf("err = %v, want errLedgerRefunded", err)
+	}
+	if _, err := l.Pay(context.Background(), "gid", "uid", 200, "nga"); err == nil {
+		t.Fatal("积分不足时应返回错误")
+	}
+}
+
+func TestLedgerRefundOnce(t *testing.T) {
+	l := newTestLedger(t, LedgerInitialBalance(100))
+	ctx := context.Background()
+	deduction, err := l.Pay(ctx, "gid", "uid", 30, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := l.Refund(ctx, deduction, "失败"); err != nil || balance != 100 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if _, err := l.Refund(ctx, deduction, "失败"); err == nil {
+		t.Fatal("同一扣除只能退还一次")
+	}
+	if _, err := l.Refund(ctx, &hub.Deduction{ID: "999", GID: "gid", UID: "uid", Point: 30}, "失败"); err == nil {
+		t.Fatal("不存在的扣除不能退还")
+	}
+	if balance, _ := l.Balance(ctx, "gid", "uid"); balance != 100 {
+		t.Fatalf("balance = %d", balance)
+	}
+}
+
+func TestLedgerGrantAndTransfer(t *testing.T) {
+	l := newTestLedger(t, LedgerInitialBalance(10))
+	ctx := context.Background()
+	if balance, err := l.Grant(ctx, "gid", "a", 20, "奖励"); err != nil || balance != 30 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if _, err := l.Transfer(ctx, "gid", "a", "b", 50); err == nil || !strings.Contains(err.Error(), "积分不足") {
+		t.Fatalf("err = %v", err)
+	}
+	if balance, err := l.Transfer(ctx, "gid", "a", "b", 25); err != nil || balance != 5 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if balance, _ := l.Balance(ctx, "gid", "b"); balance != 35 {
+		t.Fatalf("balance = %d", balance)
+	}
+	if _, err := l.Transfer(ctx, "gid", "a", "a", 1); err == nil {
+		t.Fatal("不能转给自己")
+	}
+}
+
+func TestLedgerExport(t *testing.T) {
+	l := newTestLedger(t, LedgerInitialBalance(100))
+	ctx := context.Background()
+	_, _ = l.Pay(ctx, "gid", "uid", 30, "nga")
+	_, _ = l.Grant(ctx, "gid", "uid", 10, "奖励")
+	var buf bytes.Buffer
+	count, err := l.Export(ctx, &buf, true)
+	if err != nil || count != 2 {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+	var kinds []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var entry LedgerEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, entry.Kind)
+	}
+	if want := []string{ledgerPay, ledgerGrant}; !slices.Equal(kinds, want) {
+		t.Fatalf("kinds = %v, want %v", kinds, want)
+	}
+}
+
+func TestLedgerSync(t *testing.T) {
+	remote := hubtest.NewPoint(100)
+	l := newTestLedger(t, LedgerInitialBalance(100), LedgerRemote(remote))
+	ctx := context.Background()
+	_, _ = l.Pay(ctx, "gid", "uid", 30, "nga")
+	_, _ = l.Grant(ctx, "gid", "uid", 10, "奖励")
+	remote.Err = errPointUnreachable
+	if count, err := l.Sync(ctx); count != 0 || !errors.Is(err, errPointUnreachable) {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+	// 积分服务无响应时保留未同步的记录
+	if status := syncStatus(t, l); !slices.Equal(status, []int{ledgerUnsynced, ledgerUnsynced}) {
+		t.Fatalf("status = %v", status)
+	}
+	remote.Err = nil
+	if count, err := l.Sync(ctx); count != 2 || err != nil {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+	if status := syncStatus(t, l); !slices.Equal(status, []int{ledgerSynced, ledgerSynced}) {
+		t.Fatalf("status = %v", status)
+	}
+	if balance, _ := remote.Balance(ctx, "gid", "uid"); balance != 80 {
+		t.Fatalf("remote balance = %d", balance)
+	}
+	// 积分服务拒绝的记录标记后跳过
+	remote.SetBalance("gid", "uid", 0)
+	_, _ = l.Pay(ctx, "gid", "uid", 10, "nga")
+	if count, err := l.Sync(ctx); count != 0 || err != nil {
+		t.Fatalf("count = %d, err = %v", count, err)
+	}
+	if status := syncStatus(t, l); !slices.Equal(status, []int{ledgerSynced, ledgerSynced, ledgerRejected}) {
+		t.Fatalf("status = %v", status)
+	}
+}
@@ -3,38 +3,65 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/spf13/viper"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/middleware"
 	"wechat-hub-plugin/plugins/exit_watch"
 	"wechat-hub-plugin/plugins/graph"
 	"wechat-hub-plugin/plugins/nga"
 	"wechat-hub-plugin/redirect"
 )
 
-var (
-	server   string
-	apiHost  string
-	username string
-	password string
-)
-
 func init() {
 	viper.SetConfigName(".env")
 	viper.SetConfigType("env")
 	viper.AddConfigPath(".")
 
 	viper.SetDefault("PORT", 10000)
+	viper.SetDefault("DISPATCH_WORKERS", 8)
+	viper.SetDefault("DISPATCH_QUEUE_DEPTH", 20)
+	viper.SetDefault("DISPATCH_OVERFLOW", string(OverflowDropOldest))
+	viper.SetDefault("HANDLE_TIMEOUT", "60s")
+	viper.SetDefault("OUTBOUND_GROUP_RATE", 1)
+	viper.SetDefault("OUTBOUND_GROUP_BURST", 3)
+	viper.SetDefault("OUTBOUND_GLOBAL_RATE", 5)
+	viper.SetDefault("OUTBOUND_GLOBAL_BURST", 10)
+	viper.SetDefault("OUTBOUND_QUEUE", 20)
+	viper.SetDefault("OUTBOUND_COALESCE", 1000)
+	viper.SetDefault("WS_RECONNECT_MIN", "1s")
+	viper.SetDefault("WS_RECONNECT_MAX", "60s")
+	viper.SetDefault("WS_RECONNECT_FACTOR", 2)
+	viper.SetDefault("WS_RECONNECT_JITTER", 0.2)
+	viper.SetDefault("WS_OUTBOX_CAPACITY", 1000)
+	viper.SetDefault("WS_OUTBOX_MAX_AGE", "5m")
+	viper.SetDefault("WS_OUTBOX_MAX_ATTEMPTS", 5)
+	viper.SetDefault("WS_RESPONSE_TIMEOUT", "10s")
+	viper.SetDefault("TRANSPORT", "client")
+	viper.SetDefault("WS_SERVER_PATH", "/ws")
+	viper.SetDefault("HTTP_WEBHOOK_PATH", "/webhook")
+	viper.SetDefault("HTTP_COMMAND_TIMEOUT", "10s")
+	viper.SetDefault("REPLAY_SPEED", 1)
+	viper.SetDefault("REPLAY_POINT_BALANCE", 10000)
+	viper.SetDefault("SHUTDOWN_GRACE", "30s")
+	viper.SetDefault("DEDUPE_TTL", "10m")
+	viper.SetDefault("DEDUPE_CAPACITY", 10000)
+	viper.SetDefault("POINT_RETRY_ATTEMPTS", 3)
+	viper.SetDefault("POINT_RETRY_MIN", "200ms")
+	viper.SetDefault("POINT_RETRY_MAX", "2s")
+	viper.SetDefault("POINT_SYNC_INTERVAL", "1m")
 
 	if err := viper.ReadInConfig(); err != nil {
 		var configFileNotFoundError viper.ConfigFileNotFoundError
@@ -45,82 +72,303 @@ func init() {
 		}
 	}
 	viper.AutomaticEnv()
-
-	server = viper.GetString("WS_SERVER")
-	username = viper.GetString("WS_USERNAME")
-	password = viper.GetString("WS_PASSWORD")
-	apiHost = viper.GetString("API_HOST")
-
-	if server == "" {
-		panic("WS_SERVER is empty")
-	}
-	if u, err := url.Parse(server); err != nil {
-		panic(err)
-	} else {
-		query := u.Query()
-		query.Set("username", username)
-		query.Set("password", password)
-		u.RawQuery = query.Encode()
-		server = u.String()
-	}
 }
 
 func initPlugins(service *Service) {
-	// service.AddPlugin(&plugins.SamePlugin{Model: "realisticVisionV13_v13"})
+	service.Use(middleware.Recovery(), middleware.Logger(), middleware.Timing(10*time.Second))
+	// 在插件中间件之后扣除积分, 未通过插件鉴权或冷却的命令不扣除
+	service.UseCommand(middleware.Pricing(priceRules()))
+	// service.AddPlugin(&plugins.SamePlugin{Model: "realisticVisionV13_v13"}, plugins.Authorized)
 	// service.AddPlugin(write.New())
 	service.AddPlugin(exit_watch.Plugin{})
-	service.AddPlugin(graph.Plugin{})
+	service.AddPlugin(graph.Plugin{}, middleware.ReplyError(), middleware.DefaultReply(hub.ReplyMention))
 	service.AddPlugin(nga.New(os.DirFS(viper.GetString("PLUGIN_NGA_DIR"))))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export-ledger" {
+		exportLedger(os.Args[2:])
+		return
+	}
+	// ctx 在收到退出信号时取消, 之后不再接收新消息; runCtx 在处理完剩余工作后取消, 用于连接及消息处理
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
-	client := redirect.NewWebsocketClientMessageHandler(ctx, server, redirect.WSClientHeartbeat(30*time.Second))
+	defer cancel()
+	runCtx, runCancel := context.WithCancel(context.Background())
+	defer runCancel()
+	db := connectDB()
+	service := NewService()
+	service.SetDB(NewDB(db))
+	ledger := newLedger(db)
 
-	sender := NewSender(apiHost, username, password, func(msg hub.SendMsgCommand) error {
-		command := hub.Command{
-			Command: "sendMessage",
-			Param:   msg,
+	accounts := map[string]*account{}
+	var replayers []*redirect.Replayer
+	usesLedger := false
+	for _, config := range accountConfigs() {
+		a := newAccount(runCtx, config, ledger)
+		defer a.Close()
+		accounts[a.name] = a
+		if a.replayer != nil {
+			replayers = append(replayers, a.replayer)
 		}
-		data, err := json.Marshal(command)
-		if err != nil {
-			slog.Error("命令消息序列化失败", "err", err)
-			return err
+		usesLedger = usesLedger || a.ledger
+		service.AddAccount(Account{Name: a.name, Sender: a.sender, Point: a.point, Plugins: a.plugins})
+		a.OnConnection(func(connected bool) {
+			service.SetConnected(a.name, connected)
+		})
+	}
+	if usesLedger {
+		if err := ledger.Migrate(runCtx); err != nil {
+			panic(err)
 		}
-		return client.SendMessage(data)
+		go ledger.SyncEvery(runCtx, viper.GetDuration("POINT_SYNC_INTERVAL"))
+	}
+
+	initPlugins(service)
+	service.SetSkipFailedPlugins(viper.GetBool("PLUGIN_SKIP_FAILED"))
+	service.SetHandleTimeout(viper.GetDuration("HANDLE_TIMEOUT"))
+	if err := service.Start(runCtx); err != nil {
+		panic(err)
+	}
+	overflow := OverflowPolicy(viper.GetString("DISPATCH_OVERFLOW"))
+	if len(replayers) > 0 {
+		// 重放时不丢弃消息
+		overflow = OverflowBlock
+	}
+	dispatcher := NewDispatcher(
+		viper.GetInt("DISPATCH_WORKERS"),
+		viper.GetInt("DISPATCH_QUEUE_DEPTH"),
+		overflow,
+		service.Handle,
+	)
+	dispatcher.OnReject(func(message *hub.Message) {
+		go func() {
+			_, _ = accounts[message.Account].sender.SendText(runCtx, message.GID, "消息太多啦, 请稍后再试")
+		}()
 	})
+	dedupe, err := NewDeduplicator(
+		DedupeTTL(viper.GetDuration("DEDUPE_TTL")),
+		DedupeCapacity(viper.GetInt("DEDUPE_CAPACITY")),
+		DedupeFile(viper.GetString("DEDUPE_FILE")),
+	)
+	if err != nil {
+		panic(err)
+	}
+	registerMetric("dedupe", func() any { return dedupe.Stats() })
+	go dedupe.SaveEvery(runCtx, time.Minute)
+	for _, a := range accounts {
+		a.OnMessage(func(message *hub.Message) error {
+			if dedupe.Seen(message) {
+				return nil
+			}
+			if err := dispatcher.Dispatch(message); err != nil {
+				dedupe.Forget(message)
+				return err
+			}
+			return nil
+		})
+	}
 
-	pointManage := NewPointManage(viper.GetString("API_HOST_POINT"), username, password)
+	var shuttingDown atomic.Bool
+	state := accountsState(accounts)
+	server := healthEndpoint(func() redirect.ConnState {
+		if shuttingDown.Load() {
+			return redirect.StateClosed
+		}
+		return state()
+	}, accountsRoutes(accounts))
+	if len(replayers) > 0 {
+		var wg sync.WaitGroup
+		for _, replayer := range replayers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := replayer.Replay(ctx); err != nil {
+					slog.Error("重放出错", "err", err)
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+	} else {
+		<-ctx.Done()
+	}
 
-	service := NewService(sender, pointManage)
-	service.SetDB(NewDB(connectDB()))
+	shuttingDown.Store(true)
+	grace := viper.GetDuration("SHUTDOWN_GRACE")
+	slog.Info("开始关闭", "grace", grace)
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), grace)
+	defer graceCancel()
+	// 停止接收新消息, 等待正在处理及已入队的消息
+	dropped := dispatcher.Shutdown(graceCtx)
+	// 等待排队的回复发出
+	unsent, undelivered := 0, 0
+	for _, a := range accounts {
+		unsent += a.outbound.Flush(graceCtx)
+		undelivered += a.outbox.Flush(graceCtx)
+	}
+	// 取消仍在处理的消息并断开连接
+	runCancel()
 
-	initPlugins(service)
-	client.OnMessage(func(bs []byte) error {
-		message := &hub.Message{}
-		if err := json.Unmarshal(bs, message); err != nil {
-			slog.Error("消息反序列化失败", "err", err)
-			return err
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+	if err := service.Stop(stopCtx); err != nil {
+		slog.Error("插件停止出错", "err", err)
+	}
+	if err := dedupe.Save(); err != nil {
+		slog.Error("保存消息去重记录失败", "err", err)
+	}
+	if usesLedger {
+		if _, err := ledger.Sync(stopCtx); err != nil {
+			slog.Warn("同步积分到积分服务失败", "err", err)
 		}
-		return service.Handle(message)
-	})
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("关闭数据库出错", "err", err)
+	}
+	if err := server.Shutdown(stopCtx); err != nil {
+		slog.Error("关闭HTTP服务出错", "err", err)
+	}
+	if dropped+unsent+undelivered > 0 {
+		slog.Warn("关闭完成 有未处理的工作", "droppedMessages", dropped, "unsentReplies", unsent, "undeliveredCommands", undelivered)
+	} else {
+		slog.Info("关闭完成")
+	}
+}
 
-	go healthEndpoint()
-	<-ctx.Done()
-	defer cancel()
+// accountsState 所有账号都已连接时为已连接, 否则为第一个未连接账号的状态
+func accountsState(accounts map[string]*account) func() redirect.ConnState {
+	return func() redirect.ConnState {
+		for _, a := range accounts {
+			if state := a.transport.State(); state != redirect.StateConnected {
+				return state
+			}
+		}
+		return redirect.StateConnected
+	}
 }
 
-func healthEndpoint() {
+// accountsRoutes 合并所有账号需要挂载的路由, 路径重复时无法启动
+func accountsRoutes(accounts map[string]*account) map[string]http.Handler {
+	routes := map[string]http.Handler{}
+	for _, a := range accounts {
+		for path, handler := range a.routes {
+			if _, ok := routes[path]; ok {
+				panic(fmt.Sprintf("account %q: route %s is already used by another account", a.name, path))
+			}
+			routes[path] = handler
+		}
+	}
+	return routes
+}
+
+// healthEndpoint 启动健康检查及统计的HTTP服务, 同时挂载账号需要的路由
+func healthEndpoint(state func() redirect.ConnState, routes map[string]http.Handler) *http.Server {
 	port := viper.GetInt("PORT")
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if current := state(); current != redirect.StateConnected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(current.String()))
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 		_, _ = w.Write([]byte{})
 	})
+	mux.HandleFunc("/metrics", metricsHandler)
+	for path, handler := range routes {
+		mux.Handle(path, handler)
+	}
+
+	server := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: mux}
+	go func() {
+		slog.Info("HealthEndpoint listening on", "port", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HealthEndpoint ListenAndServe", "err", err)
+		}
+	}()
+	return server
+}
+
+// priceRules 读取命令价格配置
+// POINT_PRICES: 命令=积分, 如 nga=10,txt2img=20
+// POINT_GROUP_PRICES: 群/命令=积分, 如 gid1/nga=0
+// POINT_FREE_USERS: 免费使用的用户, uid 或 群/uid
+func priceRules() middleware.PriceRules {
+	rules := middleware.PriceRules{
+		Commands: map[string]int{},
+		Groups:   map[string]map[string]int{},
+		Free:     splitList(viper.GetString("POINT_FREE_USERS")),
+	}
+	for key, price := range parsePrices("POINT_PRICES") {
+		rules.Commands[key] = price
+	}
+	for key, price := range parsePrices("POINT_GROUP_PRICES") {
+		gid, command, ok := strings.Cut(key, "/")
+		if !ok || gid == "" || command == "" {
+			panic(fmt.Sprintf("POINT_GROUP_PRICES: invalid item %q", key))
+		}
+		if rules.Groups[gid] == nil {
+			rules.Groups[gid] = map[string]int{}
+		}
+		rules.Groups[gid][command] = price
+	}
+	return rules
+}
+
+// parsePrices 解析 key=积分 列表, 格式错误时无法启动
+func parsePrices(name string) map[string]int {
+	prices := map[string]int{}
+	for _, item := range splitList(viper.GetString(name)) {
+		key, value, ok := strings.Cut(item, "=")
+		price, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || price < 0 {
+			panic(fmt.Sprintf("%s: invalid item %q", name, item))
+		}
+		prices[strings.TrimSpace(key)] = price
+	}
+	return prices
+}
 
-	slog.Info("HealthEndpoint listening on", "port", port)
-	if err := http.ListenAndServe(":"+strconv.Itoa(port), mux); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("HealthEndpoint ListenAndServe", "err", err)
+// newLedger 本地积分, 配置了 API_HOST_POINT 时从积分服务读取新用户的积分, 并将变动同步到积分服务
+func newLedger(db *sql.DB) *Ledger {
+	options := []LedgerOption{LedgerInitialBalance(viper.GetInt("POINT_INITIAL_BALANCE"))}
+	if apiHost := viper.GetString("API_HOST_POINT"); apiHost != "" {
+		options = append(options, LedgerRemote(NewPointManage(apiHost, viper.GetString("WS_USERNAME"), viper.GetString("WS_PASSWORD"))))
+	}
+	return NewLedger(db, options...)
+}
+
+// exportLedger 将本地积分的变动记录按行输出JSON, 用法: export-ledger [-all] [-sync]
+// 默认只导出未同步的记录, -sync 导出后同步到积分服务
+func exportLedger(args []string) {
+	flags := flag.NewFlagSet("export-ledger", flag.ExitOnError)
+	all := flags.Bool("all", false, "导出全部记录")
+	syncRemote := flags.Bool("sync", false, "导出后同步到积分服务")
+	_ = flags.Parse(args)
+	db := connectDB()
+	defer func() {
+		_ = db.Close()
+	}()
+	ctx := context.Background()
+	ledger := newLedger(db)
+	if err := ledger.Migrate(ctx); err != nil {
+		panic(err)
+	}
+	count, err := ledger.Export(ctx, os.Stdout, !*all)
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("导出积分记录", "count", count)
+	if *syncRemote {
+		synced, err := ledger.Sync(ctx)
+		slog.Info("同步积分到积分服务", "synced", synced, "err", err)
 	}
 }
 
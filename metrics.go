@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+var (
+	metricsMu sync.RWMutex
+	metrics   = map[string]func() any{}
+)
+
+// registerMetric 注册在 /metrics 中展示的统计
+func registerMetric(name string, fn func() any) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics[name] = fn
+}
+
+func metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	metricsMu.RLock()
+	result := make(map[string]any, len(metrics))
+	for name, fn := range metrics {
+		result[name] = fn()
+	}
+	metricsMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
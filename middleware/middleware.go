@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+// Recovery 捕获插件panic, 转换为错误返回
+func Recovery() hub.Middleware {
+	return func(ctx *hub.Context, next func() error) (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				slog.Error("插件处理出错", "gid", ctx.GID, "msgID", ctx.MsgID, "error", e, "stack", string(debug.Stack()))
+				err = fmt.Errorf("%v", e)
+			}
+		}()
+		return next()
+	}
+}
+
+// Logger 记录消息处理结果与耗时
+func Logger() hub.Middleware {
+	return func(ctx *hub.Context, next func() error) error {
+		start := time.Now()
+		err := next()
+		attrs := []any{"gid", ctx.GID, "uid", ctx.UID, "msgID", ctx.MsgID, "cost", time.Since(start)}
+		if cmd := ctx.MatchedCommand(); cmd != nil {
+			attrs = append(attrs, "command", cmd.Name)
+		}
+		if err != nil {
+			slog.Error("消息处理失败", append(attrs, "err", err)...)
+		} else {
+			slog.Debug("消息处理完成", attrs...)
+		}
+		return err
+	}
+}
+
+// Timing 处理耗时超过 threshold 时记录告警
+func Timing(threshold time.Duration) hub.Middleware {
+	return func(ctx *hub.Context, next func() error) error {
+		start := time.Now()
+		err := next()
+		if cost := time.Since(start); cost > threshold {
+			slog.Warn("消息处理耗时过长", "gid", ctx.GID, "msgID", ctx.MsgID, "content", ctx.Content, "cost", cost)
+		}
+		return err
+	}
+}
+
+// Allow 仅在 allow 返回true时继续处理
+func Allow(allow func(ctx *hub.Context) bool) hub.Middleware {
+	return func(ctx *hub.Context, next func() error) error {
+		if !allow(ctx) {
+			slog.Warn("无权限", "gid", ctx.GID, "uid", ctx.UID, "username", ctx.Username)
+			return nil
+		}
+		return next()
+	}
+}
+
+// RequireUsers 仅允许指定用户使用
+func RequireUsers(uids ...string) hub.Middleware {
+	allowed := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		allowed[uid] = true
+	}
+	return Allow(func(ctx *hub.Context) bool {
+		return allowed[ctx.UID]
+	})
+}
+
+// Cooldown 同一用户在同一个群内使用同一命令的最小间隔, 非命令消息不受限制
+func Cooldown(interval time.Duration) hub.Middleware {
+	var (
+		mu   sync.Mutex
+		last = map[string]time.Time{}
+	)
+	return func(ctx *hub.Context, next func() error) error {
+		cmd := ctx.MatchedCommand()
+		if cmd == nil {
+			return next()
+		}
+		key := ctx.GID + "\x00" + ctx.UID + "\x00" + cmd.Name
+		now := time.Now()
+		mu.Lock()
+		if t, ok := last[key]; ok && now.Sub(t) < interval {
+			mu.Unlock()
+			remain := interval - now.Sub(t)
+			return ctx.ReplayText(fmt.Sprintf("操作太频繁, 请%d秒后再试", int(remain.Seconds())+1))
+		}
+		last[key] = now
+		for k, t := range last {
+			if now.Sub(t) >= interval {
+				delete(last, k)
+			}
+		}
+		mu.Unlock()
+		return next()
+	}
+}
+
+// ReplyError 将插件返回的错误回复给用户, 不再向上返回
+func ReplyError() hub.Middleware {
+	return func(ctx *hub.Context, next func() error) error {
+		err := next()
+		if err == nil {
+			return nil
+		}
+		if replyErr := ctx.ReplayText(err.Error()); replyErr != nil {
+			slog.Error("回复错误信息失败", "err", replyErr)
+		}
+		return nil
+	}
+}
+
+// DefaultReply 插件的回复默认使用指定的回复方式
+func DefaultReply(mode hub.ReplyMode) hub.Middleware {
+	return func(ctx *hub.Context, next func() error) error {
+		sender := ctx.Sender
+		ctx.Sender = hub.NewPromptSender(sender, mode.Prompt(ctx.Message))
+		defer func() {
+			ctx.Sender = sender
+		}()
+		return next()
+	}
+}
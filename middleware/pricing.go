@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"wechat-hub-plugin/hub"
+)
+
+// PriceRules 命令价格规则, 未配置的命令使用 hub.CommandSpec.Price
+type PriceRules struct {
+	Commands map[string]int            // 命令价格, 覆盖命令声明的价格
+	Groups   map[string]map[string]int // 指定群内的命令价格, 优先于 Commands
+	Free     []string                  // 免费使用的用户, 格式为 uid 或 gid/uid
+}
+
+// Price 当前消息匹配的命令需要消耗的积分
+func (r PriceRules) Price(ctx *hub.Context, cmd *hub.CommandSpec) int {
+	for _, free := range r.Free {
+		if free == ctx.UID || free == ctx.GID+"/"+ctx.UID {
+			return 0
+		}
+	}
+	if price, ok := r.Groups[ctx.GID][cmd.Name]; ok {
+		return price
+	}
+	if price, ok := r.Commands[cmd.Name]; ok {
+		return price
+	}
+	return cmd.Price
+}
+
+// Pricing 按价格规则为命令扣除积分: 积分不足时不执行命令, 执行前预留积分,
+// 命令返回错误或panic时退还, 否则确认扣除, 命令执行失败时应返回错误而不是调用 Abort.
+// 需要直接包裹命令处理函数(Service.UseCommand), 作为全局中间件时无法得知插件中间件是否拦截了命令,
+// 且 ReplyError 等中间件会吞掉命令返回的错误
+func Pricing(rules PriceRules) hub.Middleware {
+	return func(ctx *hub.Context, next func() error) error {
+		cmd := ctx.MatchedCommand()
+		if cmd == nil || ctx.Point == nil {
+			return next()
+		}
+		price := rules.Price(ctx, cmd)
+		if price <= 0 {
+			return next()
+		}
+		balance, err := ctx.PointBalance()
+		if err != nil {
+			// 积分服务不支持查询时由扣除结果判断
+			slog.Warn("查询积分失败", "gid", ctx.GID, "uid", ctx.UID, "err", err)
+		} else if balance < price {
+			return ctx.ReplayText(fmt.Sprintf("积分不足, %s需要%d积分, 当前%d积分", hub.CommandPrefix+cmd.Name, price, balance))
+		}
+		reservation, err := ctx.Reserve(price, cmd.Name)
+		if err != nil {
+			return ctx.ReplayText(err.Error())
+		}
+		committed := false
+		defer func() {
+			if !committed {
+				_ = reservation.Cancel("命令执行失败")
+			}
+		}()
+		if err := next(); err != nil {
+			return err
+		}
+		committed = true
+		return reservation.Commit()
+	}
+}
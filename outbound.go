@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+var ErrOutboundQueueFull = errors.New("发送队列已满")
+
+// tokenBucket 令牌桶, 允许令牌为负数表示已预约的等待
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒生成的令牌数
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve 取一个令牌, 返回需要等待的时间
+func (b *tokenBucket) reserve() time.Duration {
+	if b == nil || b.rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel 归还 reserve 取出的令牌, 预约的消息最终没有发送时调用
+func (b *tokenBucket) cancel() {
+	if b == nil || b.rate <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+// full 令牌是否已补满, 补满的令牌桶与新建的没有区别
+func (b *tokenBucket) full(now time.Time) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+type (
+	// OutboundStats 出站消息统计
+	OutboundStats struct {
+		Queued    int64 `json:"queued"`    // 入队的消息数
+		Sent      int64 `json:"sent"`      // 实际发送的消息数, 合并后的消息计一次
+		Delayed   int64 `json:"delayed"`   // 因限流延迟发送的次数
+		Dropped   int64 `json:"dropped"`   // 队列已满或调用方已取消而丢弃的消息数
+		Coalesced int64 `json:"coalesced"` // 被合并到前一条文本中的消息数
+	}
+
+	outboundResult struct {
+		result *hub.SendResult
+		err    error
+	}
+
+	outboundItem struct {
+		ctx  context.Context
+		msg  hub.SendMsgCommand
+		done chan outboundResult
+	}
+
+	outboundGroup struct {
+		bucket  *tokenBucket
+		items   []*outboundItem
+		running bool
+	}
+
+	// OutboundScheduler 出站消息调度, 按群和全局令牌桶限流, 合并同一个群内连续的文本消息
+	OutboundScheduler struct {
+		send        func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error)
+		global      *tokenBucket
+		groupRate   float64
+		groupBurst  int
+		maxQueue    int
+		coalesce    bool
+		coalesceMax int
+		mu          sync.Mutex
+		groups      map[string]*outboundGroup
+		evictEvery  time.Duration // 清理空闲群的间隔
+		evicted     time.Time
+		queued      atomic.Int64
+		sent        atomic.Int64
+		delayed     atomic.Int64
+		dropped     atomic.Int64
+		coalesced   atomic.Int64
+	}
+
+	OutboundOption func(s *OutboundScheduler)
+)
+
+// OutboundGroupLimit 每个群每秒最多发送 rate 条消息, 允许 burst 条突发
+func OutboundGroupLimit(rate float64, burst int) OutboundOption {
+	return func(s *OutboundScheduler) {
+		s.groupRate = rate
+		s.groupBurst = burst
+	}
+}
+
+// OutboundGlobalLimit 所有群合计每秒最多发送 rate 条消息, 允许 burst 条突发
+func OutboundGlobalLimit(rate float64, burst int) OutboundOption {
+	return func(s *OutboundScheduler) {
+		s.global = newTokenBucket(rate, burst)
+	}
+}
+
+// OutboundQueue 每个群最多排队的消息数
+func OutboundQueue(size int) OutboundOption {
+	return func(s *OutboundScheduler) {
+		s.maxQueue = size
+	}
+}
+
+// OutboundCoalesce 合并连续的文本消息, 合并后不超过 maxLength 个字符
+func OutboundCoalesce(maxLength int) OutboundOption {
+	return func(s *OutboundScheduler) {
+		s.coalesce = maxLength > 0
+		s.coalesceMax = maxLength
+	}
+}
+
+func NewOutboundScheduler(send func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error), options ...OutboundOption) *OutboundScheduler {
+	s := &OutboundScheduler{
+		send:       send,
+		maxQueue:   20,
+		groups:     map[string]*outboundGroup{},
+		evictEvery: time.Minute,
+		evicted:    time.Now(),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Send 消息入队并等待发送结果, 合并发送的消息共享同一个结果
+func (s *OutboundScheduler) Send(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+	item := &outboundItem{ctx: ctx, msg: msg, done: make(chan outboundResult, 1)}
+	s.mu.Lock()
+	s.evictIdle(time.Now())
+	g, ok := s.groups[msg.Gid]
+	if !ok {
+		g = &outboundGroup{bucket: newTokenBucket(s.groupRate, s.groupBurst)}
+		s.groups[msg.Gid] = g
+	}
+	if len(g.items) >= s.maxQueue {
+		s.mu.Unlock()
+		s.dropped.Add(1)
+		slog.Warn("发送队列已满 丢弃消息", "gid", msg.Gid, "type", msg.Type)
+		return nil, ErrOutboundQueueFull
+	}
+	g.items = append(g.items, item)
+	s.queued.Add(1)
+	if !g.running {
+		g.running = true
+		go s.run(g)
+	}
+	s.mu.Unlock()
+
+	select {
+	case done := <-item.done:
+		return done.result, done.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Pending 排队中尚未发送的消息数
+func (s *OutboundScheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, g := range s.groups {
+		pending += len(g.items)
+	}
+	return pending
+}
+
+// Flush 等待排队的消息全部发出, 返回 ctx 结束时仍未发送的消息数
+func (s *OutboundScheduler) Flush(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		idle := true
+		for _, g := range s.groups {
+			if g.running {
+				idle = false
+				break
+			}
+		}
+		s.mu.Unlock()
+		if idle {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return s.Pending()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stats 出站消息统计
+func (s *OutboundScheduler) Stats() OutboundStats {
+	return OutboundStats{
+		Queued:    s.queued.Load(),
+		Sent:      s.sent.Load(),
+		Delayed:   s.delayed.Load(),
+		Dropped:   s.dropped.Load(),
+		Coalesced: s.coalesced.Load(),
+	}
+}
+
+// evictIdle 每隔 evictEvery 移除没有排队消息且令牌已补满的群, 需持有锁
+func (s *OutboundScheduler) evictIdle(now time.Time) {
+	if now.Sub(s.evicted) < s.evictEvery {
+		return
+	}
+	s.evicted = now
+	for gid, g := range s.groups {
+		if !g.running && len(g.items) == 0 && g.bucket.full(now) {
+			delete(s.groups, gid)
+		}
+	}
+}
+
+func (s *OutboundScheduler) run(g *outboundGroup) {
+	for {
+		s.mu.Lock()
+		s.dropCanceled(g)
+		if len(g.items) == 0 {
+			g.running = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		// 有待发送的消息时才预约令牌, 等待期间到达的文本消息可一并合并
+		if wait := max(s.global.reserve(), g.bucket.reserve()); wait > 0 {
+			s.delayed.Add(1)
+			time.Sleep(wait)
+		}
+
+		s.mu.Lock()
+		batch := s.take(g)
+		s.mu.Unlock()
+		if len(batch) == 0 {
+			// 等待期间消息全部取消, 归还令牌
+			s.global.cancel()
+			g.bucket.cancel()
+			continue
+		}
+		msg := batch[0].msg
+		for _, item := range batch[1:] {
+			msg.Body += "\n" + item.msg.Body
+		}
+		ctx, cancel := batchContext(batch)
+		result, err := s.send(ctx, msg)
+		cancel()
+		s.sent.Add(1)
+		for _, item := range batch {
+			item.done <- outboundResult{result: result, err: err}
+		}
+	}
+}
+
+// batchContext 合并发送时使用的 ctx, 不随其中某条消息的调用方取消, 截止时间取最晚的一条, 有消息不限时则不限时
+func batchContext(batch []*outboundItem) (context.Context, context.CancelFunc) {
+	if len(batch) == 1 {
+		return batch[0].ctx, func() {}
+	}
+	var latest time.Time
+	for _, item := range batch {
+		deadline, ok := item.ctx.Deadline()
+		if !ok {
+			return context.WithoutCancel(batch[0].ctx), func() {}
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(context.WithoutCancel(batch[0].ctx), latest)
+}
+
+// dropCanceled 丢弃队首调用方已取消的消息, 需持有锁
+func (s *OutboundScheduler) dropCanceled(g *outboundGroup) {
+	for len(g.items) > 0 {
+		item := g.items[0]
+		err := item.ctx.Err()
+		if err == nil {
+			return
+		}
+		g.items = g.items[1:]
+		s.dropped.Add(1)
+		item.done <- outboundResult{err: err}
+	}
+}
+
+// take 取出下一条待发送的消息, 开启合并时一并取出紧随其后的文本消息
+func (s *OutboundScheduler) take(g *outboundGroup) []*outboundItem {
+	var batch []*outboundItem
+	length := 0
+	for s.dropCanceled(g); len(g.items) > 0; s.dropCanceled(g) {
+		item := g.items[0]
+		if len(batch) > 0 {
+			first := batch[0].msg
+			if !s.coalesce || first.Type != hub.SendTypeText || item.msg.Type != hub.SendTypeText ||
+				item.msg.Prompt != first.Prompt || length+len([]rune(item.msg.Body))+1 > s.coalesceMax {
+				break
+			}
+			s.coalesced.Add(1)
+		}
+		g.items = g.items[1:]
+		batch = append(batch, item)
+		length += len([]rune(item.msg.Body)) + 1
+		if !s.coalesce {
+			break
+		}
+	}
+	return batch
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+)
+
+// fakeSend 记录发送的消息, 第一条消息阻塞到 release 关闭, 以便后续消息排队, 发送时调用 onSend
+type fakeSend struct {
+	mu      sync.Mutex
+	sent    []hub.SendMsgCommand
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	onSend  func(ctx context.Context, msg hub.SendMsgCommand)
+}
+
+func newFakeSend() *fakeSend {
+	return &fakeSend{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (f *fakeSend) send(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+	first := false
+	f.once.Do(func() {
+		first = true
+		close(f.started)
+	})
+	if first {
+		<-f.release
+	}
+	if f.onSend != nil {
+		f.onSend(ctx, msg)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, msg)
+	return &hub.SendResult{MsgID: msg.Body}, nil
+}
+
+func (f *fakeSend) bodies() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bodies := make([]string, 0, len(f.sent))
+	for _, msg := range f.sent {
+		bodies = append(bodies, msg.Body)
+	}
+	return bodies
+}
+
+type sendResult struct {
+	result *hub.SendResult
+	err    error
+}
+
+// enqueue 在后台发送消息, 等待消息入队后返回结果通道
+func enqueue(t *testing.T, s *OutboundScheduler, msg hub.SendMsgCommand) <-chan sendResult {
+	t.Helper()
+	return enqueueContext(t, context.Background(), s, msg)
+}
+
+// enqueueContext 以 ctx 在后台发送消息, 等待消息入队后返回结果通道
+func enqueueContext(t *testing.T, ctx context.Context, s *OutboundScheduler, msg hub.SendMsgCommand) <-chan sendResult {
+	t.Helper()
+	queued := s.Stats().Queued
+	ch := make(chan sendResult, 1)
+	go func() {
+		result, err := s.Send(ctx, msg)
+		ch <- sendResult{result, err}
+	}()
+	deadline := time.Now().Add(time.Second)
+	for s.Stats().Queued == queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("消息 %q 未入队", msg.Body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return ch
+}
+
+func text(body string) hub.SendMsgCommand {
+	return hub.SendMsgCommand{Gid: "gid", Type: hub.SendTypeText, Body: body}
+}
+
+// blockFirst 发送第一条消息并等待其阻塞在发送中
+func blockFirst(t *testing.T, s *OutboundScheduler, f *fakeSend) <-chan sendResult {
+	t.Helper()
+	ch := make(chan sendResult, 1)
+	go func() {
+		result, err := s.Send(context.Background(), text("first"))
+		ch <- sendResult{result, err}
+	}()
+	select {
+	case <-f.started:
+	case <-time.After(time.Second):
+		t.Fatal("第一条消息未发送")
+	}
+	return ch
+}
+
+func equalBodies(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if !slices.Equal(got, want) {
+		t.Fatalf("sent = %q, want %q", got, want)
+	}
+}
+
+func TestOutboundCoalescesQueuedTexts(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send, OutboundCoalesce(100))
+	first := blockFirst(t, s, f)
+	a := enqueue(t, s, text("a"))
+	b := enqueue(t, s, text("b"))
+	img := enqueue(t, s, hub.SendMsgCommand{Gid: "gid", Type: hub.SendTypeImage, Body: "img"})
+	c := enqueue(t, s, text("c"))
+	close(f.release)
+	<-first
+	ra, rb := <-a, <-b
+	if ra.err != nil || rb.err != nil || ra.result != rb.result {
+		t.Fatalf("合并发送的消息应共享同一个结果: %+v %+v", ra, rb)
+	}
+	<-img
+	<-c
+	// 图片消息打断合并
+	equalBodies(t, f.bodies(), "first", "a\nb", "img", "c")
+	if stats := s.Stats(); stats.Queued != 5 || stats.Sent != 4 || stats.Coalesced != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestOutboundCoalesceLimits(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send, OutboundCoalesce(6))
+	first := blockFirst(t, s, f)
+	results := []<-chan sendResult{
+		enqueue(t, s, text("aa")),
+		enqueue(t, s, text("bb")),
+		// 超过合并长度
+		enqueue(t, s, text("cc")),
+		// 回复提示不同时不合并
+		enqueue(t, s, hub.SendMsgCommand{Gid: "gid", Type: hub.SendTypeText, Body: "dd", Prompt: "@user"}),
+	}
+	close(f.release)
+	<-first
+	for _, ch := range results {
+		<-ch
+	}
+	equalBodies(t, f.bodies(), "first", "aa\nbb", "cc", "dd")
+}
+
+func TestOutboundWithoutCoalesce(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send)
+	first := blockFirst(t, s, f)
+	a := enqueue(t, s, text("a"))
+	b := enqueue(t, s, text("b"))
+	close(f.release)
+	<-first
+	<-a
+	<-b
+	equalBodies(t, f.bodies(), "first", "a", "b")
+}
+
+func TestOutboundQueueFull(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send, OutboundQueue(1))
+	first := blockFirst(t, s, f)
+	a := enqueue(t, s, text("a"))
+	if _, err := s.Send(context.Background(), text("b")); !errors.Is(err, ErrOutboundQueueFull) {
+		t.Fatalf("err = %v, want ErrOutboundQueueFull", err)
+	}
+	// 其他群不受影响
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := s.Send(ctx, hub.SendMsgCommand{Gid: "other", Type: hub.SendTypeText, Body: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	close(f.release)
+	<-first
+	<-a
+	if stats := s.Stats(); stats.Dropped != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestOutboundDropsCanceled(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send, OutboundCoalesce(100))
+	first := blockFirst(t, s, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := s.Send(ctx, text("canceled"))
+		canceled <- err
+	}()
+	for s.Stats().Queued == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v", err)
+	}
+	a := enqueue(t, s, text("a"))
+	close(f.release)
+	<-first
+	<-a
+	equalBodies(t, f.bodies(), "first", "a")
+	if stats := s.Stats(); stats.Dropped != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestOutboundGroupLimit(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	s := NewOutboundScheduler(func(_ context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		return &hub.SendResult{}, nil
+	}, OutboundGroupLimit(20, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = s.Send(context.Background(), text("a"))
+		}()
+	}
+	wg.Wait()
+	if elapsed := times[len(times)-1].Sub(times[0]); elapsed < 80*time.Millisecond {
+		t.Fatalf("每秒20条时发送3条至少需要100ms, 实际 %s", elapsed)
+	}
+	if stats := s.Stats(); stats.Delayed == 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestOutboundFlush(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send)
+	first := blockFirst(t, s, f)
+	a := enqueue(t, s, text("a"))
+	if pending := s.Pending(); pending != 1 {
+		t.Fatalf("pending = %d", pending)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if pending := s.Flush(ctx); pending != 1 {
+		t.Fatalf("超时时应返回未发送的消息数, pending = %d", pending)
+	}
+	close(f.release)
+	if pending := s.Flush(context.Background()); pending != 0 {
+		t.Fatalf("pending = %d", pending)
+	}
+	<-first
+	<-a
+	equalBodies(t, f.bodies(), "first", "a")
+}
+
+// groupNames 调度器中记录的群
+func groupNames(s *OutboundScheduler) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for gid := range s.groups {
+		names = append(names, gid)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestOutboundEvictsIdleGroups(t *testing.T) {
+	f := newFakeSend()
+	close(f.release)
+	s := NewOutboundScheduler(f.send, OutboundGroupLimit(1, 1))
+	for _, gid := range []string{"a", "b"} {
+		if _, err := s.Send(context.Background(), hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeText, Body: gid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Flush(context.Background())
+	s.mu.Lock()
+	s.evictEvery = 0
+	s.mu.Unlock()
+	// 令牌未补满的群保留, 否则重新创建的群可以绕过限流
+	_, _ = s.Send(context.Background(), hub.SendMsgCommand{Gid: "c", Type: hub.SendTypeText, Body: "c"})
+	if names := groupNames(s); !slices.Equal(names, []string{"a", "b", "c"}) {
+		t.Fatalf("groups = %v", names)
+	}
+
+	unlimited := NewOutboundScheduler(f.send)
+	for _, gid := range []string{"a", "b"} {
+		if _, err := unlimited.Send(context.Background(), hub.SendMsgCommand{Gid: gid, Type: hub.SendTypeText, Body: gid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unlimited.Flush(context.Background())
+	unlimited.mu.Lock()
+	unlimited.evictEvery = 0
+	unlimited.mu.Unlock()
+	_, _ = unlimited.Send(context.Background(), hub.SendMsgCommand{Gid: "c", Type: hub.SendTypeText, Body: "c"})
+	if names := groupNames(unlimited); !slices.Equal(names, []string{"c"}) {
+		t.Fatalf("空闲的群应被移除, groups = %v", names)
+	}
+}
+
+func TestOutboundCanceledDoesNotConsumeRate(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send, OutboundGroupLimit(10, 1))
+	first := blockFirst(t, s, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := enqueueContext(t, ctx, s, text("canceled"))
+	cancel()
+	<-canceled
+	close(f.release)
+	<-first
+	s.Flush(context.Background())
+	// 已取消的消息不预约令牌
+	if stats := s.Stats(); stats.Delayed != 0 || stats.Dropped != 1 {
+		t.Fatalf("stats = %+v", stats)
+	}
+
+	// 等待令牌期间取消的消息归还令牌
+	ctx, cancel = context.WithCancel(context.Background())
+	canceled = enqueueContext(t, ctx, s, text("canceled"))
+	deadline := time.Now().Add(time.Second)
+	for s.Stats().Delayed == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("消息未等待令牌")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-canceled
+	time.Sleep(150 * time.Millisecond)
+	start := time.Now()
+	if _, err := s.Send(context.Background(), text("a")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Millisecond {
+		t.Fatalf("令牌应已归还, 实际等待 %s", elapsed)
+	}
+	equalBodies(t, f.bodies(), "first", "a")
+	if stats := s.Stats(); stats.Delayed != 1 || stats.Dropped != 2 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestOutboundCoalescedSendOutlivesCanceledCaller(t *testing.T) {
+	f := newFakeSend()
+	s := NewOutboundScheduler(f.send, OutboundCoalesce(100))
+	first := blockFirst(t, s, f)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := enqueueContext(t, ctx, s, text("a"))
+	b := enqueue(t, s, text("b"))
+	var sendErr error
+	f.onSend = func(ctx context.Context, msg hub.SendMsgCommand) {
+		if msg.Body == "a\nb" {
+			// 合并发送期间第一条消息的调用方取消, 不影响其他消息
+			cancel()
+			sendErr = ctx.Err()
+		}
+	}
+	close(f.release)
+	<-first
+	<-a
+	if rb := <-b; rb.err != nil {
+		t.Fatal(rb.err)
+	}
+	if sendErr != nil {
+		t.Fatalf("合并发送的 ctx 不应随第一条消息取消: %v", sendErr)
+	}
+	equalBodies(t, f.bodies(), "first", "a\nb")
+}
+
+func TestBatchContext(t *testing.T) {
+	now := time.Now()
+	early, cancelEarly := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer cancelEarly()
+	late, cancelLate := context.WithDeadline(context.Background(), now.Add(time.Hour))
+	defer cancelLate()
+	item := func(ctx context.Context) *outboundItem {
+		return &outboundItem{ctx: ctx}
+	}
+	ctx, cancel := batchContext([]*outboundItem{item(early), item(late)})
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(now.Add(time.Hour)) {
+		t.Fatalf("deadline = %v, %v, want latest", deadline, ok)
+	}
+	cancelEarly()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	ctx, cancel = batchContext([]*outboundItem{item(late), item(context.Background())})
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("有不限时的消息时不设截止时间")
+	}
+	// 单条消息直接使用调用方的 ctx
+	if ctx, _ := batchContext([]*outboundItem{item(early)}); ctx != early {
+		t.Fatal("单条消息应使用调用方的 ctx")
+	}
+}
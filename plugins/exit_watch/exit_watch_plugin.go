@@ -1,7 +1,6 @@
 package exit_watch
 
 import (
-	"encoding/json"
 	"log/slog"
 	"strings"
 	"wechat-hub-plugin/hub"
@@ -10,26 +9,25 @@ import (
 type Plugin struct {
 }
 
+func (p Plugin) Name() string {
+	return "exit_watch"
+}
+
+func (p Plugin) Subscription() hub.Subscription {
+	return hub.Subscription{Events: []string{hub.EventNameExitGroup}}
+}
+
 func (p Plugin) Handle(ctx *hub.Context) error {
-	message := ctx.Message
-	if message.Event != "ExitGroup" {
-		return nil
-	}
-	jsonData, err := json.Marshal(message.Data)
-	if err != nil {
-		slog.Error("退群消息 解析Data失败", "err", err)
-		return nil
-	}
-	exitUsers := new([]hub.EventExitGroupUser)
-	if err = json.Unmarshal(jsonData, exitUsers); err != nil {
-		slog.Error("退群消息 转换数据失败", "err", err)
+	exitUsers, ok := ctx.ExitUsers()
+	if !ok {
+		slog.Error("退群消息 解析Data失败", "data", ctx.Data)
 		return nil
 	}
-	usernames := make([]string, 0, len(*exitUsers))
-	for _, user := range *exitUsers {
+	usernames := make([]string, 0, len(exitUsers))
+	for _, user := range exitUsers {
 		usernames = append(usernames, user.Name)
 	}
-	_ = ctx.Sender.SendText(ctx.GID, "检测到退群:\n"+strings.Join(usernames, "\n"))
+	_ = ctx.ReplayText("检测到退群:\n" + strings.Join(usernames, "\n"))
 	return nil
 
 }
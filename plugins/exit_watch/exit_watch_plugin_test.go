@@ -0,0 +1,25 @@
+package exit_watch
+
+import (
+	"context"
+	"testing"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+)
+
+func TestRepliesExitUsers(t *testing.T) {
+	env := hubtest.NewEnv()
+	users := []hub.EventExitGroupUser{{UID: "u1", Name: "用户1"}, {UID: "u2", Name: "用户2"}}
+	if err := env.Dispatch(context.Background(), Plugin{}, hubtest.NewEvent(hub.EventNameExitGroup, users).Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertText(t, env.Sender, "检测到退群:\n用户1\n用户2")
+}
+
+func TestIgnoresOtherMessages(t *testing.T) {
+	env := hubtest.NewEnv()
+	if err := env.Dispatch(context.Background(), Plugin{}, hubtest.NewMessage("hello").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertNoReply(t, env.Sender)
+}
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"crypto/md5"
 	_ "embed"
+	"errors"
 	"fmt"
 	"github.com/vicanso/go-charts/v2"
 	"log/slog"
 	"strconv"
-	"strings"
 	"time"
 	"wechat-hub-plugin/hub"
 )
@@ -28,24 +28,22 @@ func init() {
 type Plugin struct {
 }
 
-func (p Plugin) match(rawContent string) (content string, matched bool) {
-	keywords := []string{
-		"活跃度",
-	}
-	for _, keyword := range keywords {
-		if strings.HasPrefix(rawContent, "#"+keyword) {
-			matched = true
-			content = strings.TrimPrefix(rawContent, keyword)
-			return
-		}
-	}
-	return
+func (p Plugin) Name() string {
+	return "graph"
 }
-func (p Plugin) Handle(ctx *hub.Context) error {
-	_, matched := p.match(ctx.Content)
-	if !matched {
-		return nil
+
+// Commands 处理失败时返回面向用户的错误信息, 需配合 middleware.ReplyError 回复
+func (p Plugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{
+			Name:    "活跃度",
+			Usage:   "查看自己今日与近30天平均的发言活跃度",
+			Handler: p.activity,
+		},
 	}
+}
+
+func (p Plugin) activity(ctx *hub.Context, _ *hub.Args) error {
 	now := time.Now()
 	nowDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 	tomorrowDay := nowDay.Add(24 * time.Hour)
@@ -54,29 +52,21 @@ func (p Plugin) Handle(ctx *hub.Context) error {
 	today, err := p.Today(ctx.DB, ctx.GID, ctx.UID, nowDay.Unix(), tomorrowDay.Unix())
 	if err != nil {
 		slog.Error("[活跃度]获取今日数据失败", "error", err)
-		_ = ctx.ReplayText("[活跃度]获取今日数据失败")
-		ctx.Abort()
-		return nil
+		return errors.New("[活跃度]获取今日数据失败")
 	}
 	avgDay, err := p.AvgDay(ctx.DB, ctx.GID, ctx.UID, last30Day.Unix(), nowDay.Unix())
 	if err != nil {
 		slog.Error("[活跃度]获取近30天数据失败", "error", err)
-		_ = ctx.ReplayText("[活跃度]获取近30天数据失败")
-		ctx.Abort()
-		return nil
+		return errors.New("[活跃度]获取近30天数据失败")
 	}
 	img, err := p.Draw(ctx.Username, today, avgDay)
 	if err != nil {
 		slog.Error("[活跃度]生成图片失败", "error", err)
-		_ = ctx.ReplayText("[活跃度]生成图片失败")
-		ctx.Abort()
-		return nil
+		return errors.New("[活跃度]生成图片失败")
 	}
 	if err := ctx.ReplayImg(fmt.Sprintf("%x.png", md5.Sum([]byte(ctx.Content+ctx.UID))), bytes.NewReader(img)); err != nil {
 		slog.Error("[活跃度]上传图片失败", "error", err)
-		_ = ctx.ReplayText("[活跃度]上传图片失败")
-		ctx.Abort()
-		return nil
+		return errors.New("[活跃度]上传图片失败")
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package nga
 
 import (
+	"errors"
 	"io/fs"
 	"log/slog"
 	"math/rand"
@@ -12,32 +13,30 @@ type Plugin struct {
 	f fs.FS
 }
 
-func (p Plugin) match(rawContent string) (content string, matched bool) {
-	keywords := []string{
-		"nga",
-	}
-	for _, keyword := range keywords {
-		if strings.HasPrefix(rawContent, "#"+keyword) {
-			matched = true
-			content = strings.TrimPrefix(rawContent, keyword)
-			return
-		}
-	}
-	return
-}
 func New(f fs.FS) hub.Plugin {
 	return &Plugin{f: f}
 }
-func (p Plugin) Handle(ctx *hub.Context) error {
-	_, matched := p.match(ctx.Content)
-	if !matched {
-		return nil
+
+func (p Plugin) Name() string {
+	return "nga"
+}
+
+func (p Plugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{
+			Name:    "nga",
+			Usage:   "随机发送一张NGA图片",
+			Price:   10,
+			Handler: p.image,
+		},
 	}
+}
+
+func (p Plugin) image(ctx *hub.Context, _ *hub.Args) error {
 	img, err := p.getImage()
 	if err != nil || img == nil {
 		slog.Error("[NGA]获取图片失败", "error", err)
-		ctx.Abort()
-		return nil
+		return errors.New("[NGA]获取图片失败")
 	}
 	defer func() {
 		_ = img.Close()
@@ -45,18 +44,11 @@ func (p Plugin) Handle(ctx *hub.Context) error {
 	info, err := img.Stat()
 	if err != nil {
 		slog.Error("[NGA]获取图片信息失败", "error", err)
-		ctx.Abort()
-		return nil
-	}
-	if _, err := ctx.UsePoint(ctx.Message.GID, ctx.Message.UID, 10, "nga"); err != nil {
-		_ = ctx.ReplayText("[NGA]" + err.Error())
-		ctx.Abort()
-		return err
+		return errors.New("[NGA]获取图片信息失败")
 	}
 	if err := ctx.ReplayImg(info.Name(), img); err != nil {
 		slog.Error("[NGA]上传图片失败", "error", err)
-		ctx.Abort()
-		return nil
+		return errors.New("[NGA]上传图片失败")
 	}
 	return nil
 }
@@ -0,0 +1,34 @@
+package nga
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+)
+
+func TestSendsRandomImage(t *testing.T) {
+	env := hubtest.NewEnv()
+	images := fstest.MapFS{
+		"a/1.JPG":   {Data: []byte("jpg")},
+		"readme.md": {Data: []byte("not image")},
+	}
+	if err := env.Dispatch(context.Background(), New(images), hubtest.NewCommand("nga", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	reply := hubtest.AssertReplyType(t, env.Sender, 0, hub.SendTypeImage)
+	if reply.Filename != "1.JPG" || string(reply.Data) != "jpg" {
+		t.Fatalf("reply = %+v", reply)
+	}
+}
+
+func TestFailsWithoutImage(t *testing.T) {
+	env := hubtest.NewEnv()
+	images := fstest.MapFS{"readme.md": {Data: []byte("not image")}}
+	// 返回错误使收费中间件退还积分
+	if err := env.Dispatch(context.Background(), New(images), hubtest.NewCommand("nga", "").Build()); err == nil {
+		t.Fatal("没有图片时应返回错误")
+	}
+	hubtest.AssertNoReply(t, env.Sender)
+}
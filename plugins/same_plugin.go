@@ -2,6 +2,7 @@ package plugins
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
@@ -13,13 +14,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"wechat-hub-plugin/hub"
 )
 
 type SamePlugin struct {
 	image_arr []string
 	Model     string // 模型名称
+	Point     int    // txt2img 每次消耗的积分, 可被价格配置覆盖, 0为免费
 }
 
 // 构造函数
@@ -27,9 +28,19 @@ func NewSamePlugin() *SamePlugin {
 	return &SamePlugin{Model: "realisticVisionV13_v13"}
 }
 
-func (p *SamePlugin) Init() {
-	p.Model = "realisticVisionV13_v13"
-	slog.Info("SamePlugin init")
+func (p *SamePlugin) Name() string {
+	return "same"
+}
+
+func (p *SamePlugin) Init(ctx context.Context) error {
+	if p.Model == "" {
+		p.Model = "realisticVisionV13_v13"
+	}
+	if err := os.MkdirAll("cache/images", os.ModePerm); err != nil {
+		return err
+	}
+	slog.Info("SamePlugin init", "model", p.Model)
+	return nil
 }
 
 func (p *SamePlugin) refreshImages() string {
@@ -97,7 +108,7 @@ func (p *SamePlugin) checkoutModel(name string) error {
 	return nil
 }
 
-func (p *SamePlugin) textToImage(prompt string) string {
+func (p *SamePlugin) textToImage(ctx context.Context, prompt string) string {
 	url := "http://127.0.0.1:7860/sdapi/v1/txt2img"
 	payload := map[string]interface{}{
 		"prompt": prompt,
@@ -116,7 +127,13 @@ func (p *SamePlugin) textToImage(prompt string) string {
 	}
 
 	// 发送POST请求
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		slog.Error("Failed to create POST request", "error", err)
+		return ""
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		slog.Error("Failed to send POST request", "error", err)
 		return ""
@@ -170,45 +187,54 @@ func model_list() []string {
 	return models
 }
 
-type CommandHandler func(ctx *hub.Context, p *SamePlugin) error
+func (p *SamePlugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{Name: "same", Usage: "打个招呼", Handler: p.handle(handleSame)},
+		{Name: "same_setu", Usage: "随机发送一张缓存图片", Handler: p.handle(handleSameSetu)},
+		{
+			Name:  "txt2img",
+			Usage: "根据提示词生成图片",
+			Price: p.Point,
+			Args: []hub.ArgSpec{
+				{Name: "prompt", Type: hub.ArgText, Required: true, Usage: "提示词"},
+			},
+			Handler: p.handle(handleTxt2Img),
+		},
+		{
+			Name:  "check_model",
+			Usage: "切换模型, 不指定时随机选择",
+			Args: []hub.ArgSpec{
+				{Name: "name", Type: hub.ArgString, Usage: "模型名称"},
+			},
+			Handler: p.handle(handleCheckModel),
+		},
+		{Name: "model_list", Usage: "查看模型列表", Handler: p.handle(handleModelList)},
+		{Name: "model", Usage: "查看当前模型", Handler: p.handle(handleModel)},
+	}
+}
 
-var handlers = map[string]CommandHandler{
-	"#same":        handleSame,
-	"#same_setu":   handleSameSetu,
-	"#txt2img":     handleTxt2Img,
-	"#check_model": handleCheckModel,
-	"#model_list":  handleModelList,
-	"#model":       handleModel,
+func (p *SamePlugin) handle(handler func(ctx *hub.Context, args *hub.Args, p *SamePlugin) error) hub.CommandHandler {
+	return func(ctx *hub.Context, args *hub.Args) error {
+		slog.Info("SamePlugin receive message", "type", ctx.MsgType, "content", ctx.Content)
+		return handler(ctx, args, p)
+	}
 }
 
-func (p *SamePlugin) Handle(ctx *hub.Context) error {
+// Authorized 仅允许指定用户使用, 注册插件时作为中间件传入
+func Authorized(ctx *hub.Context, next func() error) error {
 	if "same day" != ctx.Username || ctx.UID != "f1ed61fbef4e6a63" {
 		slog.Error("Unauthorized user", "username", ctx.Username, "uid", ctx.UID)
 		return nil
 	}
-	p.refreshImages()
-	slog.Info("SamePlugin receive message", "type", ctx.MsgType, "content", ctx.Content)
-
-	for cmd, handler := range handlers {
-		if strings.HasPrefix(ctx.Content, cmd) {
-			return handler(ctx, p)
-		}
-	}
-
-	// currentEnv := os.Getenv("PLUGIN_ENV")
-	// if "same" != currentEnv {
-	// 	slog.Info("current env is not same, textToImage will not be called")
-	// 	return nil
-	// }
-
-	return nil
+	return next()
 }
 
-func handleSame(ctx *hub.Context, p *SamePlugin) error {
-	return ctx.Sender.SendText(ctx.GID, "hello same")
+func handleSame(ctx *hub.Context, _ *hub.Args, p *SamePlugin) error {
+	return ctx.ReplayText("hello same")
 }
 
-func handleSameSetu(ctx *hub.Context, p *SamePlugin) error {
+func handleSameSetu(ctx *hub.Context, _ *hub.Args, p *SamePlugin) error {
+	p.refreshImages()
 	filePath := p.randomImage()
 	slog.Info("handle same_setu", "file_path", filePath)
 	file, err := os.Open(filePath)
@@ -216,45 +242,46 @@ func handleSameSetu(ctx *hub.Context, p *SamePlugin) error {
 		slog.Error("Failed to open image", "error", err)
 		return nil
 	}
-	return ctx.Sender.SendImg(ctx.GID, filePath, file)
+	return ctx.ReplayImg(filePath, file)
 }
 
-func handleTxt2Img(ctx *hub.Context, p *SamePlugin) error {
-	prompt := ctx.Content[8:]
+func handleTxt2Img(ctx *hub.Context, args *hub.Args, p *SamePlugin) error {
+	prompt := args.String("prompt")
 	slog.Info("handle txt2img", "prompt", prompt)
-	ctx.Sender.SendText(ctx.GID, "正在生成图片，请稍等")
-	imagePath := p.textToImage(prompt)
+	_ = ctx.ReplayText("正在生成图片，请稍等")
+	imagePath := p.textToImage(ctx, prompt)
 	if imagePath == "" {
 		slog.Error("Failed to generate image")
-		return ctx.Sender.SendText(ctx.GID, "Failed to generate image")
+		_ = ctx.ReplayText("Failed to generate image")
+		return errors.New("Failed to generate image")
 	}
 	slog.Info("handle txt2img", "imagePath", imagePath)
 	file, err := os.Open(imagePath)
 	if err != nil {
 		slog.Error("Failed to open image", "error", err)
-		return nil
+		return errors.New("Failed to open image")
 	}
-	return ctx.Sender.SendImg(ctx.GID, imagePath, file)
+	return ctx.ReplayImg(imagePath, file)
 }
 
-func handleCheckModel(ctx *hub.Context, p *SamePlugin) error {
-	name := ctx.Content[13:]
+func handleCheckModel(ctx *hub.Context, args *hub.Args, p *SamePlugin) error {
+	name := args.String("name")
 	slog.Info("handle check_model", "name", name)
 	if err := p.checkoutModel(name); err != nil {
-		return ctx.Sender.SendText(ctx.GID, "Failed to check out model")
+		return ctx.ReplayText("Failed to check out model")
 	}
-	return ctx.Sender.SendText(ctx.GID, "Model checked out successfully")
+	return ctx.ReplayText("Model checked out successfully")
 }
 
-func handleModel(ctx *hub.Context, p *SamePlugin) error {
-	return ctx.Sender.SendText(ctx.GID, "当前模型："+p.Model)
+func handleModel(ctx *hub.Context, _ *hub.Args, p *SamePlugin) error {
+	return ctx.ReplayText("当前模型：" + p.Model)
 }
 
-func handleModelList(ctx *hub.Context, p *SamePlugin) error {
+func handleModelList(ctx *hub.Context, _ *hub.Args, p *SamePlugin) error {
 	models := model_list()
 	modelsStr := "模型列表：\n"
 	for _, model := range models {
 		modelsStr += model + "\n"
 	}
-	return ctx.Sender.SendText(ctx.GID, modelsStr)
+	return ctx.ReplayText(modelsStr)
 }
@@ -2,13 +2,14 @@ package write
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
-	"strings"
 	"wechat-hub-plugin/hub"
 )
 
@@ -18,41 +19,45 @@ type Plugin struct {
 func New() hub.Plugin {
 	return &Plugin{}
 }
-func (h Plugin) match(rawContent string) (content string, matched bool) {
-	keywords := []string{
-		"手写",
-		"write",
-	}
-	for _, keyword := range keywords {
-		if strings.HasPrefix(rawContent, "#"+keyword+" ") {
-			matched = true
-			content = strings.TrimPrefix(rawContent, keyword)
-			return
-		}
-	}
-	return
+
+func (h Plugin) Name() string {
+	return "write"
 }
-func (h Plugin) Handle(ctx *hub.Context) error {
-	content, matched := h.match(ctx.Content)
-	if !matched || content == "" {
-		return nil
+
+func (h Plugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{
+			Name:    "手写",
+			Aliases: []string{"write"},
+			Usage:   "生成手写体图片",
+			Args: []hub.ArgSpec{
+				{Name: "content", Type: hub.ArgText, Required: true, Usage: "要手写的内容"},
+			},
+			Handler: h.write,
+		},
 	}
-	img, err := h.getImage(content, ctx.Username)
+}
+
+func (h Plugin) write(ctx *hub.Context, args *hub.Args) error {
+	content := args.String("content")
+	img, err := h.getImage(ctx, content, ctx.Username)
 	if err != nil {
 		slog.Error("[手写]获取图片失败", "error", err)
-		ctx.Abort()
-		return nil
+		return errors.New("[手写]获取图片失败")
 	}
 	if err := ctx.ReplayImg(fmt.Sprintf("%x.png", md5.Sum([]byte(content))), bytes.NewReader(img)); err != nil {
 		slog.Error("[手写]上传图片失败", "error", err)
-		ctx.Abort()
-		return nil
+		return errors.New("[手写]上传图片失败")
 	}
 	return nil
 }
 
-func (h Plugin) getImage(content string, author string) ([]byte, error) {
-	resp, err := http.Get("https://api.52vmy.cn/api/img/tw?msg=" + url.QueryEscape(content+"\n\u202E——"+author))
+func (h Plugin) getImage(ctx context.Context, content string, author string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.52vmy.cn/api/img/tw?msg="+url.QueryEscape(content+"\n\u202E——"+author), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -4,65 +4,145 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/redirect"
 )
 
+// errPointUnreachable 请求未得到积分服务的响应, 可以安全重试幂等的请求
+var errPointUnreachable = errors.New("发送请求失败")
+
 type (
 	PointManage struct {
 		apiHost  string
 		username string
 		password string
 		client   *http.Client
+		attempts int
+		backoff  redirect.Backoff
+		journal  *DeductionJournal
 	}
 
+	PointOption func(p *PointManage)
+
 	payPoint struct {
+		GID            string `json:"gid"`
+		UID            string `json:"uid"`
+		Point          int    `json:"point"`
+		Command        string `json:"command"`
+		IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	}
+	refundPoint struct {
+		DeductionID  string `json:"deductionId,omitempty"`
+		DeductionKey string `json:"deductionKey,omitempty"`
+		GID          string `json:"gid"`
+		UID          string `json:"uid"`
+		Point        int    `json:"point"`
+		Command      string `json:"command"`
+		Reason       string `json:"reason"`
+	}
+	grantPoint struct {
+		GID    string `json:"gid"`
+		UID    string `json:"uid"`
+		Point  int    `json:"point"`
+		Reason string `json:"reason"`
+	}
+	transferPoint struct {
 		GID     string `json:"gid"`
-		UID     string `json:"uid"`
+		FromUID string `json:"fromUid"`
+		ToUID   string `json:"toUid"`
 		Point   int    `json:"point"`
-		Command string `json:"command"`
+	}
+	deductionResult struct {
+		ID      string `json:"id"`
+		Balance int    `json:"balance"`
+	}
+	// pointRejectedError 积分服务明确拒绝的请求
+	pointRejectedError struct {
+		code int
+		msg  string
 	}
 	pointResult struct {
-		Code int    `json:"code"`
-		Msg  string `json:"msg"`
-		Data int    `json:"data"`
+		Code int             `json:"code"`
+		Msg  string          `json:"msg"`
+		Data json.RawMessage `json:"data"`
 	}
 )
 
-func NewPointManage(apiHost string, username string, password string) hub.PointInterface {
-	return &PointManage{
+func (e *pointRejectedError) Error() string {
+	return e.msg
+}
+
+// PointRetry 积分服务无响应时最多尝试 attempts 次, 只重试查询、带幂等键的扣除及指明扣除记录的退还
+func PointRetry(attempts int, backoff redirect.Backoff) PointOption {
+	return func(p *PointManage) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		if backoff.Max < backoff.Min {
+			backoff.Max = backoff.Min
+		}
+		if backoff.Factor < 1 {
+			backoff.Factor = 1
+		}
+		p.attempts = attempts
+		p.backoff = backoff
+	}
+}
+
+// PointJournal 将每次扣除及退还尝试写入 journal, 用于对账
+func PointJournal(journal *DeductionJournal) PointOption {
+	return func(p *PointManage) {
+		p.journal = journal
+	}
+}
+
+func NewPointManage(apiHost string, username string, password string, options ...PointOption) hub.PointInterface {
+	p := &PointManage{
 		apiHost:  apiHost,
 		username: username,
 		password: password,
-		client:   &http.Client{},
+		client:   &http.Client{Timeout: 10 * time.Second},
+		attempts: 3,
+		backoff:  redirect.Backoff{Min: 200 * time.Millisecond, Max: 2 * time.Second, Factor: 2, Jitter: 0.2},
+	}
+	for _, option := range options {
+		option(p)
 	}
+	return p
 }
 
-func (p PointManage) Pay(gid string, uid string, point int, command string) (int, error) {
-	data := payPoint{
-		GID:     gid,
-		UID:     uid,
-		Point:   point,
-		Command: command,
-	}
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		slog.Error("Error marshaling JSON", "data", data, "error", err)
-		return 0, fmt.Errorf("组装请求失败")
+// request 请求积分服务, 返回结果中的data
+func (p PointManage) request(ctx context.Context, method string, path string, data any) (json.RawMessage, error) {
+	var body *bytes.Buffer
+	if data != nil {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			slog.Error("Error marshaling JSON", "data", data, "error", err)
+			return nil, fmt.Errorf("组装请求失败")
+		}
+		body = bytes.NewBuffer(jsonData)
+	} else {
+		body = &bytes.Buffer{}
 	}
-	req, err := http.NewRequestWithContext(context.Background(), "POST", p.apiHost+"/api/point/deduction/command", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, method, p.apiHost+path, body)
 	if err != nil {
 		slog.Error("Error creating request", "error", err)
-		return 0, fmt.Errorf("创建请求失败")
+		return nil, fmt.Errorf("创建请求失败")
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
-	req.Header.Set("Content-Type", "application/json")
 	resp, err := p.client.Do(req)
 	if err != nil {
 		slog.Error("Error sending request", "error", err)
-		return 0, fmt.Errorf("发送请求失败")
+		return nil, errPointUnreachable
 	}
 	defer func() {
 		_ = resp.Body.Close()
@@ -71,12 +151,199 @@ func (p PointManage) Pay(gid string, uid string, point int, command string) (int
 	result := new(pointResult)
 	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
 		slog.Error("Error reading response body", "error", err)
-		return 0, fmt.Errorf("请求失败")
+		return nil, fmt.Errorf("请求失败")
 	}
 	if result.Code != 0 {
-		slog.Error("pay point failed", "gid", gid, "uid", uid, "point", strconv.Itoa(point), "command", command, "code", result.Code, "msg", result.Msg)
-		return result.Code, fmt.Errorf(result.Msg)
+		slog.Error("point request failed", "path", path, "data", data, "code", result.Code, "msg", result.Msg)
+		return nil, &pointRejectedError{code: result.Code, msg: result.Msg}
 	}
-	slog.Info("pay point", "gid", gid, "uid", uid, "point", strconv.Itoa(point), "command", command, "result", result)
 	return result.Data, nil
 }
+
+// retry 请求未得到响应时按退避策略重试, 最多尝试 attempts 次, 只能用于幂等的请求
+func (p PointManage) retry(ctx context.Context, attempts int, request func(attempt int) (json.RawMessage, error)) (json.RawMessage, error) {
+	for attempt := 1; ; attempt++ {
+		data, err := request(attempt)
+		if err == nil || !errors.Is(err, errPointUnreachable) || attempt >= attempts {
+			return data, err
+		}
+		delay := p.backoff.Delay(attempt)
+		slog.Warn("积分服务无响应 等待重试", "attempt", attempt, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// balanceOf 解析操作后的积分
+func balanceOf(data json.RawMessage) (int, error) {
+	var balance int
+	if err := json.Unmarshal(data, &balance); err != nil {
+		slog.Error("Error decoding balance", "data", string(data), "error", err)
+		return 0, fmt.Errorf("请求失败")
+	}
+	return balance, nil
+}
+
+// journaled 按 retry 请求积分服务, 每次尝试前后将 entry 的状态写入 journal, 成功时由调用方写入结果
+func (p PointManage) journaled(ctx context.Context, attempts int, entry *deductionJournalEntry, request func() (json.RawMessage, error)) (json.RawMessage, error) {
+	return p.retry(ctx, attempts, func(attempt int) (json.RawMessage, error) {
+		entry.Attempt = attempt
+		entry.Status = journalPending
+		entry.Error = ""
+		p.journal.write(*entry)
+		data, err := request()
+		if err != nil {
+			var rejected *pointRejectedError
+			if errors.As(err, &rejected) {
+				entry.Status = journalRejected
+			} else {
+				entry.Status = journalUnknown
+			}
+			entry.Error = err.Error()
+			p.journal.write(*entry)
+		}
+		return data, err
+	})
+}
+
+// Pay 扣除积分, ctx 中带有幂等键时(见 hub.WithDeductionKey)积分服务无响应会重试
+func (p PointManage) Pay(ctx context.Context, gid string, uid string, point int, command string) (*hub.Deduction, error) {
+	key := hub.DeductionKeyFrom(ctx)
+	entry := deductionJournalEntry{Kind: journalPay, Key: key, GID: gid, UID: uid, Point: point, Command: command}
+	attempts := 1
+	if key != "" {
+		// 没有幂等键时重试可能重复扣除
+		attempts = p.attempts
+	}
+	data, err := p.journaled(ctx, attempts, &entry, func() (json.RawMessage, error) {
+		return p.request(ctx, http.MethodPost, "/api/point/deduction/command", payPoint{
+			GID:            gid,
+			UID:            uid,
+			Point:          point,
+			Command:        command,
+			IdempotencyKey: key,
+		})
+	})
+	if err != nil {
+		slog.Error("pay point failed", "gid", gid, "uid", uid, "point", strconv.Itoa(point), "command", command, "key", key, "error", err)
+		return nil, err
+	}
+	deduction := &hub.Deduction{Key: key, GID: gid, UID: uid, Point: point, Command: command}
+	// 旧版积分服务只返回扣除后的积分
+	result := deductionResult{}
+	if err := json.Unmarshal(data, &result.Balance); err != nil {
+		if err := json.Unmarshal(data, &result); err != nil {
+			slog.Error("Error decoding deduction", "data", string(data), "error", err)
+			entry.Status = journalUnknown
+			entry.Error = "解析响应失败: " + string(data)
+			p.journal.write(entry)
+			return nil, fmt.Errorf("请求失败")
+		}
+	}
+	deduction.ID = result.ID
+	deduction.Balance = result.Balance
+	entry.Status = journalOK
+	entry.DeductionID = result.ID
+	entry.Balance = result.Balance
+	p.journal.write(entry)
+	slog.Info("pay point", "gid", gid, "uid", uid, "point", strconv.Itoa(point), "command", command, "result", result)
+	return deduction, nil
+}
+
+func (p PointManage) Balance(ctx context.Context, gid string, uid string) (int, error) {
+	query := url.Values{"gid": {gid}, "uid": {uid}}
+	data, err := p.retry(ctx, p.attempts, func(int) (json.RawMessage, error) {
+		return p.request(ctx, http.MethodGet, "/api/point/balance?"+query.Encode(), nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return balanceOf(data)
+}
+
+// Refund 退还扣除的积分, 指明了扣除记录(ID 或幂等键)时积分服务无响应会重试, 同一扣除只会退还一次
+func (p PointManage) Refund(ctx context.Context, deduction *hub.Deduction, reason string) (int, error) {
+	entry := deductionJournalEntry{
+		Kind:        journalRefund,
+		Key:         deduction.Key,
+		GID:         deduction.GID,
+		UID:         deduction.UID,
+		Point:       deduction.Point,
+		Command:     deduction.Command,
+		DeductionID: deduction.ID,
+		Reason:      reason,
+	}
+	attempts := 1
+	if deduction.ID != "" || deduction.Key != "" {
+		attempts = p.attempts
+	}
+	data, err := p.journaled(ctx, attempts, &entry, func() (json.RawMessage, error) {
+		return p.request(ctx, http.MethodPost, "/api/point/refund", refundPoint{
+			DeductionID:  deduction.ID,
+			DeductionKey: deduction.Key,
+			GID:          deduction.GID,
+			UID:          deduction.UID,
+			Point:        deduction.Point,
+			Command:      deduction.Command,
+			Reason:       reason,
+		})
+	})
+	if err != nil {
+		slog.Error("refund point failed", "deduction", deduction, "reason", reason, "error", err)
+		return 0, err
+	}
+	balance, err := balanceOf(data)
+	if err != nil {
+		entry.Status = journalUnknown
+		entry.Error = "解析响应失败: " + string(data)
+		p.journal.write(entry)
+		return 0, err
+	}
+	entry.Status = journalOK
+	entry.Balance = balance
+	p.journal.write(entry)
+	slog.Info("refund point", "deduction", deduction, "reason", reason)
+	return balance, nil
+}
+
+func (p PointManage) Grant(ctx context.Context, gid string, uid string, point int, reason string) (int, error) {
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	data, err := p.request(ctx, http.MethodPost, "/api/point/grant", grantPoint{
+		GID:    gid,
+		UID:    uid,
+		Point:  point,
+		Reason: reason,
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("grant point", "gid", gid, "uid", uid, "point", point, "reason", reason)
+	return balanceOf(data)
+}
+
+func (p PointManage) Transfer(ctx context.Context, gid string, fromUID string, toUID string, point int) (int, error) {
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	if fromUID == toUID {
+		return 0, fmt.Errorf("不能转给自己")
+	}
+	data, err := p.request(ctx, http.MethodPost, "/api/point/transfer", transferPoint{
+		GID:     gid,
+		FromUID: fromUID,
+		ToUID:   toUID,
+		Point:   point,
+	})
+	if err != nil {
+		return 0, err
+	}
+	slog.Info("transfer point", "gid", gid, "from", fromUID, "to", toUID, "point", point)
+	return balanceOf(data)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"wechat-hub-plugin/hub"
+)
+
+// memoryPoint 只保存在内存中的积分, 重放录制文件时代替真实的积分服务
+type memoryPoint struct {
+	mu         sync.Mutex
+	initial    int
+	balances   map[string]int
+	deductions map[string]*hub.Deduction // 按id记录, 用于退还
+	keys       map[string]*hub.Deduction // 按幂等键记录
+	refunded   map[string]bool
+	seq        int
+}
+
+func newMemoryPoint(initial int) *memoryPoint {
+	return &memoryPoint{
+		initial:    initial,
+		balances:   map[string]int{},
+		deductions: map[string]*hub.Deduction{},
+		keys:       map[string]*hub.Deduction{},
+		refunded:   map[string]bool{},
+	}
+}
+
+func (p *memoryPoint) balanceLocked(gid string, uid string) int {
+	if balance, ok := p.balances[gid+"/"+uid]; ok {
+		return balance
+	}
+	return p.initial
+}
+
+// changeLocked 修改积分, 积分不足时返回错误
+func (p *memoryPoint) changeLocked(gid string, uid string, point int) (int, error) {
+	balance := p.balanceLocked(gid, uid) + point
+	if balance < 0 {
+		return 0, fmt.Errorf("积分不足, 当前%d积分", balance-point)
+	}
+	p.balances[gid+"/"+uid] = balance
+	return balance, nil
+}
+
+func (p *memoryPoint) Pay(ctx context.Context, gid string, uid string, point int, command string) (*hub.Deduction, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := hub.DeductionKeyFrom(ctx)
+	if deduction, ok := p.keys[key]; ok && key != "" {
+		d := *deduction
+		return &d, nil
+	}
+	balance, err := p.changeLocked(gid, uid, -point)
+	if err != nil {
+		return nil, err
+	}
+	p.seq++
+	deduction := &hub.Deduction{ID: strconv.Itoa(p.seq), Key: key, GID: gid, UID: uid, Point: point, Command: command, Balance: balance}
+	p.deductions[deduction.ID] = deduction
+	if key != "" {
+		p.keys[key] = deduction
+	}
+	slog.Info("pay point(memory)", "gid", gid, "uid", uid, "point", point, "command", command, "balance", balance)
+	return deduction, nil
+}
+
+func (p *memoryPoint) Balance(_ context.Context, gid string, uid string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.balanceLocked(gid, uid), nil
+}
+
+func (p *memoryPoint) Refund(_ context.Context, deduction *hub.Deduction, reason string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if deduction.ID != "" {
+		if _, ok := p.deductions[deduction.ID]; !ok {
+			return 0, fmt.Errorf("扣除记录 %s 不存在", deduction.ID)
+		}
+		if p.refunded[deduction.ID] {
+			return 0, fmt.Errorf("积分已退还")
+		}
+		p.refunded[deduction.ID] = true
+	}
+	slog.Info("refund point(memory)", "deduction", deduction, "reason", reason)
+	return p.changeLocked(deduction.GID, deduction.UID, deduction.Point)
+}
+
+func (p *memoryPoint) Grant(_ context.Context, gid string, uid string, point int, reason string) (int, error) {
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changeLocked(gid, uid, point)
+}
+
+func (p *memoryPoint) Transfer(_ context.Context, gid string, fromUID string, toUID string, point int) (int, error) {
+	if point <= 0 {
+		return 0, fmt.Errorf("积分必须大于0")
+	}
+	if fromUID == toUID {
+		return 0, fmt.Errorf("不能转给自己")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	balance, err := p.changeLocked(gid, fromUID, -point)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := p.changeLocked(gid, toUID, point); err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
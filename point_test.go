@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/redirect"
+)
+
+// pointServer 模拟积分服务, 按路径返回预设的data并记录请求, 前 drop 个请求不响应直接断开连接
+type pointServer struct {
+	mu       sync.Mutex
+	requests []string
+	bodies   []map[string]any
+	times    []time.Time
+	data     map[string]string
+	drop     int
+}
+
+func newPointServer(t *testing.T, data map[string]string, options ...PointOption) (*pointServer, hub.PointInterface) {
+	t.Helper()
+	p := &pointServer{data: data}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		p.mu.Lock()
+		p.requests = append(p.requests, r.Method+" "+r.URL.RequestURI())
+		p.bodies = append(p.bodies, body)
+		p.times = append(p.times, time.Now())
+		drop := len(p.requests) <= p.drop
+		p.mu.Unlock()
+		if drop {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			_ = conn.Close()
+			return
+		}
+		data, ok := p.data[r.URL.Path]
+		if !ok {
+			_, _ = fmt.Fprint(w, `{"code":1,"msg":"积分不足"}`)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"code":0,"data":%s}`, data)
+	}))
+	t.Cleanup(server.Close)
+	return p, NewPointManage(server.URL, "", "", options...)
+}
+
+func (p *pointServer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.requests)
+}
+
+// setDrop 之后的 n 个请求不响应
+func (p *pointServer) setDrop(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drop = len(p.requests) + n
+}
+
+// fastRetry 测试用的重试间隔
+var fastRetry = PointRetry(3, redirect.Backoff{Min: time.Millisecond, Max: time.Millisecond, Factor: 2})
+
+// openJournal 在临时目录中打开扣除记录, 返回文件路径
+func openJournal(t *testing.T) (*DeductionJournal, string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "journal", "point.jsonl")
+	journal, err := OpenDeductionJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = journal.Close()
+	})
+	return journal, file
+}
+
+// readJournal 按行读取扣除记录, 返回每条记录的 类型:尝试次数:状态
+func readJournal(t *testing.T, file string) []string {
+	t.Helper()
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	for _, line := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		var entry deductionJournalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		records = append(records, fmt.Sprintf("%s:%d:%s", entry.Kind, entry.Attempt, entry.Status))
+	}
+	return records
+}
+
+func TestPointManagePayAndRefund(t *testing.T) {
+	server, p := newPointServer(t, map[string]string{
+		"/api/point/deduction/command": `{"id":"d1","balance":70}`,
+		"/api/point/refund":            `100`,
+	})
+	ctx := context.Background()
+	deduction, err := p.Pay(ctx, "gid", "uid", 30, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (hub.Deduction{ID: "d1", GID: "gid", UID: "uid", Point: 30, Command: "nga", Balance: 70}); *deduction != want {
+		t.Fatalf("deduction = %+v, want %+v", *deduction, want)
+	}
+	if balance, err := p.Refund(ctx, deduction, "处理失败"); err != nil || balance != 100 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if body := server.bodies[1]; body["deductionId"] != "d1" || body["point"] != float64(30) || body["reason"] != "处理失败" {
+		t.Fatalf("refund body = %v", body)
+	}
+}
+
+func TestPointManagePayLegacyResult(t *testing.T) {
+	// 旧版积分服务只返回扣除后的积分
+	_, p := newPointServer(t, map[string]string{"/api/point/deduction/command": `70`})
+	deduction, err := p.Pay(context.Background(), "gid", "uid", 30, "nga")
+	if err != nil || deduction.ID != "" || deduction.Balance != 70 {
+		t.Fatalf("deduction = %+v, err = %v", deduction, err)
+	}
+}
+
+func TestPointManageError(t *testing.T) {
+	_, p := newPointServer(t, map[string]string{})
+	if _, err := p.Pay(context.Background(), "gid", "uid", 30, "nga"); err == nil || err.Error() != "积分不足" {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestPointManageBalanceGrantAndTransfer(t *testing.T) {
+	server, p := newPointServer(t, map[string]string{
+		"/api/point/balance":  `50`,
+		"/api/point/grant":    `60`,
+		"/api/point/transfer": `40`,
+	})
+	ctx := context.Background()
+	if balance, err := p.Balance(ctx, "gid", "uid"); err != nil || balance != 50 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if balance, err := p.Grant(ctx, "gid", "uid", 10, "奖励"); err != nil || balance != 60 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if balance, err := p.Transfer(ctx, "gid", "uid", "other", 20); err != nil || balance != 40 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if server.requests[0] != "GET /api/point/balance?gid=gid&uid=uid" {
+		t.Fatalf("requests = %v", server.requests)
+	}
+	if body := server.bodies[2]; body["fromUid"] != "uid" || body["toUid"] != "other" || body["point"] != float64(20) {
+		t.Fatalf("transfer body = %v", body)
+	}
+}
+
+func TestPointManageValidation(t *testing.T) {
+	server, p := newPointServer(t, map[string]string{
+		"/api/point/grant":    `60`,
+		"/api/point/transfer": `40`,
+	})
+	ctx := context.Background()
+	for _, point := range []int{0, -10} {
+		if _, err := p.Grant(ctx, "gid", "uid", point, "奖励"); err == nil {
+			t.Fatalf("增加 %d 积分应返回错误", point)
+		}
+		if _, err := p.Transfer(ctx, "gid", "uid", "other", point); err == nil {
+			t.Fatalf("转移 %d 积分应返回错误", point)
+		}
+	}
+	if _, err := p.Transfer(ctx, "gid", "uid", "uid", 10); err == nil {
+		t.Fatal("不能转给自己")
+	}
+	// 参数错误时不请求积分服务
+	if len(server.requests) != 0 {
+		t.Fatalf("requests = %v", server.requests)
+	}
+}
+
+func TestPointManagePayRetriesOnlyWithKey(t *testing.T) {
+	server, p := newPointServer(t, map[string]string{"/api/point/deduction/command": `{"id":"d1","balance":70}`}, fastRetry)
+	server.setDrop(1)
+	// 没有幂等键时重试可能重复扣除, 不重试
+	if _, err := p.Pay(context.Background(), "gid", "uid", 30, "nga"); !errors.Is(err, errPointUnreachable) {
+		t.Fatalf("err = %v, want errPointUnreachable", err)
+	}
+	if count := server.count(); count != 1 {
+		t.Fatalf("requests = %d, want 1", count)
+	}
+	server.setDrop(2)
+	deduction, err := p.Pay(hub.WithDeductionKey(context.Background(), "m1"), "gid", "uid", 30, "nga")
+	if err != nil || deduction.ID != "d1" {
+		t.Fatalf("deduction = %+v, err = %v", deduction, err)
+	}
+	if count := server.count(); count != 4 {
+		t.Fatalf("requests = %d, want 4", count)
+	}
+	for _, body := range server.bodies[1:] {
+		if body["idempotencyKey"] != "m1" {
+			t.Fatalf("重试应使用相同的幂等键: %v", body)
+		}
+	}
+}
+
+func TestPointManageRetryGivesUp(t *testing.T) {
+	server, p := newPointServer(t, map[string]string{}, fastRetry)
+	server.setDrop(10)
+	if _, err := p.Pay(hub.WithDeductionKey(context.Background(), "m1"), "gid", "uid", 30, "nga"); !errors.Is(err, errPointUnreachable) {
+		t.Fatalf("err = %v, want errPointUnreachable", err)
+	}
+	if count := server.count(); count != 3 {
+		t.Fatalf("requests = %d, want 3", count)
+	}
+	// 积分服务拒绝时不重试
+	server.setDrop(0)
+	if _, err := p.Pay(hub.WithDeductionKey(context.Background(), "m2"), "gid", "uid", 30, "nga"); err == nil || err.Error() != "积分不足" {
+		t.Fatalf("err = %v", err)
+	}
+	if count := server.count(); count != 4 {
+		t.Fatalf("requests = %d, want 4", count)
+	}
+}
+
+func TestPointRetryBackoff(t *testing.T) {
+	p := NewPointManage("", "", "", PointRetry(0, redirect.Backoff{Min: 20 * time.Millisecond, Max: time.Millisecond})).(*PointManage)
+	if p.attempts != 1 || p.backoff.Max != 20*time.Millisecond || p.backoff.Factor != 1 {
+		t.Fatalf("attempts = %d, backoff = %+v", p.attempts, p.backoff)
+	}
+	backoff := redirect.Backoff{Min: 20 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}
+	server, p2 := newPointServer(t, map[string]string{"/api/point/deduction/command": `70`}, PointRetry(4, backoff))
+	server.setDrop(3)
+	if _, err := p2.Pay(hub.WithDeductionKey(context.Background(), "m1"), "gid", "uid", 30, "nga"); err != nil {
+		t.Fatal(err)
+	}
+	// 每次重试前按退避策略等待, 等待时间不超过 Max
+	want := []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	for i, delay := range want {
+		if got := backoff.Delay(i + 1); got != delay {
+			t.Fatalf("Delay(%d) = %v, want %v", i+1, got, delay)
+		}
+		if gap := server.times[i+1].Sub(server.times[i]); gap < delay {
+			t.Fatalf("第%d次重试间隔 %v, want >= %v", i+1, gap, delay)
+		}
+	}
+}
+
+func TestPointManageRefundRetries(t *testing.T) {
+	server, p := newPointServer(t, map[string]string{"/api/point/refund": `100`}, fastRetry)
+	server.setDrop(1)
+	// 没有指明扣除记录时不重试
+	if _, err := p.Refund(context.Background(), &hub.Deduction{GID: "gid", UID: "uid", Point: 30}, "失败"); !errors.Is(err, errPointUnreachable) {
+		t.Fatalf("err = %v, want errPointUnreachable", err)
+	}
+	server.setDrop(2)
+	if balance, err := p.Refund(context.Background(), &hub.Deduction{ID: "d1", GID: "gid", UID: "uid", Point: 30}, "失败"); err != nil || balance != 100 {
+		t.Fatalf("balance = %d, err = %v", balance, err)
+	}
+	if count := server.count(); count != 4 {
+		t.Fatalf("requests = %d, want 4", count)
+	}
+}
+
+func TestDeductionJournal(t *testing.T) {
+	journal, file := openJournal(t)
+	server, p := newPointServer(t, map[string]string{
+		"/api/point/deduction/command": `{"id":"d1","balance":70}`,
+		"/api/point/refund":            `100`,
+	}, fastRetry, PointJournal(journal))
+	server.setDrop(1)
+	deduction, err := p.Pay(hub.WithDeductionKey(context.Background(), "m1"), "gid", "uid", 30, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Refund(context.Background(), deduction, "失败"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"pay:1:pending", "pay:1:unknown", "pay:2:pending", "pay:2:ok", "refund:1:pending", "refund:1:ok"}
+	if records := readJournal(t, file); !slices.Equal(records, want) {
+		t.Fatalf("records = %v, want %v", records, want)
+	}
+	// 重新打开后追加写入, 保留之前的记录
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	journal, err = OpenDeductionJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	delete(server.data, "/api/point/deduction/command")
+	_, p = newPointServer(t, server.data, PointJournal(journal))
+	if _, err := p.Pay(context.Background(), "gid", "uid", 30, "nga"); err == nil {
+		t.Fatal("积分服务拒绝时应返回错误")
+	}
+	want = append(want, "pay:1:pending", "pay:1:rejected")
+	if records := readJournal(t, file); !slices.Equal(records, want) {
+		t.Fatalf("records = %v, want %v", records, want)
+	}
+}
+
+func TestReservationRefundRetries(t *testing.T) {
+	journal, file := openJournal(t)
+	server, p := newPointServer(t, map[string]string{
+		"/api/point/deduction/command": `{"id":"d1","balance":70}`,
+		"/api/point/refund":            `100`,
+	}, fastRetry, PointJournal(journal))
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx := &hub.Context{Message: &hub.Message{BaseMessage: hub.BaseMessage{GID: "gid", UID: "uid"}}, Point: p}
+	ctx.SetContext(c)
+	if _, err := ctx.Reserve(30, "nga"); err != nil {
+		t.Fatal(err)
+	}
+	// ctx 结束后自动退还, 积分服务无响应时重试后退还成功
+	server.setDrop(1)
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for server.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests = %v", server.requests)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ctx.CancelReservations("处理未完成")
+	want := []string{"pay:1:pending", "pay:1:ok", "refund:1:pending", "refund:1:unknown", "refund:2:pending", "refund:2:ok"}
+	for !slices.Equal(readJournal(t, file), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("records = %v, want %v", readJournal(t, file), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
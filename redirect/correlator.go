@@ -0,0 +1,143 @@
+package redirect
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrResponseTimeout = errors.New("等待响应超时")
+	ErrDisconnected    = errors.New("连接已断开")
+)
+
+type (
+	// Transport 可收发消息的连接
+	Transport interface {
+		MessageRedirector
+		MessageReceiver
+	}
+
+	// ResponseReceiver 通过单独通道返回命令响应的连接, 如http请求的响应体, 收到的数据只作为响应匹配
+	ResponseReceiver interface {
+		OnResponse(fn OnMessage)
+	}
+
+	// ResponseMatcher 判断收到的数据是否为响应, 返回对应的请求id
+	ResponseMatcher func(data []byte) (id string, ok bool)
+
+	// Correlator 将响应按请求id交给等待中的调用方, 其余消息原样转发
+	Correlator struct {
+		transport Transport
+		match     ResponseMatcher
+		timeout   time.Duration
+		mu        sync.Mutex
+		pending   map[string]chan response
+		onMessage OnMessage
+	}
+
+	// response 等待中的请求收到的响应, 连接断开时为错误
+	response struct {
+		data []byte
+		err  error
+	}
+)
+
+func NewCorrelator(transport Transport, match ResponseMatcher, timeout time.Duration) *Correlator {
+	c := &Correlator{
+		transport: transport,
+		match:     match,
+		timeout:   timeout,
+		pending:   map[string]chan response{},
+	}
+	transport.OnMessage(c.receive)
+	if receiver, ok := transport.(ResponseReceiver); ok {
+		receiver.OnResponse(func(data []byte) error {
+			c.respond(data)
+			return nil
+		})
+	}
+	return c
+}
+
+// respond 数据为响应时交给等待中的调用方, 超时后才到达的响应直接丢弃
+func (c *Correlator) respond(data []byte) bool {
+	id, ok := c.match(data)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	ch, waiting := c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if waiting {
+		ch <- response{data: data}
+	}
+	return true
+}
+
+// FailPending 等待中的请求立即返回 err, 用于连接断开时不再等待已发出请求的响应
+func (c *Correlator) FailPending(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.pending {
+		ch <- response{err: err}
+		delete(c.pending, id)
+	}
+}
+
+func (c *Correlator) receive(data []byte) error {
+	if c.respond(data) {
+		return nil
+	}
+	c.mu.Lock()
+	onMessage := c.onMessage
+	c.mu.Unlock()
+	if onMessage == nil {
+		return nil
+	}
+	return onMessage(data)
+}
+
+// Request 发送请求并等待相同id的响应
+func (c *Correlator) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	ch := make(chan response, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+	if err := c.transport.SendMessage(data); err != nil {
+		return nil, err
+	}
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		timer := time.NewTimer(c.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case resp := <-ch:
+		return resp.data, resp.err
+	case <-timeout:
+		return nil, ErrResponseTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SendMessage 发送不需要响应的消息
+func (c *Correlator) SendMessage(data []byte) error {
+	return c.transport.SendMessage(data)
+}
+
+// OnMessage 接收响应以外的消息
+func (c *Correlator) OnMessage(fn OnMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = fn
+}
@@ -0,0 +1,204 @@
+package redirect
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport 记录发送的消息, deliver 模拟收到hub的数据
+type fakeTransport struct {
+	mu        sync.Mutex
+	sent      chan []byte
+	sendErr   error
+	onMessage OnMessage
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{sent: make(chan []byte, 10)}
+}
+
+func (f *fakeTransport) SendMessage(data []byte) error {
+	if f.sendErr != nil {
+		return f.sendErr
+	}
+	f.sent <- data
+	return nil
+}
+
+func (f *fakeTransport) OnMessage(fn OnMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onMessage = fn
+}
+
+func (f *fakeTransport) deliver(data string) {
+	f.mu.Lock()
+	onMessage := f.onMessage
+	f.mu.Unlock()
+	_ = onMessage([]byte(data))
+}
+
+// waitSent 等待请求发出
+func (f *fakeTransport) waitSent(t *testing.T) string {
+	t.Helper()
+	select {
+	case data := <-f.sent:
+		return string(data)
+	case <-time.After(time.Second):
+		t.Fatal("请求未发出")
+		return ""
+	}
+}
+
+type requestResult struct {
+	data string
+	err  error
+}
+
+// request 在后台发送请求, 返回结果的通道
+func request(c *Correlator, ctx context.Context, id string) <-chan requestResult {
+	result := make(chan requestResult, 1)
+	go func() {
+		data, err := c.Request(ctx, id, []byte(`{"id":"`+id+`","command":"sendMsg"}`))
+		result <- requestResult{string(data), err}
+	}()
+	return result
+}
+
+func waitResult(t *testing.T, result <-chan requestResult) requestResult {
+	t.Helper()
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("请求未返回")
+		return requestResult{}
+	}
+}
+
+// pendingCount 等待中的请求数
+func (c *Correlator) pendingCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+func TestCorrelatorMatchesResponses(t *testing.T) {
+	transport := newFakeTransport()
+	c := NewCorrelator(transport, responseID, time.Second)
+	messages := make(chan string, 10)
+	c.OnMessage(func(data []byte) error {
+		messages <- string(data)
+		return nil
+	})
+	first := request(c, context.Background(), "r1")
+	transport.waitSent(t)
+	second := request(c, context.Background(), "r2")
+	transport.waitSent(t)
+	// 响应的顺序与请求不同时按id交给对应的请求
+	transport.deliver(`{"id":"r2","code":0}`)
+	transport.deliver(`{"id":"x","msgType":1}`)
+	transport.deliver(`{"id":"r1","code":1}`)
+	if r := waitResult(t, second); r.err != nil || r.data != `{"id":"r2","code":0}` {
+		t.Fatalf("second = %+v", r)
+	}
+	if r := waitResult(t, first); r.err != nil || r.data != `{"id":"r1","code":1}` {
+		t.Fatalf("first = %+v", r)
+	}
+	// 响应以外的消息原样转发
+	if message := <-messages; message != `{"id":"x","msgType":1}` {
+		t.Fatalf("message = %s", message)
+	}
+	if n := c.pendingCount(); n != 0 {
+		t.Fatalf("pending = %d", n)
+	}
+}
+
+func TestCorrelatorTimeoutDropsLateResponse(t *testing.T) {
+	transport := newFakeTransport()
+	c := NewCorrelator(transport, responseID, 20*time.Millisecond)
+	messages := make(chan string, 10)
+	c.OnMessage(func(data []byte) error {
+		messages <- string(data)
+		return nil
+	})
+	result := request(c, context.Background(), "r1")
+	transport.waitSent(t)
+	if r := waitResult(t, result); !errors.Is(r.err, ErrResponseTimeout) {
+		t.Fatalf("err = %v, want ErrResponseTimeout", r.err)
+	}
+	// 超时后到达的响应直接丢弃, 不阻塞接收, 也不作为消息转发
+	done := make(chan struct{})
+	go func() {
+		transport.deliver(`{"id":"r1","code":0}`)
+		transport.deliver(`{"id":"r1","code":0}`)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("迟到的响应阻塞了接收")
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("迟到的响应不应转发: %s", message)
+	default:
+	}
+	if n := c.pendingCount(); n != 0 {
+		t.Fatalf("pending = %d", n)
+	}
+}
+
+func TestCorrelatorContextCanceled(t *testing.T) {
+	transport := newFakeTransport()
+	c := NewCorrelator(transport, responseID, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := request(c, ctx, "r1")
+	transport.waitSent(t)
+	cancel()
+	if r := waitResult(t, result); !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", r.err)
+	}
+	if n := c.pendingCount(); n != 0 {
+		t.Fatalf("pending = %d", n)
+	}
+}
+
+func TestCorrelatorSendError(t *testing.T) {
+	transport := newFakeTransport()
+	transport.sendErr = errors.New("队列已满")
+	c := NewCorrelator(transport, responseID, time.Second)
+	if _, err := c.Request(context.Background(), "r1", []byte(`{"id":"r1"}`)); !errors.Is(err, transport.sendErr) {
+		t.Fatalf("err = %v, want %v", err, transport.sendErr)
+	}
+	if n := c.pendingCount(); n != 0 {
+		t.Fatalf("pending = %d", n)
+	}
+}
+
+func TestCorrelatorFailPending(t *testing.T) {
+	transport := newFakeTransport()
+	c := NewCorrelator(transport, responseID, 0)
+	first := request(c, context.Background(), "r1")
+	transport.waitSent(t)
+	second := request(c, context.Background(), "r2")
+	transport.waitSent(t)
+	// 连接断开时等待中的请求立即失败, 不等到超时
+	c.FailPending(ErrDisconnected)
+	for _, result := range []<-chan requestResult{first, second} {
+		if r := waitResult(t, result); !errors.Is(r.err, ErrDisconnected) {
+			t.Fatalf("err = %v, want ErrDisconnected", r.err)
+		}
+	}
+	transport.deliver(`{"id":"r1","code":0}`)
+	// 之后的请求不受影响
+	third := request(c, context.Background(), "r3")
+	transport.waitSent(t)
+	transport.deliver(`{"id":"r3","code":0}`)
+	if r := waitResult(t, third); r.err != nil {
+		t.Fatalf("err = %v", r.err)
+	}
+}
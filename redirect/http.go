@@ -0,0 +1,268 @@
+package redirect
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SignatureHeader 请求体签名的请求头, 值为 sha256=<hex(hmac_sha256(secret, body))>
+const SignatureHeader = "X-Hub-Signature"
+
+type (
+	// HTTPRedirector 通过webhook接收hub推送的消息, 通过http请求向hub发送命令
+	HTTPRedirector struct {
+		commandUrl string
+		username   string
+		password   string
+		secret     []byte
+		client     *http.Client
+		outbox     *Outbox
+		backoff    Backoff
+		closed     atomic.Bool
+		failing    atomic.Bool
+		mu         sync.RWMutex
+		onMessage  OnMessage
+		onResponse OnMessage
+	}
+
+	HTTPOption func(h *HTTPRedirector)
+)
+
+// HTTPBasicAuth webhook校验及发送命令时使用的用户名密码
+func HTTPBasicAuth(username, password string) HTTPOption {
+	return func(h *HTTPRedirector) {
+		h.username = username
+		h.password = password
+	}
+}
+
+// HTTPSignature webhook校验及发送命令时使用的签名密钥
+func HTTPSignature(secret string) HTTPOption {
+	return func(h *HTTPRedirector) {
+		h.secret = []byte(secret)
+	}
+}
+
+// HTTPTimeout 发送命令的请求超时时间
+func HTTPTimeout(timeout time.Duration) HTTPOption {
+	return func(h *HTTPRedirector) {
+		h.client.Timeout = timeout
+	}
+}
+
+// HTTPBackoff 发送失败后的重试等待策略, 无效的配置按 WSClientBackoff 的规则修正
+func HTTPBackoff(backoff Backoff) HTTPOption {
+	return func(h *HTTPRedirector) {
+		h.backoff = backoff.normalize()
+	}
+}
+
+// HTTPOutbox 使用指定的待发送队列, 默认使用仅保存在内存中的队列
+func HTTPOutbox(outbox *Outbox) HTTPOption {
+	return func(h *HTTPRedirector) {
+		h.outbox = outbox
+	}
+}
+
+func NewHTTPMessageHandler(ctx context.Context, commandUrl string, options ...HTTPOption) *HTTPRedirector {
+	h := &HTTPRedirector{
+		commandUrl: commandUrl,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		backoff:    Backoff{Min: time.Second, Max: time.Minute, Factor: 2, Jitter: 0.2},
+	}
+	for _, option := range options {
+		option(h)
+	}
+	if h.outbox == nil {
+		h.outbox, _ = NewOutbox()
+	}
+	go h.sendMessage(ctx)
+	go func() {
+		<-ctx.Done()
+		h.closed.Store(true)
+	}()
+	return h
+}
+
+// sign 计算请求体签名
+func (h *HTTPRedirector) sign(body []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify 校验webhook请求, 配置了签名密钥时校验签名, 配置了用户名时校验Basic认证
+func (h *HTTPRedirector) verify(r *http.Request, body []byte) bool {
+	if len(h.secret) > 0 && !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(h.sign(body))) {
+		return false
+	}
+	if h.username != "" {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(h.username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(h.password)) != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP 接收hub推送的消息
+func (h *HTTPRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1024*1024*10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.verify(r, body) {
+		slog.Warn("webhook认证失败", "remote", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if !json.Valid(body) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	h.mu.RLock()
+	onMessage := h.onMessage
+	h.mu.RUnlock()
+	if onMessage != nil {
+		if err := onMessage(body); err != nil {
+			// 返回错误让hub稍后重试
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// post 发送一条命令, 返回响应体
+func (h *HTTPRedirector) post(ctx context.Context, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.commandUrl, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.username != "" {
+		req.SetBasicAuth(h.username, h.password)
+	}
+	if len(h.secret) > 0 {
+		req.Header.Set(SignatureHeader, h.sign(data))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024*10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("发送命令失败: %s", resp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// deliver 命令请求的响应体交给响应处理, 由 Correlator 按请求id匹配
+func (h *HTTPRedirector) deliver(body []byte) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return
+	}
+	if !json.Valid(body) {
+		slog.Warn("命令响应不是有效的json", "body", string(body))
+		return
+	}
+	h.mu.RLock()
+	onResponse := h.onResponse
+	h.mu.RUnlock()
+	if onResponse == nil {
+		return
+	}
+	if err := onResponse(body); err != nil {
+		slog.Error("处理命令响应失败", "err", err)
+	}
+}
+
+// sendMessage 按顺序发送待发送队列中的消息, 失败时按退避策略等待后重试
+func (h *HTTPRedirector) sendMessage(ctx context.Context) {
+	attempt := 0
+	for {
+		entry, ok := h.outbox.next(ctx)
+		if !ok {
+			return
+		}
+		body, err := h.post(ctx, []byte(entry.Data))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			attempt++
+			h.failing.Store(true)
+			delay := h.backoff.Delay(attempt)
+			slog.Error("发送命令失败 等待重试", "id", entry.ID, "delay", delay, "err", err)
+			h.outbox.fail(entry, err)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		attempt = 0
+		h.failing.Store(false)
+		h.outbox.done(entry)
+		h.deliver(body)
+	}
+}
+
+// State 最近一次发送失败时为已断开
+func (h *HTTPRedirector) State() ConnState {
+	switch {
+	case h.closed.Load():
+		return StateClosed
+	case h.failing.Load():
+		return StateDisconnected
+	default:
+		return StateConnected
+	}
+}
+
+// SendMessage 消息放入待发送队列
+func (h *HTTPRedirector) SendMessage(bytes []byte) error {
+	return h.outbox.Push(bytes)
+}
+
+func (h *HTTPRedirector) OnMessage(fn OnMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onMessage = fn
+}
+
+// OnResponse 接收发送命令的响应体
+func (h *HTTPRedirector) OnResponse(fn OnMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onResponse = fn
+}
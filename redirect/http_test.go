@@ -0,0 +1,101 @@
+package redirect
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// responseID 测试用的响应匹配: 带 id 且不带 msgType 的数据为命令响应
+func responseID(data []byte) (string, bool) {
+	var v struct {
+		ID      string `json:"id"`
+		MsgType *int   `json:"msgType"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil || v.ID == "" || v.MsgType != nil {
+		return "", false
+	}
+	return v.ID, true
+}
+
+func TestHTTPCommandResponseReachesCorrelator(t *testing.T) {
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var command struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(body, &command)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"id": command.ID, "code": 0, "data": map[string]string{"msgID": "m1"}})
+	}))
+	defer hub.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHTTPMessageHandler(ctx, hub.URL)
+	correlator := NewCorrelator(h, responseID, time.Second)
+	resp, err := correlator.Request(ctx, "req-1", []byte(`{"id":"req-1","command":"sendMsg"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := responseID(resp); !ok || id != "req-1" {
+		t.Fatalf("unexpected response %s", resp)
+	}
+}
+
+func TestHTTPCommandResponseIsNotDeliveredAsMessage(t *testing.T) {
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"code":0}`))
+	}))
+	defer hub.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := NewHTTPMessageHandler(ctx, hub.URL)
+	correlator := NewCorrelator(h, responseID, time.Second)
+	messages := make(chan []byte, 1)
+	correlator.OnMessage(func(data []byte) error {
+		messages <- data
+		return nil
+	})
+	if err := correlator.SendMessage([]byte(`{"command":"sendMsg"}`)); err != nil {
+		t.Fatal(err)
+	}
+	flushCtx, flushCancel := context.WithTimeout(ctx, time.Second)
+	defer flushCancel()
+	if n := h.outbox.Flush(flushCtx); n != 0 {
+		t.Fatalf("%d commands not sent", n)
+	}
+	select {
+	case data := <-messages:
+		t.Fatalf("command response delivered as message: %s", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHTTPBackoffNormalized(t *testing.T) {
+	tests := []struct {
+		backoff Backoff
+		want    Backoff
+	}{
+		{Backoff{}, Backoff{Min: time.Second, Max: time.Minute, Factor: 1}},
+		{Backoff{Min: 2 * time.Second, Max: time.Second, Factor: 0.5, Jitter: 0.2}, Backoff{Min: 2 * time.Second, Max: 2 * time.Second, Factor: 1, Jitter: 0.2}},
+		{Backoff{Min: 2 * time.Minute, Factor: 2}, Backoff{Min: 2 * time.Minute, Max: 2 * time.Minute, Factor: 2}},
+		{Backoff{Min: time.Millisecond, Max: time.Second, Factor: 3}, Backoff{Min: time.Millisecond, Max: time.Second, Factor: 3}},
+	}
+	for _, tt := range tests {
+		h := &HTTPRedirector{}
+		HTTPBackoff(tt.backoff)(h)
+		if h.backoff != tt.want {
+			t.Fatalf("HTTPBackoff(%+v) = %+v, want %+v", tt.backoff, h.backoff, tt.want)
+		}
+		// 修正后等待时间为正数且不超过 Max, 不会忙等或无限增长
+		for attempt := 1; attempt <= 20; attempt++ {
+			if delay := h.backoff.Delay(attempt); delay <= 0 || delay > h.backoff.Max {
+				t.Fatalf("%+v: Delay(%d) = %v", h.backoff, attempt, delay)
+			}
+		}
+	}
+}
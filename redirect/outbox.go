@@ -0,0 +1,355 @@
+package redirect
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrOutboxFull = errors.New("待发送队列已满")
+
+type (
+	outboxEntry struct {
+		ID       uint64    `json:"id"`
+		Data     string    `json:"data"`
+		Created  time.Time `json:"created"`
+		Attempts int       `json:"attempts"`
+		// 已写入连接等待确认, 不持久化, 重启后重新发送
+		inflight  bool
+		requestID string // 带请求id的消息收到hub的响应后才移除
+	}
+
+	deadLetter struct {
+		outboxEntry
+		Reason string    `json:"reason"`
+		Failed time.Time `json:"failed"`
+	}
+
+	// Outbox 待发送消息队列, 断线重连期间保留未发送及未确认的消息, 按顺序重试
+	Outbox struct {
+		mu          sync.Mutex
+		entries     []*outboxEntry
+		nextID      uint64
+		changed     chan struct{}
+		capacity    int
+		maxAge      time.Duration
+		maxAttempts int
+		file        string
+		deadLetter  string
+	}
+
+	OutboxOption func(o *Outbox)
+)
+
+// OutboxCapacity 最多保留的待发送消息数
+func OutboxCapacity(capacity int) OutboxOption {
+	return func(o *Outbox) {
+		o.capacity = capacity
+	}
+}
+
+// OutboxMaxAge 消息超过该时间仍未发送则放弃, 0表示不限制
+func OutboxMaxAge(maxAge time.Duration) OutboxOption {
+	return func(o *Outbox) {
+		o.maxAge = maxAge
+	}
+}
+
+// OutboxMaxAttempts 单条消息最多发送次数, 0表示不限制
+func OutboxMaxAttempts(attempts int) OutboxOption {
+	return func(o *Outbox) {
+		o.maxAttempts = attempts
+	}
+}
+
+// OutboxFile 持久化待发送消息的文件, 进程重启后继续发送
+func OutboxFile(file string) OutboxOption {
+	return func(o *Outbox) {
+		o.file = file
+	}
+}
+
+// OutboxDeadLetter 记录最终发送失败消息的文件, 每行一条JSON
+func OutboxDeadLetter(file string) OutboxOption {
+	return func(o *Outbox) {
+		o.deadLetter = file
+	}
+}
+
+func NewOutbox(options ...OutboxOption) (*Outbox, error) {
+	o := &Outbox{
+		changed:     make(chan struct{}),
+		capacity:    1000,
+		maxAge:      5 * time.Minute,
+		maxAttempts: 5,
+	}
+	for _, option := range options {
+		option(o)
+	}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Outbox) load() error {
+	if o.file == "" {
+		return nil
+	}
+	bs, err := os.ReadFile(o.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bs, &o.entries); err != nil {
+		return fmt.Errorf("读取待发送消息失败: %w", err)
+	}
+	for _, entry := range o.entries {
+		o.nextID = max(o.nextID, entry.ID)
+	}
+	if len(o.entries) > 0 {
+		slog.Info("恢复待发送消息", "count", len(o.entries), "file", o.file)
+	}
+	return nil
+}
+
+// persist 将队列写入文件, 需持有锁
+func (o *Outbox) persist() {
+	if o.file == "" {
+		return
+	}
+	bs, err := json.Marshal(o.entries)
+	if err != nil {
+		slog.Error("待发送消息序列化失败", "err", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(o.file), os.ModePerm); err != nil {
+		slog.Error("创建待发送消息目录失败", "err", err)
+		return
+	}
+	tmp := o.file + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		slog.Error("保存待发送消息失败", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, o.file); err != nil {
+		slog.Error("保存待发送消息失败", "err", err)
+	}
+}
+
+// notify 通知队列变化, 需持有锁
+func (o *Outbox) notify() {
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+// Push 追加待发送消息
+func (o *Outbox) Push(data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.capacity > 0 && len(o.entries) >= o.capacity {
+		return ErrOutboxFull
+	}
+	o.nextID++
+	o.entries = append(o.entries, &outboxEntry{ID: o.nextID, Data: string(data), Created: time.Now()})
+	o.persist()
+	o.notify()
+	return nil
+}
+
+// Len 待发送消息数
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+// Flush 等待队列中的消息全部发送, 带请求id的消息需等到hub确认, 返回 ctx 结束时剩余的消息数,
+// 配置了持久化文件时剩余消息在重启后继续发送
+func (o *Outbox) Flush(ctx context.Context) int {
+	for {
+		o.mu.Lock()
+		remaining, changed := o.unsentLocked(), o.changed
+		o.mu.Unlock()
+		if remaining == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return remaining
+		case <-changed:
+		}
+	}
+}
+
+// unsentLocked 未发送及等待确认的消息数, 不带请求id的消息写入连接后即视为已发送, 需持有锁
+func (o *Outbox) unsentLocked() int {
+	count := 0
+	for _, entry := range o.entries {
+		if !entry.inflight || entry.requestID != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// next 等待并返回第一条未写入连接的消息, 已过期的消息直接放弃
+func (o *Outbox) next(ctx context.Context) (*outboxEntry, bool) {
+	for {
+		o.mu.Lock()
+		if entry := o.nextLocked(); entry != nil {
+			o.mu.Unlock()
+			return entry, true
+		}
+		changed := o.changed
+		o.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-changed:
+		}
+	}
+}
+
+func (o *Outbox) nextLocked() *outboxEntry {
+	for i := 0; i < len(o.entries); {
+		entry := o.entries[i]
+		if entry.inflight {
+			i++
+			continue
+		}
+		if o.maxAge <= 0 || time.Since(entry.Created) <= o.maxAge {
+			return entry
+		}
+		o.dropLocked(entry, fmt.Errorf("超过最长保留时间 %s", o.maxAge))
+	}
+	return nil
+}
+
+// track 记录消息的请求id, 需在写入连接之前调用, 以免响应先于 sent 到达
+func (o *Outbox) track(entry *outboxEntry, requestID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entry.requestID = requestID
+}
+
+// sent 消息已写入连接但未确认送达: 带请求id的消息收到响应(ack)后移除,
+// 其余消息无法确认, 保留最后写入的一条, 之后的消息写入成功时移除, 连接断开时重新发送(requeue)
+func (o *Outbox) sent(entry *outboxEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !slices.Contains(o.entries, entry) {
+		// 写入期间已收到响应
+		return
+	}
+	o.entries = slices.DeleteFunc(o.entries, func(e *outboxEntry) bool {
+		return e.inflight && e.requestID == ""
+	})
+	entry.inflight = true
+	o.persist()
+	o.notify()
+}
+
+// ack 收到hub对请求id的响应, 移除对应的消息, 返回是否为队列中的消息
+func (o *Outbox) ack(requestID string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, entry := range o.entries {
+		if entry.requestID == requestID {
+			o.removeLocked(entry)
+			o.persist()
+			o.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// requeue 连接断开, 已写入连接但未确认的消息按原顺序重新发送, 并计入发送次数
+func (o *Outbox) requeue(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var inflight []*outboxEntry
+	for _, entry := range o.entries {
+		if entry.inflight {
+			inflight = append(inflight, entry)
+		}
+	}
+	for _, entry := range inflight {
+		entry.inflight = false
+		slog.Warn("连接断开 重新发送未确认的消息", "id", entry.ID, "requestID", entry.requestID)
+		o.failLocked(entry, err)
+	}
+	if len(inflight) > 0 {
+		o.notify()
+	}
+}
+
+// done 消息发送成功
+func (o *Outbox) done(entry *outboxEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.removeLocked(entry)
+	o.persist()
+	o.notify()
+}
+
+// fail 记录一次发送失败, 超过最大次数时放弃该消息
+func (o *Outbox) fail(entry *outboxEntry, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failLocked(entry, err)
+}
+
+func (o *Outbox) failLocked(entry *outboxEntry, err error) {
+	entry.Attempts++
+	if o.maxAttempts > 0 && entry.Attempts >= o.maxAttempts {
+		o.dropLocked(entry, fmt.Errorf("发送%d次均失败: %w", entry.Attempts, err))
+		return
+	}
+	o.persist()
+}
+
+func (o *Outbox) removeLocked(entry *outboxEntry) {
+	for i, e := range o.entries {
+		if e == entry {
+			o.entries = append(o.entries[:i], o.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// dropLocked 放弃消息并写入死信, 需持有锁
+func (o *Outbox) dropLocked(entry *outboxEntry, reason error) {
+	o.removeLocked(entry)
+	o.persist()
+	o.notify()
+	slog.Error("消息发送失败 已放弃", "id", entry.ID, "attempts", entry.Attempts, "reason", reason, "data", entry.Data)
+	if o.deadLetter == "" {
+		return
+	}
+	bs, err := json.Marshal(deadLetter{outboxEntry: *entry, Reason: reason.Error(), Failed: time.Now()})
+	if err != nil {
+		slog.Error("死信序列化失败", "err", err)
+		return
+	}
+	f, err := os.OpenFile(o.deadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("打开死信文件失败", "err", err)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.Write(append(bs, '\n')); err != nil {
+		slog.Error("写入死信失败", "err", err)
+	}
+}
@@ -0,0 +1,174 @@
+package redirect
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustOutbox(t *testing.T, options ...OutboxOption) *Outbox {
+	t.Helper()
+	o, err := NewOutbox(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// mustNext 取出下一条待发送的消息, 没有时失败
+func mustNext(t *testing.T, o *Outbox) *outboxEntry {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	entry, ok := o.next(ctx)
+	if !ok {
+		t.Fatal("队列中没有待发送的消息")
+	}
+	return entry
+}
+
+// assertNoNext 队列中没有待写入连接的消息
+func assertNoNext(t *testing.T, o *Outbox) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if entry, ok := o.next(ctx); ok {
+		t.Fatalf("不应有待发送的消息: %s", entry.Data)
+	}
+}
+
+func TestOutboxRequeueUnconfirmedInOrder(t *testing.T) {
+	o := mustOutbox(t)
+	_ = o.Push([]byte("a"))
+	_ = o.Push([]byte("b"))
+	a := mustNext(t, o)
+	o.track(a, "r1")
+	o.sent(a)
+	b := mustNext(t, o)
+	o.sent(b)
+	assertNoNext(t, o)
+	if o.Len() != 2 {
+		t.Fatalf("未确认的消息应保留, len = %d", o.Len())
+	}
+	o.requeue(errors.New("断开"))
+	if entry := mustNext(t, o); entry.Data != "a" || entry.Attempts != 1 {
+		t.Fatalf("应先重新发送 a, got %s attempts=%d", entry.Data, entry.Attempts)
+	}
+	if !o.ack("r1") {
+		t.Fatal("ack r1 应移除 a")
+	}
+	if entry := mustNext(t, o); entry.Data != "b" {
+		t.Fatalf("应重新发送 b, got %s", entry.Data)
+	}
+}
+
+func TestOutboxSentReleasesPreviousUnconfirmed(t *testing.T) {
+	o := mustOutbox(t)
+	_ = o.Push([]byte("a"))
+	_ = o.Push([]byte("b"))
+	o.sent(mustNext(t, o))
+	if o.Len() != 2 {
+		t.Fatalf("最后写入的消息应保留到下一条写入成功, len = %d", o.Len())
+	}
+	o.sent(mustNext(t, o))
+	if o.Len() != 1 {
+		t.Fatalf("下一条写入成功后应移除上一条, len = %d", o.Len())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if remaining := o.Flush(ctx); remaining != 0 {
+		t.Fatalf("不带请求id的消息写入后不应阻塞 Flush, remaining = %d", remaining)
+	}
+}
+
+func TestOutboxFlushWaitsForAck(t *testing.T) {
+	o := mustOutbox(t)
+	_ = o.Push([]byte("a"))
+	a := mustNext(t, o)
+	o.track(a, "r1")
+	o.sent(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if remaining := o.Flush(ctx); remaining != 1 {
+		t.Fatalf("Flush 应等待确认, remaining = %d", remaining)
+	}
+	go o.ack("r1")
+	if remaining := o.Flush(context.Background()); remaining != 0 {
+		t.Fatalf("remaining = %d", remaining)
+	}
+}
+
+func TestOutboxAckBeforeSent(t *testing.T) {
+	o := mustOutbox(t)
+	_ = o.Push([]byte("a"))
+	a := mustNext(t, o)
+	o.track(a, "r1")
+	o.ack("r1")
+	o.sent(a)
+	if o.Len() != 0 {
+		t.Fatalf("先于 sent 到达的响应也应移除消息, len = %d", o.Len())
+	}
+	o.requeue(errors.New("断开"))
+	assertNoNext(t, o)
+}
+
+func TestOutboxDropsAfterMaxAttempts(t *testing.T) {
+	deadLetter := filepath.Join(t.TempDir(), "dead.jsonl")
+	o := mustOutbox(t, OutboxMaxAttempts(2), OutboxDeadLetter(deadLetter))
+	_ = o.Push([]byte("a"))
+	o.fail(mustNext(t, o), errors.New("失败1"))
+	o.sent(mustNext(t, o))
+	o.requeue(errors.New("断开"))
+	assertNoNext(t, o)
+	bs, err := os.ReadFile(deadLetter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(bs)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "断开") {
+		t.Fatalf("dead letter = %q", bs)
+	}
+}
+
+func TestOutboxDropsExpired(t *testing.T) {
+	o := mustOutbox(t, OutboxMaxAge(time.Millisecond))
+	_ = o.Push([]byte("a"))
+	time.Sleep(5 * time.Millisecond)
+	assertNoNext(t, o)
+	if o.Len() != 0 {
+		t.Fatalf("过期的消息应放弃, len = %d", o.Len())
+	}
+}
+
+func TestOutboxCapacity(t *testing.T) {
+	o := mustOutbox(t, OutboxCapacity(1))
+	if err := o.Push([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Push([]byte("b")); !errors.Is(err, ErrOutboxFull) {
+		t.Fatalf("err = %v, want ErrOutboxFull", err)
+	}
+}
+
+func TestOutboxPersistsUnconfirmed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "outbox.json")
+	o := mustOutbox(t, OutboxFile(file))
+	_ = o.Push([]byte("a"))
+	_ = o.Push([]byte("b"))
+	o.sent(mustNext(t, o))
+
+	restored := mustOutbox(t, OutboxFile(file))
+	if restored.Len() != 2 {
+		t.Fatalf("重启后应恢复未确认的消息, len = %d", restored.Len())
+	}
+	if entry := mustNext(t, restored); entry.Data != "a" {
+		t.Fatalf("重启后应重新发送未确认的 a, got %s", entry.Data)
+	}
+	_ = restored.Push([]byte("c"))
+	if entries := restored.entries; entries[len(entries)-1].ID != 3 {
+		t.Fatalf("恢复后的消息id应继续递增, got %d", entries[len(entries)-1].ID)
+	}
+}
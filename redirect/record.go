@@ -0,0 +1,266 @@
+package redirect
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// 录制记录的方向
+const (
+	RecordInbound  = "in"  // 收到的消息
+	RecordOutbound = "out" // 发送的命令
+)
+
+type (
+	// Record 录制文件中的一行
+	Record struct {
+		Time time.Time       `json:"time"`
+		Dir  string          `json:"dir"`
+		Data json.RawMessage `json:"data"`
+	}
+
+	// recordWriter 追加写入JSONL录制文件
+	recordWriter struct {
+		mu   sync.Mutex
+		file *os.File
+	}
+)
+
+func newRecordWriter(file string) (*recordWriter, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recordWriter{file: f}, nil
+}
+
+func (w *recordWriter) write(dir string, data []byte) {
+	raw := json.RawMessage(data)
+	if !json.Valid(data) {
+		raw, _ = json.Marshal(string(data))
+	}
+	bs, err := json.Marshal(Record{Time: time.Now(), Dir: dir, Data: raw})
+	if err != nil {
+		slog.Error("录制记录序列化失败", "err", err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.file.Write(append(bs, '\n')); err != nil {
+		slog.Error("写入录制文件失败", "err", err)
+	}
+}
+
+func (w *recordWriter) Close() error {
+	return w.file.Close()
+}
+
+// Recorder 录制经过的所有消息和命令, 其余行为与被包装的连接一致
+type Recorder struct {
+	Transport
+	writer *recordWriter
+}
+
+func NewRecorder(transport Transport, file string) (*Recorder, error) {
+	writer, err := newRecordWriter(file)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Transport: transport, writer: writer}, nil
+}
+
+func (r *Recorder) SendMessage(data []byte) error {
+	r.writer.write(RecordOutbound, data)
+	return r.Transport.SendMessage(data)
+}
+
+func (r *Recorder) OnMessage(fn OnMessage) {
+	r.Transport.OnMessage(func(data []byte) error {
+		r.writer.write(RecordInbound, data)
+		return fn(data)
+	})
+}
+
+// OnResponse 被包装的连接单独返回命令响应时同样录制
+func (r *Recorder) OnResponse(fn OnMessage) {
+	if receiver, ok := r.Transport.(ResponseReceiver); ok {
+		receiver.OnResponse(func(data []byte) error {
+			r.writer.write(RecordInbound, data)
+			return fn(data)
+		})
+	}
+}
+
+// State 被包装连接的状态, 无法获取时视为已连接
+func (r *Recorder) State() ConnState {
+	if s, ok := r.Transport.(interface{ State() ConnState }); ok {
+		return s.State()
+	}
+	return StateConnected
+}
+
+func (r *Recorder) Close() error {
+	return r.writer.Close()
+}
+
+type (
+	// Replayer 按录制时的间隔重放录制文件中收到的消息, 发送的命令写入捕获文件而不发出
+	Replayer struct {
+		file      string
+		speed     float64
+		capture   string
+		writer    *recordWriter
+		respond   func(data []byte) []byte
+		mu        sync.RWMutex
+		onMessage OnMessage
+		state     ConnState
+	}
+
+	ReplayOption func(r *Replayer)
+)
+
+// ReplaySpeed 重放速度倍数, 1为原速, 0表示不等待
+func ReplaySpeed(speed float64) ReplayOption {
+	return func(r *Replayer) {
+		r.speed = speed
+	}
+}
+
+// ReplayCapture 捕获发送命令的文件, 为空时只打印日志
+func ReplayCapture(file string) ReplayOption {
+	return func(r *Replayer) {
+		r.capture = file
+	}
+}
+
+// ReplayRespond 为发送的命令生成模拟的响应, 返回nil表示不响应
+func ReplayRespond(respond func(data []byte) []byte) ReplayOption {
+	return func(r *Replayer) {
+		r.respond = respond
+	}
+}
+
+func NewReplayer(file string, options ...ReplayOption) (*Replayer, error) {
+	r := &Replayer{file: file, speed: 1, state: StateConnecting}
+	for _, option := range options {
+		option(r)
+	}
+	if r.capture != "" {
+		writer, err := newRecordWriter(r.capture)
+		if err != nil {
+			return nil, err
+		}
+		r.writer = writer
+	}
+	return r, nil
+}
+
+// Replay 重放录制文件中收到的消息, 全部重放完成或 ctx 取消时返回
+func (r *Replayer) Replay(ctx context.Context) error {
+	f, err := os.Open(r.file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	r.setState(StateConnected)
+	defer r.setState(StateClosed)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024*10)
+	var last time.Time
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("录制文件第%d行解析失败: %w", line, err)
+		}
+		if record.Dir != RecordInbound {
+			continue
+		}
+		if !last.IsZero() && r.speed > 0 {
+			if wait := time.Duration(float64(record.Time.Sub(last)) / r.speed); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		last = record.Time
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r.receive(record.Data)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	slog.Info("重放完成", "file", r.file, "messages", count)
+	return nil
+}
+
+func (r *Replayer) receive(data []byte) {
+	r.mu.RLock()
+	onMessage := r.onMessage
+	r.mu.RUnlock()
+	if onMessage == nil {
+		return
+	}
+	if err := onMessage(data); err != nil {
+		slog.Error("重放消息处理失败", "err", err)
+	}
+}
+
+func (r *Replayer) setState(state ConnState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = state
+}
+
+func (r *Replayer) State() ConnState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.state
+}
+
+// SendMessage 捕获发送的命令
+func (r *Replayer) SendMessage(data []byte) error {
+	if r.writer != nil {
+		r.writer.write(RecordOutbound, data)
+	} else {
+		slog.Info("捕获命令", "data", string(data))
+	}
+	if r.respond != nil {
+		if resp := r.respond(data); resp != nil {
+			go r.receive(resp)
+		}
+	}
+	return nil
+}
+
+func (r *Replayer) OnMessage(fn OnMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onMessage = fn
+}
+
+func (r *Replayer) Close() error {
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer.Close()
+}
@@ -2,17 +2,90 @@ package redirect
 
 import (
 	"context"
+	"errors"
 	"github.com/gorilla/websocket"
 	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ConnState 连接状态
+type ConnState int32
+
+const (
+	StateConnecting   ConnState = iota // 连接中
+	StateConnected                     // 已连接
+	StateDisconnected                  // 已断开, 等待重连
+	StateClosed                        // 已关闭, 不再重连
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return "closed"
+	}
+}
+
+// Backoff 指数退避重连策略
+type Backoff struct {
+	Min    time.Duration // 首次重连等待时间
+	Max    time.Duration // 最大等待时间
+	Factor float64       // 每次失败后等待时间的倍数
+	Jitter float64       // 随机抖动比例, 0.2 表示在 ±20% 范围内随机
+}
+
+// Delay 第 attempt 次重连前的等待时间, attempt 从1开始, 加上抖动后不超过 Max
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Min) * math.Pow(b.Factor, float64(attempt-1))
+	if b.Jitter > 0 {
+		delay *= 1 - b.Jitter + rand.Float64()*2*b.Jitter
+	}
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	return time.Duration(delay)
+}
+
+// normalize 修正无效的配置: Min 默认1s, Max 默认1分钟且不小于 Min, Factor 不小于1
+func (b Backoff) normalize() Backoff {
+	if b.Min <= 0 {
+		b.Min = time.Second
+	}
+	if b.Max <= 0 {
+		b.Max = time.Minute
+	}
+	if b.Max < b.Min {
+		b.Max = b.Min
+	}
+	if b.Factor < 1 {
+		b.Factor = 1
+	}
+	return b
+}
+
 type WSClientRedirector struct {
-	serverUrl string
-	messages  chan []byte
-	heartbeat time.Duration
-	server    wsConnection
-	onMessage OnMessage
+	serverUrl      string
+	outbox         *Outbox
+	heartbeat      time.Duration
+	backoff        Backoff
+	server         wsConnection
+	serverChanged  chan struct{}
+	state          atomic.Int32
+	mu             sync.RWMutex
+	ack            ResponseMatcher
+	onMessage      OnMessage
+	onConnected    func()
+	onDisconnected func(err error)
+	onReconnecting func(attempt int, delay time.Duration)
 }
 
 type WSClientOption func(h *WSClientRedirector)
@@ -26,57 +99,246 @@ func WSClientHeartbeat(heartbeat time.Duration) WSClientOption {
 		h.heartbeat = heartbeat
 	}
 }
+
+// WSClientBackoff 重连退避策略
+func WSClientBackoff(backoff Backoff) WSClientOption {
+	return func(h *WSClientRedirector) {
+		h.backoff = backoff.normalize()
+	}
+}
+
+// WSClientOutbox 使用指定的待发送队列, 默认使用仅保存在内存中的队列
+func WSClientOutbox(outbox *Outbox) WSClientOption {
+	return func(h *WSClientRedirector) {
+		h.outbox = outbox
+	}
+}
+
+// WSClientAck hub对带请求id的命令回复响应时, 收到响应后才从待发送队列移除命令, 连接断开时重新发送未确认的命令.
+// match 同时用于取出发送的命令及收到的响应中的请求id, 未设置时写入连接的最后一条命令在重连后重新发送
+func WSClientAck(match ResponseMatcher) WSClientOption {
+	return func(h *WSClientRedirector) {
+		h.ack = match
+	}
+}
+
 func NewWebsocketClientMessageHandler(ctx context.Context, serverUrl string, options ...WSClientOption) *WSClientRedirector {
 	h := &WSClientRedirector{
-		serverUrl: serverUrl,
-		messages:  make(chan []byte, 10),
+		serverUrl:     serverUrl,
+		backoff:       Backoff{Min: time.Second, Max: time.Minute, Factor: 2, Jitter: 0.2},
+		serverChanged: make(chan struct{}),
 	}
 	for _, option := range options {
 		option(h)
 	}
+	if h.outbox == nil {
+		h.outbox, _ = NewOutbox()
+	}
 	go h.serve(ctx)
+	go h.sendMessage(ctx)
 	return h
 }
 
+// State 当前连接状态
+func (h *WSClientRedirector) State() ConnState {
+	return ConnState(h.state.Load())
+}
+
+func (h *WSClientRedirector) setState(state ConnState) {
+	h.state.Store(int32(state))
+}
+
 func (h *WSClientRedirector) serve(ctx context.Context) {
+	defer h.setState(StateClosed)
+	attempt := 0
 	for {
-		conn, _, err := websocket.DefaultDialer.Dial(h.serverUrl, nil)
+		h.setState(StateConnecting)
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, h.serverUrl, nil)
 		if err != nil {
-			slog.Error("websocket连接失败 等待重试", "server", h.serverUrl, "error", err)
-			time.Sleep(time.Second * 5)
+			if ctx.Err() != nil {
+				return
+			}
+			attempt++
+			slog.Error("websocket连接失败 等待重试", "server", h.serverUrl, "attempt", attempt, "error", err)
+			if !h.wait(ctx, attempt) {
+				return
+			}
 			continue
 		}
+		attempt = 0
 		slog.Info("websocket连接成功", "server", h.serverUrl)
 		// 创建client
 		c := newClient(conn, h.heartbeat, func(messageType int, message []byte) {
-			if h.onMessage != nil {
-				_ = h.onMessage(message)
+			if h.ack != nil {
+				if id, ok := h.ack(message); ok {
+					h.outbox.ack(id)
+				}
+			}
+			h.mu.RLock()
+			onMessage := h.onMessage
+			h.mu.RUnlock()
+			if onMessage != nil {
+				_ = onMessage(message)
 			}
 		})
-		h.server = c
-		go h.sendMessage()
-		if err := c.Serve(ctx); err == nil {
+		h.setServer(c)
+		h.setState(StateConnected)
+		h.mu.RLock()
+		onConnected := h.onConnected
+		h.mu.RUnlock()
+		if onConnected != nil {
+			onConnected()
+		}
+		err = c.Serve(ctx)
+		h.disconnect(err)
+		h.setState(StateDisconnected)
+		h.mu.RLock()
+		onDisconnected := h.onDisconnected
+		h.mu.RUnlock()
+		if onDisconnected != nil {
+			onDisconnected(err)
+		}
+		if err == nil {
 			return
 		}
+		attempt++
 		slog.Error("websocket连接断开 等待重连", "server", h.serverUrl, "error", err)
-		time.Sleep(time.Second * 5)
+		if !h.wait(ctx, attempt) {
+			return
+		}
+	}
+}
+
+// wait 按退避策略等待重连, ctx 取消时返回false
+func (h *WSClientRedirector) wait(ctx context.Context, attempt int) bool {
+	h.setState(StateDisconnected)
+	delay := h.backoff.Delay(attempt)
+	h.mu.RLock()
+	onReconnecting := h.onReconnecting
+	h.mu.RUnlock()
+	if onReconnecting != nil {
+		onReconnecting(attempt, delay)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (h *WSClientRedirector) setServer(server wsConnection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.server = server
+	close(h.serverChanged)
+	h.serverChanged = make(chan struct{})
+}
+
+// disconnect 移除断开的连接, 已写入该连接但未确认的消息重新发送
+func (h *WSClientRedirector) disconnect(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.server = nil
+	close(h.serverChanged)
+	h.serverChanged = make(chan struct{})
+	if err == nil {
+		err = errors.New("连接已关闭")
+	}
+	h.outbox.requeue(err)
+}
+
+// sent 消息写入连接后, 连接仍未断开时标记为等待确认, 返回false时连接已断开, 需重新发送
+func (h *WSClientRedirector) sent(server wsConnection, entry *outboxEntry) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.server != server {
+		return false
+	}
+	h.outbox.sent(entry)
+	return true
+}
+
+// waitServer 等待可用的连接, 跳过已发送失败的连接
+func (h *WSClientRedirector) waitServer(ctx context.Context, failed wsConnection) (wsConnection, bool) {
+	for {
+		h.mu.RLock()
+		server, changed := h.server, h.serverChanged
+		h.mu.RUnlock()
+		if server != nil && server != failed {
+			return server, true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-changed:
+		}
 	}
 }
 
-func (h *WSClientRedirector) sendMessage() {
-	for message := range h.messages {
-		if err := h.server.SendMessage(message); err != nil {
-			slog.Error("发送消息失败", "err", err)
+// sendMessage 按顺序发送待发送队列中的消息, 连接断开时等待重连后重试, 已写入但未确认的消息见 Outbox.sent
+func (h *WSClientRedirector) sendMessage(ctx context.Context) {
+	var failed wsConnection
+	for {
+		entry, ok := h.outbox.next(ctx)
+		if !ok {
 			return
 		}
+		server, ok := h.waitServer(ctx, failed)
+		if !ok {
+			return
+		}
+		if h.ack != nil {
+			if id, ok := h.ack([]byte(entry.Data)); ok {
+				h.outbox.track(entry, id)
+			}
+		}
+		if err := server.WriteMessage(ctx, []byte(entry.Data)); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("发送消息失败 等待重连后重试", "id", entry.ID, "err", err)
+			h.outbox.fail(entry, err)
+			failed = server
+			continue
+		}
+		if !h.sent(server, entry) {
+			h.outbox.fail(entry, errors.New("写入后连接已断开"))
+			failed = server
+		}
 	}
 }
 
+// SendMessage 消息放入待发送队列
 func (h *WSClientRedirector) SendMessage(bytes []byte) error {
-	h.messages <- bytes
-	return nil
+	return h.outbox.Push(bytes)
 }
 
 func (h *WSClientRedirector) OnMessage(fn OnMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	h.onMessage = fn
 }
+
+// OnConnected 连接成功时回调
+func (h *WSClientRedirector) OnConnected(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onConnected = fn
+}
+
+// OnDisconnected 连接断开时回调, 主动关闭时 err 为nil
+func (h *WSClientRedirector) OnDisconnected(fn func(err error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onDisconnected = fn
+}
+
+// OnReconnecting 等待重连前回调, attempt 为连续失败次数, delay 为本次等待时间
+func (h *WSClientRedirector) OnReconnecting(fn func(attempt int, delay time.Duration)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onReconnecting = fn
+}
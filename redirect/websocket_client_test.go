@@ -0,0 +1,177 @@
+package redirect_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+	"wechat-hub-plugin/redirect"
+)
+
+func TestBackoffDelayWithJitterNotExceedMax(t *testing.T) {
+	b := redirect.Backoff{Min: time.Second, Max: 4 * time.Second, Factor: 2, Jitter: 0.5}
+	for attempt := 1; attempt <= 10; attempt++ {
+		for i := 0; i < 100; i++ {
+			delay := b.Delay(attempt)
+			if delay > b.Max {
+				t.Fatalf("attempt %d: delay %s > max %s", attempt, delay, b.Max)
+			}
+			if delay < b.Min/2 {
+				t.Fatalf("attempt %d: delay %s < min-jitter", attempt, delay)
+			}
+		}
+	}
+	if delay := (redirect.Backoff{Min: time.Second, Max: time.Minute, Factor: 2}).Delay(3); delay != 4*time.Second {
+		t.Fatalf("delay without jitter = %s, want 4s", delay)
+	}
+}
+
+func TestWSClientConnectionCallbacks(t *testing.T) {
+	h := hubtest.NewHub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan bool, 10)
+	client := redirect.NewWebsocketClientMessageHandler(ctx, h.URL,
+		redirect.WSClientBackoff(redirect.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}),
+	)
+	client.OnConnected(func() { events <- true })
+	client.OnDisconnected(func(err error) { events <- false })
+	if err := h.WaitConnected(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	next := func() bool {
+		t.Helper()
+		select {
+		case connected := <-events:
+			return connected
+		case <-time.After(2 * time.Second):
+			t.Fatal("未收到连接状态回调")
+			return false
+		}
+	}
+	waitState(t, client, redirect.StateConnected)
+	h.Disconnect()
+	// 回调可能在首次连接成功之后才注册, 首次连接的回调可有可无
+	connected := next()
+	if connected {
+		connected = next()
+	}
+	if connected {
+		t.Fatal("断开连接后应先回调 OnDisconnected")
+	}
+	if !next() {
+		t.Fatal("重连后应回调 OnConnected")
+	}
+	if state := client.State(); state != redirect.StateConnected {
+		t.Fatalf("state = %s, want connected", state)
+	}
+	cancel()
+	if next() {
+		t.Fatal("关闭后应回调 OnDisconnected")
+	}
+	waitState(t, client, redirect.StateClosed)
+}
+
+// waitState 等待连接变为 state
+func waitState(t *testing.T, client *redirect.WSClientRedirector, state redirect.ConnState) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for client.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %s, want %s", client.State(), state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitCommand 等待hub收到 Param.Body 为 body 的命令
+func waitCommand(t *testing.T, h *hubtest.Hub, body string) {
+	t.Helper()
+	for count := 1; ; count++ {
+		commands, err := h.WaitCommands(count, 2*time.Second)
+		if err != nil {
+			t.Fatalf("hub未收到命令 %s, 已收到 %+v", body, commands)
+		}
+		if commands[count-1].Param.Body == body {
+			return
+		}
+	}
+}
+
+func command(id string, body string) []byte {
+	bs, _ := json.Marshal(hub.Command{ID: id, Command: "sendMessage", Param: hub.SendMsgCommand{Body: body}})
+	return bs
+}
+
+func TestWSClientResendsLastCommandAfterDisconnect(t *testing.T) {
+	h := hubtest.NewHub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := redirect.NewWebsocketClientMessageHandler(ctx, h.URL,
+		redirect.WSClientBackoff(redirect.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}),
+	)
+	waitState(t, client, redirect.StateConnected)
+	_ = client.SendMessage(command("", "a"))
+	waitCommand(t, h, "a")
+	h.Disconnect()
+	_ = client.SendMessage(command("", "b"))
+	waitCommand(t, h, "b")
+}
+
+func TestWSClientResendsUnackedCommandAfterReconnect(t *testing.T) {
+	h := hubtest.NewHub(t)
+	h.Respond = false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox, _ := redirect.NewOutbox()
+	client := redirect.NewWebsocketClientMessageHandler(ctx, h.URL,
+		redirect.WSClientOutbox(outbox),
+		redirect.WSClientAck(hub.ResponseID),
+		redirect.WSClientBackoff(redirect.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}),
+	)
+	waitState(t, client, redirect.StateConnected)
+	_ = client.SendMessage(command("r1", "a"))
+	_ = client.SendMessage(command("r2", "b"))
+	if _, err := h.WaitCommands(2, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.Len() != 2 {
+		t.Fatalf("未收到响应的命令应保留, len = %d", outbox.Len())
+	}
+	h.Disconnect()
+	commands, err := h.WaitCommands(4, 2*time.Second)
+	if err != nil {
+		t.Fatalf("重连后应重新发送未确认的命令, 已收到 %+v", commands)
+	}
+	if commands[2].ID != "r1" || commands[3].ID != "r2" {
+		t.Fatalf("应按顺序重新发送, got %s %s", commands[2].ID, commands[3].ID)
+	}
+}
+
+func TestWSClientRemovesAckedCommand(t *testing.T) {
+	h := hubtest.NewHub(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox, _ := redirect.NewOutbox()
+	client := redirect.NewWebsocketClientMessageHandler(ctx, h.URL,
+		redirect.WSClientOutbox(outbox),
+		redirect.WSClientAck(hub.ResponseID),
+		redirect.WSClientBackoff(redirect.Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}),
+	)
+	waitState(t, client, redirect.StateConnected)
+	_ = client.SendMessage(command("r1", "a"))
+	flushCtx, flushCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer flushCancel()
+	if remaining := outbox.Flush(flushCtx); remaining != 0 {
+		t.Fatalf("收到响应后应移除命令, remaining = %d", remaining)
+	}
+	h.Disconnect()
+	waitState(t, client, redirect.StateConnected)
+	_ = client.SendMessage(command("r2", "b"))
+	waitCommand(t, h, "b")
+	if commands := h.Commands(); len(commands) != 2 {
+		t.Fatalf("已确认的命令不应重新发送: %+v", commands)
+	}
+}
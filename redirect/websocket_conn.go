@@ -2,23 +2,33 @@ package redirect
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"github.com/gorilla/websocket"
 	"log/slog"
 	"time"
 )
 
+var ErrConnectionClosed = errors.New("连接已关闭")
+
 type wsConnection interface {
 	Serve(ctx context.Context) error
 	Close()
 	SendMessage(message []byte) error
+	// WriteMessage 发送消息并等待写入完成
+	WriteMessage(ctx context.Context, message []byte) error
+}
+
+type outgoing struct {
+	message []byte
+	result  chan error
 }
 
 type connection struct {
 	*websocket.Conn
 	heartbeat         time.Duration
-	messageBufferPool chan []byte
+	messageBufferPool chan outgoing
 	exit              chan error
+	closed            chan struct{}
 	cancelFn          context.CancelFunc
 	receiveMessage    func(messageType int, message []byte)
 }
@@ -28,8 +38,9 @@ func newClient(conn *websocket.Conn, heartbeat time.Duration, receiveMessage fun
 	return &connection{
 		Conn:              conn,
 		heartbeat:         heartbeat,
-		messageBufferPool: make(chan []byte, 5),
-		exit:              make(chan error),
+		messageBufferPool: make(chan outgoing, 5),
+		exit:              make(chan error, 2),
+		closed:            make(chan struct{}),
 		receiveMessage:    receiveMessage,
 	}
 }
@@ -37,16 +48,15 @@ func newClient(conn *websocket.Conn, heartbeat time.Duration, receiveMessage fun
 func (c *connection) Serve(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	c.cancelFn = cancel
-	var ticker *time.Ticker
+	var tick <-chan time.Time
 	if c.heartbeat > 0 {
-		ticker = time.NewTicker(c.heartbeat)
+		ticker := time.NewTicker(c.heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 	defer func() {
 		cancel()
-		if ticker != nil {
-			ticker.Stop()
-		}
-		close(c.messageBufferPool)
+		close(c.closed)
 		_ = c.Conn.Close()
 	}()
 	go c.readMessage()
@@ -55,7 +65,7 @@ func (c *connection) Serve(ctx context.Context) error {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-ticker.C:
+		case <-tick:
 			if err := c.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(2*time.Second)); err != nil {
 				slog.Error("心跳消息出错", "error", err)
 				return err
@@ -72,14 +82,39 @@ func (c *connection) Close() {
 		_ = c.Conn.Close()
 	}
 }
-func (c *connection) SendMessage(message []byte) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = fmt.Errorf("%v", r)
+
+func (c *connection) SendMessage(message []byte) error {
+	select {
+	case c.messageBufferPool <- outgoing{message: message}:
+		return nil
+	case <-c.closed:
+		return ErrConnectionClosed
+	}
+}
+
+func (c *connection) WriteMessage(ctx context.Context, message []byte) error {
+	result := make(chan error, 1)
+	select {
+	case c.messageBufferPool <- outgoing{message: message, result: result}:
+	case <-c.closed:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-c.closed:
+		// 连接关闭时写入协程可能已经退出
+		select {
+		case err := <-result:
+			return err
+		default:
+			return ErrConnectionClosed
 		}
-	}()
-	c.messageBufferPool <- message
-	return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *connection) readMessage() {
@@ -93,7 +128,7 @@ func (c *connection) readMessage() {
 		switch messageType {
 		case websocket.PingMessage:
 			// 当接收到 Ping 消息时，自动发送 Pong 消息
-			if err := c.WriteMessage(websocket.PongMessage, message); err != nil {
+			if err := c.WriteControl(websocket.PongMessage, message, time.Now().Add(2*time.Second)); err != nil {
 				slog.Error("pong消息出错", "error", err)
 				c.exit <- err
 				return
@@ -120,12 +155,19 @@ func (c *connection) onReceiveMessage(messageType int, message []byte) {
 // sendMessage 将缓冲队列中的信息转发到服务器
 func (c *connection) sendMessage() {
 	for {
-		message := <-c.messageBufferPool
-		err := c.WriteMessage(websocket.TextMessage, message)
-		if err != nil {
-			slog.Error("发送消息出错", "error", err)
-			c.exit <- err
+		select {
+		case <-c.closed:
 			return
+		case out := <-c.messageBufferPool:
+			err := c.Conn.WriteMessage(websocket.TextMessage, out.message)
+			if out.result != nil {
+				out.result <- err
+			}
+			if err != nil {
+				slog.Error("发送消息出错", "error", err)
+				c.exit <- err
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,240 @@
+package redirect
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type (
+	// WSServerRedirector 等待hub连接的websocket服务端, 允许多个hub同时连接
+	WSServerRedirector struct {
+		ctx          context.Context
+		upgrader     websocket.Upgrader
+		outbox       *Outbox
+		heartbeat    time.Duration
+		authenticate func(r *http.Request) bool
+		route        func(data []byte) string
+		mu           sync.RWMutex
+		conns        []wsConnection
+		routes       map[string]wsConnection
+		changed      chan struct{}
+		onMessage    OnMessage
+	}
+
+	WSServerOption func(h *WSServerRedirector)
+)
+
+func WSServerHeartbeat(heartbeat time.Duration) WSServerOption {
+	return func(h *WSServerRedirector) {
+		// 最低5s心跳
+		if heartbeat < time.Second*5 {
+			heartbeat = time.Second * 5
+		}
+		h.heartbeat = heartbeat
+	}
+}
+
+// WSServerBasicAuth 校验连接的用户名密码, 支持 query 参数 username/password 或 Basic 认证
+func WSServerBasicAuth(username, password string) WSServerOption {
+	return func(h *WSServerRedirector) {
+		h.authenticate = func(r *http.Request) bool {
+			u, p, ok := r.BasicAuth()
+			if !ok {
+				u, p = r.URL.Query().Get("username"), r.URL.Query().Get("password")
+			}
+			return subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		}
+	}
+}
+
+// WSServerRoute 取出消息所属的路由key, 消息从哪个连接收到, 同一个key的回复就发往哪个连接
+func WSServerRoute(route func(data []byte) string) WSServerOption {
+	return func(h *WSServerRedirector) {
+		h.route = route
+	}
+}
+
+// WSServerOutbox 使用指定的待发送队列, 默认使用仅保存在内存中的队列
+func WSServerOutbox(outbox *Outbox) WSServerOption {
+	return func(h *WSServerRedirector) {
+		h.outbox = outbox
+	}
+}
+
+func NewWebsocketServerMessageHandler(ctx context.Context, options ...WSServerOption) *WSServerRedirector {
+	h := &WSServerRedirector{
+		ctx: ctx,
+		upgrader: websocket.Upgrader{
+			// hub不是浏览器, 不校验来源
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		routes:  map[string]wsConnection{},
+		changed: make(chan struct{}),
+	}
+	for _, option := range options {
+		option(h)
+	}
+	if h.outbox == nil {
+		h.outbox, _ = NewOutbox()
+	}
+	go h.sendMessage(ctx)
+	return h
+}
+
+// ServeHTTP 接受hub的websocket连接, 连接断开前不返回
+func (h *WSServerRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.authenticate != nil && !h.authenticate(r) {
+		slog.Warn("websocket连接认证失败", "remote", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("websocket升级失败", "remote", r.RemoteAddr, "error", err)
+		return
+	}
+	var c wsConnection
+	c = newClient(conn, h.heartbeat, func(messageType int, message []byte) {
+		if h.route != nil {
+			if key := h.route(message); key != "" {
+				h.mu.Lock()
+				h.routes[key] = c
+				h.mu.Unlock()
+			}
+		}
+		h.mu.RLock()
+		onMessage := h.onMessage
+		h.mu.RUnlock()
+		if onMessage != nil {
+			_ = onMessage(message)
+		}
+	})
+	h.addConn(c)
+	slog.Info("hub已连接", "remote", r.RemoteAddr, "connections", h.Connections())
+	err = c.Serve(h.ctx)
+	h.removeConn(c)
+	slog.Info("hub已断开", "remote", r.RemoteAddr, "connections", h.Connections(), "error", err)
+}
+
+func (h *WSServerRedirector) addConn(c wsConnection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns = append(h.conns, c)
+	h.notifyLocked()
+}
+
+func (h *WSServerRedirector) removeConn(c wsConnection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, conn := range h.conns {
+		if conn == c {
+			h.conns = append(h.conns[:i], h.conns[i+1:]...)
+			break
+		}
+	}
+	for key, conn := range h.routes {
+		if conn == c {
+			delete(h.routes, key)
+		}
+	}
+	h.notifyLocked()
+}
+
+// notifyLocked 通知连接变化, 需持有锁
+func (h *WSServerRedirector) notifyLocked() {
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// Connections 当前连接数
+func (h *WSServerRedirector) Connections() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// State 有任意hub连接时为已连接
+func (h *WSServerRedirector) State() ConnState {
+	if h.ctx.Err() != nil {
+		return StateClosed
+	}
+	if h.Connections() > 0 {
+		return StateConnected
+	}
+	return StateDisconnected
+}
+
+// waitServer 等待可用的连接, 优先使用消息来源的连接, 跳过已发送失败的连接
+func (h *WSServerRedirector) waitServer(ctx context.Context, key string, failed wsConnection) (wsConnection, bool) {
+	for {
+		h.mu.RLock()
+		server, changed := h.routes[key], h.changed
+		if server == nil || server == failed {
+			server = nil
+			// 没有对应的连接时使用最新的连接
+			for i := len(h.conns) - 1; i >= 0; i-- {
+				if h.conns[i] != failed {
+					server = h.conns[i]
+					break
+				}
+			}
+		}
+		h.mu.RUnlock()
+		if server != nil {
+			return server, true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-changed:
+			failed = nil
+		}
+	}
+}
+
+// sendMessage 按顺序发送待发送队列中的消息, 没有连接时等待hub连接后重试
+func (h *WSServerRedirector) sendMessage(ctx context.Context) {
+	var failed wsConnection
+	for {
+		entry, ok := h.outbox.next(ctx)
+		if !ok {
+			return
+		}
+		key := ""
+		if h.route != nil {
+			key = h.route([]byte(entry.Data))
+		}
+		server, ok := h.waitServer(ctx, key, failed)
+		if !ok {
+			return
+		}
+		if err := server.WriteMessage(ctx, []byte(entry.Data)); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("发送消息失败 等待重试", "id", entry.ID, "err", err)
+			h.outbox.fail(entry, err)
+			failed = server
+			continue
+		}
+		failed = nil
+		h.outbox.done(entry)
+	}
+}
+
+// SendMessage 消息放入待发送队列
+func (h *WSServerRedirector) SendMessage(bytes []byte) error {
+	return h.outbox.Push(bytes)
+}
+
+func (h *WSServerRedirector) OnMessage(fn OnMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onMessage = fn
+}
@@ -0,0 +1,185 @@
+package redirect_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/redirect"
+)
+
+// newWSServer 启动需要认证的websocket服务端, 返回服务端及连接地址
+func newWSServer(t *testing.T, ctx context.Context) (*redirect.WSServerRedirector, string) {
+	t.Helper()
+	h := redirect.NewWebsocketServerMessageHandler(ctx,
+		redirect.WSServerBasicAuth("hub", "secret"),
+		redirect.WSServerRoute(hub.RouteGID),
+	)
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return h, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// dialWSServer 以hub的身份连接服务端, 连接在测试结束时关闭
+func dialWSServer(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?username=hub&password=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// readWS 读取一条消息, 超时时测试失败
+func readWS(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(message)
+}
+
+// waitConnections 等待服务端的连接数变为 n
+func waitConnections(t *testing.T, h *redirect.WSServerRedirector, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Connections() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("connections = %d, want %d", h.Connections(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWSServerRejectsUnauthorized(t *testing.T) {
+	h, url := newWSServer(t, context.Background())
+	for _, query := range []string{"", "?username=hub&password=wrong", "?username=other&password=secret"} {
+		_, resp, err := websocket.DefaultDialer.Dial(url+query, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("query %q: resp = %v, err = %v", query, resp, err)
+		}
+	}
+	header := http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("hub:secret"))}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Basic 认证应通过: %v", err)
+	}
+	defer conn.Close()
+	waitConnections(t, h, 1)
+}
+
+func TestWSServerRoutesRepliesToSourceConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, url := newWSServer(t, ctx)
+	var mu sync.Mutex
+	var received []string
+	h.OnMessage(func(message []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, string(message))
+		return nil
+	})
+	a := dialWSServer(t, url)
+	b := dialWSServer(t, url)
+	waitConnections(t, h, 2)
+	for conn, gid := range map[*websocket.Conn]string{a: "ga", b: "gb"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"gid":"`+gid+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received = %d", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// 回复发往收到该群消息的连接
+	for _, reply := range []struct {
+		conn *websocket.Conn
+		data string
+	}{
+		{a, `{"param":{"gid":"ga"},"n":1}`},
+		{b, `{"param":{"gid":"gb"},"n":2}`},
+		{a, `{"param":{"gid":"ga"},"n":3}`},
+	} {
+		if err := h.SendMessage([]byte(reply.data)); err != nil {
+			t.Fatal(err)
+		}
+		if message := readWS(t, reply.conn); message != reply.data {
+			t.Fatalf("message = %s, want %s", message, reply.data)
+		}
+	}
+	// 来源连接断开后发往其他连接
+	_ = a.Close()
+	waitConnections(t, h, 1)
+	reply := `{"param":{"gid":"ga"},"n":4}`
+	if err := h.SendMessage([]byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+	if message := readWS(t, b); message != reply {
+		t.Fatalf("message = %s, want %s", message, reply)
+	}
+}
+
+func TestWSServerQueuesUntilConnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, url := newWSServer(t, ctx)
+	if state := h.State(); state != redirect.StateDisconnected {
+		t.Fatalf("state = %s, want disconnected", state)
+	}
+	// 没有连接时保留在待发送队列, hub连接后按顺序发送
+	for _, data := range []string{`{"n":1}`, `{"n":2}`} {
+		if err := h.SendMessage([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := dialWSServer(t, url)
+	for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+		if message := readWS(t, conn); message != want {
+			t.Fatalf("message = %s, want %s", message, want)
+		}
+	}
+	if state := h.State(); state != redirect.StateConnected {
+		t.Fatalf("state = %s, want connected", state)
+	}
+}
+
+func TestWSServerShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h, url := newWSServer(t, ctx)
+	conn := dialWSServer(t, url)
+	waitConnections(t, h, 1)
+	cancel()
+	// ctx 取消后关闭所有连接
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, _, err := conn.ReadMessage(); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("连接应被关闭, err = %v", err)
+	}
+	waitConnections(t, h, 0)
+	if state := h.State(); state != redirect.StateClosed {
+		t.Fatalf("state = %s, want closed", state)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"wechat-hub-plugin/hub"
+)
+
+func TestReplaySenderDoesNotUpload(t *testing.T) {
+	var sent []hub.SendMsgCommand
+	// apiHost 无法连接, 上传时会失败
+	sender := NewSender("http://127.0.0.1:0", "", "", func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+		sent = append(sent, msg)
+		return &hub.SendResult{}, nil
+	}, SenderUpload(discardUpload))
+	if _, err := sender.SendImg(context.Background(), "gid", "a.png", bytes.NewReader([]byte("png"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || !strings.HasPrefix(sent[0].Body, "replay://") {
+		t.Fatalf("unexpected commands %+v", sent)
+	}
+}
+
+func TestMemoryPointRefundsOnce(t *testing.T) {
+	p := newMemoryPoint(100)
+	ctx := hub.WithDeductionKey(context.Background(), "m1:nga")
+	d, err := p.Pay(ctx, "gid", "uid", 10, "nga")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := p.Pay(ctx, "gid", "uid", 10, "nga"); again.ID != d.ID {
+		t.Fatalf("same key charged twice: %s %s", d.ID, again.ID)
+	}
+	if balance, _ := p.Refund(context.Background(), d, "test"); balance != 100 {
+		t.Fatalf("balance after refund = %d", balance)
+	}
+	if _, err := p.Refund(context.Background(), d, "test"); err == nil {
+		t.Fatal("refund twice")
+	}
+	if _, err := p.Pay(context.Background(), "gid", "uid", 1000, "nga"); err == nil {
+		t.Fatal("pay over balance")
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -9,58 +11,181 @@ import (
 	"log/slog"
 	"mime/multipart"
 	"net/http"
+	"time"
 	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/redirect"
 )
 
-type Sender struct {
-	apiHost  string
-	username string
-	password string
-	sendFn   func(msg hub.SendMsgCommand) error
-	client   *http.Client
+// newRequestID 生成命令的请求id
+func newRequestID() string {
+	bs := make([]byte, 8)
+	_, _ = rand.Read(bs)
+	return fmt.Sprintf("%x", bs)
 }
 
-func NewSender(apiHost string, username string, password string, sendFn func(msg hub.SendMsgCommand) error) hub.SenderInterface {
-	return &Sender{
+// replayResponse 重放时为等待响应的命令生成成功的响应
+func replayResponse(data []byte) []byte {
+	command := hub.Command{}
+	if err := json.Unmarshal(data, &command); err != nil || command.ID == "" {
+		return nil
+	}
+	bs, _ := json.Marshal(hub.CommandResponse{ID: command.ID, Data: hub.SendResult{MsgID: "replay-" + command.ID}})
+	return bs
+}
+
+// commandSender 将消息封装为发送命令, await 为true时等待hub的响应并返回消息id
+func commandSender(correlator *redirect.Correlator, await bool) func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+	return func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		command := hub.Command{
+			Command: "sendMessage",
+			Param:   msg,
+		}
+		if await {
+			command.ID = newRequestID()
+		}
+		data, err := json.Marshal(command)
+		if err != nil {
+			slog.Error("命令消息序列化失败", "err", err)
+			return nil, err
+		}
+		if !await {
+			return &hub.SendResult{}, correlator.SendMessage(data)
+		}
+		bs, err := correlator.Request(ctx, command.ID, data)
+		if err != nil {
+			slog.Error("等待命令响应失败", "id", command.ID, "gid", msg.Gid, "err", err)
+			return nil, err
+		}
+		resp := hub.CommandResponse{}
+		if err := json.Unmarshal(bs, &resp); err != nil {
+			slog.Error("命令响应反序列化失败", "id", command.ID, "err", err)
+			return nil, err
+		}
+		if resp.Code != 0 {
+			if resp.Data.Code == 0 {
+				resp.Data.Code = resp.Code
+			}
+			return &resp.Data, fmt.Errorf("发送消息失败: code=%d msg=%s", resp.Code, resp.Msg)
+		}
+		return &resp.Data, nil
+	}
+}
+
+type (
+	Sender struct {
+		apiHost  string
+		username string
+		password string
+		sendFn   func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error)
+		uploadFn func(ctx context.Context, filename string, file io.Reader) (string, error)
+		client   *http.Client
+	}
+
+	SenderOption func(s *Sender)
+)
+
+// SenderUpload 使用 fn 上传资源, 返回资源地址, 默认上传到 API_HOST
+func SenderUpload(fn func(ctx context.Context, filename string, file io.Reader) (string, error)) SenderOption {
+	return func(s *Sender) {
+		s.uploadFn = fn
+	}
+}
+
+func NewSender(apiHost string, username string, password string, sendFn func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error), options ...SenderOption) hub.SenderInterface {
+	s := &Sender{
 		apiHost:  apiHost,
 		username: username,
 		password: password,
 		sendFn:   sendFn,
-		client:   &http.Client{},
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}
+	s.uploadFn = s.upload
+	for _, option := range options {
+		option(s)
 	}
+	return s
 }
-func (s *Sender) SendText(gid string, content string) error {
-	return s.sendFn(hub.SendMsgCommand{
+
+// discardUpload 读取并丢弃资源, 返回以 replay:// 开头的地址, 用于重放时不上传
+func discardUpload(_ context.Context, filename string, file io.Reader) (string, error) {
+	if _, err := io.Copy(io.Discard, file); err != nil {
+		return "", err
+	}
+	return "replay://" + filename, nil
+}
+func (s *Sender) SendText(ctx context.Context, gid string, content string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.send(ctx, hub.SendMsgCommand{
 		Gid:  gid,
-		Type: 1,
+		Type: hub.SendTypeText,
 		Body: content,
-	})
+	}, opts...)
 }
 
-func (s *Sender) SendNetworkImg(gid string, src string) error {
-	return s.sendFn(hub.SendMsgCommand{
+func (s *Sender) SendNetworkImg(ctx context.Context, gid string, src string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.send(ctx, hub.SendMsgCommand{
 		Gid:  gid,
-		Type: 2,
+		Type: hub.SendTypeImage,
 		Body: src,
-	})
+	}, opts...)
+}
+
+func (s *Sender) SendImg(ctx context.Context, gid string, filename string, file io.Reader, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.sendUpload(ctx, gid, hub.SendTypeImage, filename, file, opts)
+}
+
+func (s *Sender) SendNetworkVideo(ctx context.Context, gid string, src string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.send(ctx, hub.SendMsgCommand{
+		Gid:  gid,
+		Type: hub.SendTypeVideo,
+		Body: src,
+	}, opts...)
+}
+
+func (s *Sender) SendVideo(ctx context.Context, gid string, filename string, file io.Reader, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.sendUpload(ctx, gid, hub.SendTypeVideo, filename, file, opts)
+}
+
+func (s *Sender) SendNetworkFile(ctx context.Context, gid string, src string, filename string, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.send(ctx, hub.SendMsgCommand{
+		Gid:      gid,
+		Type:     hub.SendTypeFile,
+		Body:     src,
+		Filename: filename,
+	}, opts...)
+}
+
+func (s *Sender) SendFile(ctx context.Context, gid string, filename string, file io.Reader, opts ...hub.SendOption) (*hub.SendResult, error) {
+	return s.sendUpload(ctx, gid, hub.SendTypeFile, filename, file, opts)
+}
+
+// send 应用发送选项后发送
+func (s *Sender) send(ctx context.Context, cmd hub.SendMsgCommand, opts ...hub.SendOption) (*hub.SendResult, error) {
+	for _, opt := range opts {
+		opt(&cmd)
+	}
+	return s.sendFn(ctx, cmd)
 }
 
-func (s *Sender) SendImg(gid string, filename string, file io.Reader) error {
-	src, err := s.upload(filename, file)
+// sendUpload 上传资源后发送
+func (s *Sender) sendUpload(ctx context.Context, gid string, msgType int, filename string, file io.Reader, opts []hub.SendOption) (*hub.SendResult, error) {
+	src, err := s.uploadFn(ctx, filename, file)
 	if err != nil {
-		slog.Error("Failed to upload image", "error", err)
-		return err
+		slog.Error("Failed to upload file", "type", msgType, "error", err)
+		return nil, err
 	}
-	return s.sendFn(hub.SendMsgCommand{
+	return s.send(ctx, hub.SendMsgCommand{
 		Gid:      gid,
-		Type:     2,
+		Type:     msgType,
 		Body:     src,
 		Filename: filename,
-	})
+	}, opts...)
 }
 
-func (s *Sender) upload(filename string, file io.Reader) (string, error) {
-	slog.Info("Uploading image", "filename", filename)
+func (s *Sender) upload(ctx context.Context, filename string, file io.Reader) (string, error) {
+	slog.Info("Uploading file", "filename", filename)
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 	if part, err := writer.CreateFormFile("file", filename); err != nil {
@@ -82,13 +207,13 @@ func (s *Sender) upload(filename string, file io.Reader) (string, error) {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", s.apiHost+"/upload", body)
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiHost+"/upload", body)
 	if err != nil {
 		slog.Error("Failed to create request", "error", err)
 		return "", err
 	}
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(s.username+":"+s.password)))
 
 	resp, err := s.client.Do(req)
 	if err != nil {
@@ -100,7 +225,7 @@ func (s *Sender) upload(filename string, file io.Reader) (string, error) {
 	}()
 
 	if resp.StatusCode != http.StatusOK {
-		slog.Error("Failed to upload image", "status", resp.Status)
+		slog.Error("Failed to upload file", "status", resp.Status)
 		return "", fmt.Errorf(resp.Status)
 	}
 	result := httpResult[string]{}
@@ -109,7 +234,7 @@ func (s *Sender) upload(filename string, file io.Reader) (string, error) {
 		return "", err
 	}
 	if result.Code != 0 {
-		slog.Error("Failed to upload image", "msg", result.Msg)
+		slog.Error("Failed to upload file", "msg", result.Msg)
 		return "", fmt.Errorf(result.Msg)
 	}
 	return result.Data, nil
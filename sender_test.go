@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"wechat-hub-plugin/hub"
+)
+
+// newUploadServer 模拟上传接口, 返回以文件名结尾的资源地址, 文件名为 fail 时上传失败
+func newUploadServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil || r.URL.Path != "/upload" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		if header.Filename == "fail" {
+			_, _ = fmt.Fprint(w, `{"code":1,"msg":"上传失败"}`)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"code":0,"data":"http://cdn/%s?size=%d"}`, r.FormValue("filename"), len(data))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// recordSend 记录发送的消息
+func recordSend(sent *[]hub.SendMsgCommand) func(ctx context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+	return func(_ context.Context, msg hub.SendMsgCommand) (*hub.SendResult, error) {
+		*sent = append(*sent, msg)
+		return &hub.SendResult{MsgID: "msg-" + msg.Body}, nil
+	}
+}
+
+func TestSenderUploadsVideoAndFile(t *testing.T) {
+	var sent []hub.SendMsgCommand
+	s := NewSender(newUploadServer(t).URL, "", "", recordSend(&sent))
+	if result, err := s.SendVideo(context.Background(), "gid", "a.mp4", strings.NewReader("mp4")); err != nil || result.MsgID != "msg-http://cdn/a.mp4?size=3" {
+		t.Fatalf("result = %+v, err = %v", result, err)
+	}
+	if _, err := s.SendFile(context.Background(), "gid", "a.pdf", strings.NewReader("pdf")); err != nil {
+		t.Fatal(err)
+	}
+	want := []hub.SendMsgCommand{
+		{Gid: "gid", Type: hub.SendTypeVideo, Body: "http://cdn/a.mp4?size=3", Filename: "a.mp4"},
+		{Gid: "gid", Type: hub.SendTypeFile, Body: "http://cdn/a.pdf?size=3", Filename: "a.pdf"},
+	}
+	if len(sent) != len(want) || sent[0] != want[0] || sent[1] != want[1] {
+		t.Fatalf("sent = %+v, want %+v", sent, want)
+	}
+}
+
+func TestSenderNetworkVideoAndFile(t *testing.T) {
+	var sent []hub.SendMsgCommand
+	s := NewSender("http://unused", "", "", recordSend(&sent))
+	if _, err := s.SendNetworkVideo(context.Background(), "gid", "http://example.com/a.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SendNetworkFile(context.Background(), "gid", "http://example.com/a.pdf", "报告.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	want := []hub.SendMsgCommand{
+		{Gid: "gid", Type: hub.SendTypeVideo, Body: "http://example.com/a.mp4"},
+		{Gid: "gid", Type: hub.SendTypeFile, Body: "http://example.com/a.pdf", Filename: "报告.pdf"},
+	}
+	if len(sent) != len(want) || sent[0] != want[0] || sent[1] != want[1] {
+		t.Fatalf("sent = %+v, want %+v", sent, want)
+	}
+}
+
+func TestSenderUploadFailure(t *testing.T) {
+	var sent []hub.SendMsgCommand
+	s := NewSender(newUploadServer(t).URL, "", "", recordSend(&sent))
+	if _, err := s.SendFile(context.Background(), "gid", "fail", strings.NewReader("pdf")); err == nil || err.Error() != "上传失败" {
+		t.Fatalf("err = %v", err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("上传失败时不应发送消息: %+v", sent)
+	}
+}
+
+func TestSenderAppliesOptions(t *testing.T) {
+	var sent []hub.SendMsgCommand
+	s := NewSender(newUploadServer(t).URL, "", "", recordSend(&sent))
+	if _, err := s.SendText(context.Background(), "gid", "hello", hub.WithPrompt("@user")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SendVideo(context.Background(), "gid", "a.mp4", strings.NewReader("mp4"), hub.WithPrompt("@user")); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range sent {
+		if msg.Prompt != "@user" {
+			t.Fatalf("sent = %+v", sent)
+		}
+	}
+}
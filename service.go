@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"sync"
+	"time"
 	"wechat-hub-plugin/hub"
 )
 
@@ -11,38 +16,365 @@ type httpResult[T any] struct {
 	Data T      `json:"data"`
 }
 
+type pluginEntry struct {
+	name         string
+	plugin       hub.Plugin
+	commands     []*hub.CommandSpec
+	middlewares  []hub.Middleware
+	subscription hub.Subscription
+	started      bool
+}
+
+// Account 机器人账号, 每个账号使用独立的发送者和积分服务, 共享同一组插件
+type Account struct {
+	Name    string
+	Sender  hub.SenderInterface
+	Point   hub.PointInterface
+	Plugins []string // 启用的插件名称, 为空时启用全部插件
+}
+
+type accountEntry struct {
+	Account
+	enabled map[string]bool
+}
+
+// Service 管理账号与插件, 将收到的消息分发给插件处理.
+// 消息匹配到命令时只执行该命令, 不再交给任何 hub.Handler 插件处理; 未匹配命令时按注册顺序交给订阅该消息的 hub.Handler 插件
 type Service struct {
 	db          hub.DBInterface
-	sender      hub.SenderInterface
-	pointManage hub.PointInterface
-	plugins     []hub.Plugin
+	accounts    map[string]*accountEntry
+	plugins     []*pluginEntry
+	router      *hub.Router
+	owners      map[*hub.CommandSpec]*pluginEntry
+	middlewares []hub.Middleware
+	commandMws  []hub.Middleware
+	skipFailed  bool
+	ctx         context.Context
+	timeout     time.Duration
+	connMu      sync.Mutex
+	connected   map[string]bool // 账号与hub的连接状态
+	running     bool            // 插件已启动, 连接状态变化时通知插件
+}
+
+func NewService() *Service {
+	s := &Service{
+		accounts:  map[string]*accountEntry{},
+		plugins:   []*pluginEntry{},
+		router:    hub.NewRouter(),
+		owners:    map[*hub.CommandSpec]*pluginEntry{},
+		connected: map[string]bool{},
+	}
+	s.router.SetFilter(s.routeCommand)
+	return s
+}
+
+// AddAccount 添加账号, 收到的消息按 Message.Account 使用对应账号回复
+func (s *Service) AddAccount(account Account) {
+	entry := &accountEntry{Account: account}
+	if len(account.Plugins) > 0 {
+		entry.enabled = make(map[string]bool, len(account.Plugins))
+		for _, name := range account.Plugins {
+			entry.enabled[name] = true
+		}
+	}
+	s.accounts[account.Name] = entry
+}
+
+// enabledPlugin 插件是否在账号中启用
+func (a *accountEntry) enabledPlugin(entry *pluginEntry) bool {
+	return a.enabled == nil || a.enabled[entry.name]
+}
+
+// Use 添加全局中间件, 作用于每条消息的整个处理过程
+func (s *Service) Use(middlewares ...hub.Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// UseCommand 添加命令中间件, 位于插件中间件之内, 直接包裹命令处理函数,
+// 插件中间件拦截的命令不会执行, 用于需要确认命令实际执行结果的处理, 如扣除积分
+func (s *Service) UseCommand(middlewares ...hub.Middleware) {
+	s.commandMws = append(s.commandMws, middlewares...)
+}
+
+// AddPlugin 添加插件, middlewares 仅作用于该插件
+func (s *Service) AddPlugin(plugin hub.Plugin, middlewares ...hub.Middleware) {
+	entry := &pluginEntry{name: fmt.Sprintf("%T", plugin), plugin: plugin, middlewares: middlewares}
+	if namer, ok := plugin.(hub.Namer); ok {
+		entry.name = namer.Name()
+	}
+	_, isHandler := plugin.(hub.Handler)
+	commander, isCommander := plugin.(hub.Commander)
+	if !isHandler && !isCommander {
+		panic(fmt.Sprintf("插件 %s 未实现 Handler 或 Commander", entry.name))
+	}
+	if subscriber, ok := plugin.(hub.Subscriber); ok {
+		entry.subscription = subscriber.Subscription()
+	}
+	if isCommander {
+		for _, spec := range commander.Commands() {
+			if wrapped := entry.wrapCommand(spec, s); wrapped != nil {
+				entry.commands = append(entry.commands, wrapped)
+			}
+		}
+		if err := s.router.Register(entry.commands...); err != nil {
+			panic(fmt.Sprintf("插件 %s 注册命令失败: %v", entry.name, err))
+		}
+		for _, spec := range entry.commands {
+			s.owners[spec] = entry
+		}
+	}
+	s.plugins = append(s.plugins, entry)
 }
 
-func NewService(sender hub.SenderInterface, pointManage hub.PointInterface) *Service {
-	return &Service{
-		sender:      sender,
-		pointManage: pointManage,
-		plugins:     []hub.Plugin{},
+// routeCommand 命令仅在所属插件订阅的消息及启用该插件的账号中生效
+func (s *Service) routeCommand(ctx *hub.Context, spec *hub.CommandSpec) bool {
+	entry, ok := s.owners[spec]
+	if !ok {
+		return true
 	}
+	account, ok := s.accounts[ctx.Account]
+	return ok && account.enabledPlugin(entry) && entry.subscription.Match(ctx.Message)
 }
 
-func (s *Service) AddPlugin(plugin hub.Plugin) {
-	s.plugins = append(s.plugins, plugin)
+// Routes 插件的订阅与命令
+func (s *Service) Routes() []string {
+	routes := make([]string, 0, len(s.plugins))
+	for _, entry := range s.plugins {
+		route := entry.name + " <- " + entry.subscription.String()
+		for _, spec := range entry.commands {
+			route += " " + hub.CommandPrefix + spec.Name
+		}
+		routes = append(routes, route)
+	}
+	return routes
 }
 func (s *Service) SetDB(db hub.DBInterface) {
 	s.db = db
 }
 
+// SetSkipFailedPlugins 插件启动失败时是否跳过该插件继续运行, 默认启动失败时Start返回错误
+func (s *Service) SetSkipFailedPlugins(skip bool) {
+	s.skipFailed = skip
+}
+
+// SetHandleTimeout 单条消息的处理时限, 0表示不限制
+func (s *Service) SetHandleTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// Start 按注册顺序初始化并启动插件, ctx 取消时正在处理的消息随之取消
+func (s *Service) Start(ctx context.Context) error {
+	s.ctx = ctx
+	var errs []error
+	plugins := make([]*pluginEntry, 0, len(s.plugins))
+	for _, entry := range s.plugins {
+		if err := entry.start(ctx); err != nil {
+			slog.Error("插件启动失败", "plugin", entry.name, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", entry.name, err))
+			if s.skipFailed {
+				s.router.Unregister(entry.commands...)
+				continue
+			}
+		}
+		plugins = append(plugins, entry)
+	}
+	if len(errs) > 0 && !s.skipFailed {
+		_ = s.Stop(ctx)
+		return errors.Join(errs...)
+	}
+	s.plugins = plugins
+	slog.Info("插件启动完成", "total", len(s.plugins), "failed", len(errs))
+	for _, account := range s.accounts {
+		for _, name := range account.Plugins {
+			if !s.hasPlugin(name) {
+				slog.Warn("账号启用的插件不存在", "account", account.Name, "plugin", name)
+			}
+		}
+	}
+	for _, route := range s.Routes() {
+		slog.Info("插件路由", "route", route)
+	}
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.running = true
+	for account, connected := range s.connected {
+		s.notifyConnection(account, connected)
+	}
+	return nil
+}
+
+// SetConnected 更新账号与hub的连接状态, 状态变化时通知账号启用的 hub.ConnectionWatcher 插件,
+// 插件启动前的状态在启动后通知
+func (s *Service) SetConnected(account string, connected bool) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if previous, ok := s.connected[account]; ok && previous == connected {
+		return
+	}
+	s.connected[account] = connected
+	if s.running {
+		s.notifyConnection(account, connected)
+	}
+}
+
+// Connected 账号是否已连接hub
+func (s *Service) Connected(account string) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.connected[account]
+}
+
+// notifyConnection 通知插件账号的连接状态, 调用时需持有 connMu, 保证通知的顺序与状态变化一致
+func (s *Service) notifyConnection(account string, connected bool) {
+	entry, ok := s.accounts[account]
+	if !ok {
+		return
+	}
+	for _, plugin := range s.plugins {
+		watcher, ok := plugin.plugin.(hub.ConnectionWatcher)
+		if !ok || !plugin.started || !entry.enabledPlugin(plugin) {
+			continue
+		}
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					slog.Error("插件处理连接状态panic", "plugin", plugin.name, "account", account, "err", err)
+				}
+			}()
+			watcher.ConnectionChanged(account, connected)
+		}()
+	}
+}
+
+func (s *Service) hasPlugin(name string) bool {
+	for _, entry := range s.plugins {
+		if entry.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop 按注册的逆序停止已启动的插件
+func (s *Service) Stop(ctx context.Context) error {
+	s.connMu.Lock()
+	s.running = false
+	s.connMu.Unlock()
+	var errs []error
+	for i := len(s.plugins) - 1; i >= 0; i-- {
+		entry := s.plugins[i]
+		if !entry.started {
+			continue
+		}
+		entry.started = false
+		if stopper, ok := entry.plugin.(hub.Stopper); ok {
+			if err := stopper.Stop(ctx); err != nil {
+				slog.Error("插件停止失败", "plugin", entry.name, "err", err)
+				errs = append(errs, fmt.Errorf("%s: %w", entry.name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *pluginEntry) start(ctx context.Context) error {
+	if initializer, ok := e.plugin.(hub.Initializer); ok {
+		if err := initializer.Init(ctx); err != nil {
+			return fmt.Errorf("初始化失败: %w", err)
+		}
+	}
+	if starter, ok := e.plugin.(hub.Starter); ok {
+		if err := starter.Start(ctx); err != nil {
+			return fmt.Errorf("启动失败: %w", err)
+		}
+	}
+	e.started = true
+	return nil
+}
+
+// wrapCommand 复制命令声明, 处理函数外层依次包裹插件中间件及 s 的命令中间件, 启用的群受插件订阅的群白名单限制
+func (e *pluginEntry) wrapCommand(spec *hub.CommandSpec, s *Service) *hub.CommandSpec {
+	wrapped := *spec
+	if len(e.subscription.Groups) > 0 {
+		groups := make([]string, 0, len(e.subscription.Groups))
+		for _, gid := range e.subscription.Groups {
+			if spec.EnabledIn(gid) {
+				groups = append(groups, gid)
+			}
+		}
+		if len(groups) == 0 {
+			slog.Warn("命令启用的群与插件订阅的群无交集, 忽略该命令", "plugin", e.name, "command", spec.Name)
+			return nil
+		}
+		wrapped.Groups = groups
+	}
+	wrapped.Handler = func(ctx *hub.Context, args *hub.Args) error {
+		return hub.Chain(ctx, e.middlewares, func() error {
+			return hub.Chain(ctx, s.commandMws, func() error {
+				return spec.Handler(ctx, args)
+			})
+		})
+	}
+	return &wrapped
+}
+
 func (s *Service) Handle(message *hub.Message) error {
-	slog.Info("receive message", "type", message.MsgType, "content", message.Content)
+	slog.Info("receive message", "account", message.Account, "type", message.MsgType, "content", message.Content)
+	account, ok := s.accounts[message.Account]
+	if !ok {
+		slog.Error("消息所属账号不存在", "account", message.Account, "msgID", message.MsgID)
+		return fmt.Errorf("账号 %s 不存在", message.Account)
+	}
 	ctx := &hub.Context{
 		Message: message,
-		Sender:  s.sender,
+		Sender:  account.Sender,
 		DB:      s.db,
-		Point:   s.pointManage,
+		Point:   account.Point,
 	}
-	for _, plugin := range s.plugins {
-		if err := (plugin).Handle(ctx); err != nil {
+	base := s.ctx
+	if base == nil {
+		base = context.Background()
+	}
+	// 处理结束或panic时退还未确认的积分预留
+	defer ctx.CancelReservations("处理未完成")
+	if s.timeout > 0 {
+		c, cancel := context.WithTimeout(base, s.timeout)
+		defer cancel()
+		base = c
+	}
+	ctx.SetContext(base)
+	matched, usageErr := s.router.Resolve(ctx)
+	return hub.Chain(ctx, s.middlewares, func() error {
+		if matched && usageErr != nil {
+			return s.replyUsage(ctx, usageErr)
+		}
+		return s.dispatch(ctx, account)
+	})
+}
+
+// replyUsage 命令参数错误时回复用法, 与执行命令一样经过命令所属插件的中间件, 未通过鉴权的用户不会收到回复
+func (s *Service) replyUsage(ctx *hub.Context, usageErr error) error {
+	reply := func() error {
+		return ctx.ReplayText(usageErr.Error())
+	}
+	if entry, ok := s.owners[ctx.MatchedCommand()]; ok {
+		return hub.Chain(ctx, entry.middlewares, reply)
+	}
+	return reply()
+}
+
+func (s *Service) dispatch(ctx *hub.Context, account *accountEntry) error {
+	if cmd := ctx.MatchedCommand(); cmd != nil {
+		return cmd.Handler(ctx, ctx.Args())
+	}
+	for _, entry := range s.plugins {
+		handler, ok := entry.plugin.(hub.Handler)
+		if !ok || !account.enabledPlugin(entry) || !entry.subscription.Match(ctx.Message) {
+			continue
+		}
+		if err := hub.Chain(ctx, entry.middlewares, func() error {
+			return handler.Handle(ctx)
+		}); err != nil {
 			return err
 		}
 		if ctx.IsAbort() {
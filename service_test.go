@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"wechat-hub-plugin/hub"
+	"wechat-hub-plugin/hubtest"
+	"wechat-hub-plugin/middleware"
+)
+
+// lifecyclePlugin 按调用顺序记录生命周期事件, initErr 不为nil时初始化失败
+type lifecyclePlugin struct {
+	name    string
+	events  *[]string
+	initErr error
+}
+
+func (p *lifecyclePlugin) Init(context.Context) error {
+	*p.events = append(*p.events, p.name+".init")
+	return p.initErr
+}
+
+func (p *lifecyclePlugin) Start(context.Context) error {
+	*p.events = append(*p.events, p.name+".start")
+	return nil
+}
+
+func (p *lifecyclePlugin) Stop(context.Context) error {
+	*p.events = append(*p.events, p.name+".stop")
+	return nil
+}
+
+func (p *lifecyclePlugin) Handle(*hub.Context) error {
+	return nil
+}
+
+func TestServiceLifecycleOrder(t *testing.T) {
+	var events []string
+	s := NewService()
+	s.AddPlugin(&lifecyclePlugin{name: "a", events: &events})
+	s.AddPlugin(&lifecyclePlugin{name: "b", events: &events})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 按注册顺序启动, 按逆序停止
+	if want := []string{"a.init", "a.start", "b.init", "b.start", "b.stop", "a.stop"}; !slices.Equal(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	events = nil
+	if err := s.Stop(context.Background()); err != nil || len(events) != 0 {
+		t.Fatalf("已停止的插件不应再次停止: %v, err = %v", events, err)
+	}
+}
+
+func TestServiceStopAfterFailedInit(t *testing.T) {
+	var events []string
+	initErr := errors.New("初始化出错")
+	s := NewService()
+	s.AddPlugin(&lifecyclePlugin{name: "a", events: &events})
+	s.AddPlugin(&lifecyclePlugin{name: "b", events: &events, initErr: initErr})
+	if err := s.Start(context.Background()); !errors.Is(err, initErr) {
+		t.Fatalf("err = %v, want %v", err, initErr)
+	}
+	// 启动失败时停止已启动的插件, 初始化失败的插件不调用 Start 及 Stop
+	if want := []string{"a.init", "a.start", "b.init", "a.stop"}; !slices.Equal(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	events = nil
+	if err := s.Stop(context.Background()); err != nil || len(events) != 0 {
+		t.Fatalf("启动失败后 Stop 不应再次停止插件: %v, err = %v", events, err)
+	}
+}
+
+func TestServiceSkipsFailedPlugin(t *testing.T) {
+	var events []string
+	s := NewService()
+	s.SetSkipFailedPlugins(true)
+	s.AddPlugin(&lifecyclePlugin{name: "a", events: &events, initErr: errors.New("初始化出错")})
+	s.AddPlugin(&lifecyclePlugin{name: "b", events: &events})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.init", "b.init", "b.start", "b.stop"}; !slices.Equal(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+}
+
+// paidPlugin 收费命令, #paid 成功回复, #broken 返回错误, #abort 回复后调用 Abort
+type paidPlugin struct{}
+
+func (paidPlugin) Name() string {
+	return "paid"
+}
+
+func (paidPlugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{Name: "paid", Price: 10, Handler: func(ctx *hub.Context, _ *hub.Args) error {
+			return ctx.ReplayText("done")
+		}},
+		{Name: "broken", Price: 10, Handler: func(ctx *hub.Context, _ *hub.Args) error {
+			return errors.New("出错了")
+		}},
+		{Name: "abort", Price: 10, Handler: func(ctx *hub.Context, _ *hub.Args) error {
+			ctx.Abort()
+			return ctx.ReplayText("done")
+		}},
+		{Name: "echo", Price: 10, Args: []hub.ArgSpec{{Name: "text", Type: hub.ArgText, Required: true}}, Handler: func(ctx *hub.Context, args *hub.Args) error {
+			return ctx.ReplayText(args.String("text"))
+		}},
+	}
+}
+
+// newTestService 使用 env 的替身创建只有默认账号的服务
+func newTestService(t *testing.T, env *hubtest.Env, setup func(s *Service)) *Service {
+	t.Helper()
+	s := NewService()
+	s.SetDB(env.DB)
+	s.AddAccount(Account{Sender: env.Sender, Point: env.Point})
+	setup(s)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPricingChargesCompletedCommand(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := newTestService(t, env, func(s *Service) {
+		s.UseCommand(middleware.Pricing(middleware.PriceRules{}))
+		s.AddPlugin(paidPlugin{})
+	})
+	if err := s.Handle(hubtest.NewCommand("paid", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertText(t, env.Sender, "done")
+	hubtest.AssertPaid(t, env.Point, "uid", "paid", 10)
+}
+
+func TestPricingRefundsOnlyOnError(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := newTestService(t, env, func(s *Service) {
+		s.UseCommand(middleware.Pricing(middleware.PriceRules{}))
+		s.AddPlugin(paidPlugin{})
+	})
+	if err := s.Handle(hubtest.NewCommand("broken", "").Build()); err == nil {
+		t.Fatal("命令的错误应返回")
+	}
+	hubtest.AssertPaid(t, env.Point, "uid", "broken", 0)
+	// Abort 只停止后续处理, 不表示命令失败
+	if err := s.Handle(hubtest.NewCommand("abort", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertPaid(t, env.Point, "uid", "abort", 10)
+}
+
+func TestPricingSkipsCommandRejectedByPluginMiddleware(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := newTestService(t, env, func(s *Service) {
+		s.UseCommand(middleware.Pricing(middleware.PriceRules{}))
+		s.AddPlugin(paidPlugin{}, middleware.RequireUsers("admin"))
+	})
+	if err := s.Handle(hubtest.NewCommand("paid", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertNoReply(t, env.Sender)
+	hubtest.AssertPaid(t, env.Point, "uid", "paid", 0)
+	if payments := env.Point.Payments(); len(payments) != 0 {
+		t.Fatalf("未执行的命令不应产生积分变动: %+v", payments)
+	}
+}
+
+func TestPricingRefundsErrorSwallowedByReplyError(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := newTestService(t, env, func(s *Service) {
+		s.UseCommand(middleware.Pricing(middleware.PriceRules{}))
+		s.AddPlugin(paidPlugin{}, middleware.ReplyError())
+	})
+	if err := s.Handle(hubtest.NewCommand("broken", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertText(t, env.Sender, "出错了")
+	hubtest.AssertPaid(t, env.Point, "uid", "broken", 0)
+}
+
+// otherPlugin 只有一个命令的插件
+type otherPlugin struct{}
+
+func (otherPlugin) Name() string {
+	return "other"
+}
+
+func (otherPlugin) Commands() []*hub.CommandSpec {
+	return []*hub.CommandSpec{
+		{Name: "other", Usage: "其他命令", Handler: func(ctx *hub.Context, _ *hub.Args) error {
+			return ctx.ReplayText("other")
+		}},
+	}
+}
+
+// handlerPlugin 记录收到的消息内容
+type handlerPlugin struct {
+	contents []string
+}
+
+func (p *handlerPlugin) Handle(ctx *hub.Context) error {
+	p.contents = append(p.contents, ctx.Content)
+	return nil
+}
+
+func TestCommandBypassesHandlerPlugins(t *testing.T) {
+	env := hubtest.NewEnv()
+	handler := &handlerPlugin{}
+	s := newTestService(t, env, func(s *Service) {
+		s.AddPlugin(handler)
+		s.AddPlugin(otherPlugin{})
+	})
+	if err := s.Handle(hubtest.NewCommand("other", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertText(t, env.Sender, "other")
+	if err := s.Handle(hubtest.NewMessage("你好").Build()); err != nil {
+		t.Fatal(err)
+	}
+	// 匹配到命令的消息不交给 Handler 插件
+	if want := []string{"你好"}; !slices.Equal(handler.contents, want) {
+		t.Fatalf("contents = %v, want %v", handler.contents, want)
+	}
+}
+
+func TestHelpListsOnlyCommandsEnabledForAccount(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := NewService()
+	s.AddAccount(Account{Sender: env.Sender, Point: env.Point, Plugins: []string{"other"}})
+	s.AddPlugin(paidPlugin{})
+	s.AddPlugin(otherPlugin{})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Handle(hubtest.NewCommand("help", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertTextContains(t, env.Sender, "#other")
+	for _, text := range env.Sender.Texts() {
+		if strings.Contains(text, "#paid") {
+			t.Fatalf("帮助中不应包含账号未启用的命令: %q", text)
+		}
+	}
+	env.Sender.Reset()
+	if err := s.Handle(hubtest.NewCommand("help", "paid").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertText(t, env.Sender, "未找到命令: paid")
+}
+
+func TestUsageErrorPassesPluginMiddlewares(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := newTestService(t, env, func(s *Service) {
+		s.AddPlugin(paidPlugin{}, middleware.RequireUsers("admin"))
+	})
+	if err := s.Handle(hubtest.NewCommand("echo", "").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertNoReply(t, env.Sender)
+	if err := s.Handle(hubtest.NewCommand("echo", "").User("admin", "admin").Build()); err != nil {
+		t.Fatal(err)
+	}
+	hubtest.AssertTextContains(t, env.Sender, "用法: #echo")
+}
+
+// watchPlugin 记录收到的连接状态
+type watchPlugin struct {
+	otherPlugin
+	events []string
+}
+
+func (p *watchPlugin) ConnectionChanged(account string, connected bool) {
+	p.events = append(p.events, fmt.Sprintf("%s:%v", account, connected))
+}
+
+func TestConnectionWatcherReceivesAccountState(t *testing.T) {
+	env := hubtest.NewEnv()
+	s := NewService()
+	s.AddAccount(Account{Name: "a", Sender: env.Sender, Point: env.Point})
+	s.AddAccount(Account{Name: "b", Sender: env.Sender, Point: env.Point, Plugins: []string{"paid"}})
+	watcher := &watchPlugin{}
+	s.AddPlugin(watcher)
+	s.AddPlugin(paidPlugin{})
+	s.SetConnected("a", true)
+	s.SetConnected("b", true)
+	if len(watcher.events) != 0 {
+		t.Fatalf("插件启动前不应通知: %v", watcher.events)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.SetConnected("a", true)
+	s.SetConnected("a", false)
+	s.SetConnected("b", false)
+	s.SetConnected("a", true)
+	want := []string{"a:true", "a:false", "a:true"}
+	if !slices.Equal(watcher.events, want) {
+		t.Fatalf("events = %v, want %v", watcher.events, want)
+	}
+	if !s.Connected("a") || s.Connected("b") {
+		t.Fatalf("Connected(a) = %v, Connected(b) = %v", s.Connected("a"), s.Connected("b"))
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.SetConnected("a", false)
+	if len(watcher.events) != len(want) {
+		t.Fatalf("插件停止后不应通知: %v", watcher.events)
+	}
+}